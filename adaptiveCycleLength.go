@@ -3,6 +3,8 @@ package ictl
 type adaptiveCycleLength struct {
 	cycleSentTotalSize int
 	cycleSentCount     int
+
+	maxLength int // 0 means unlimited
 }
 
 func (a *adaptiveCycleLength) first() bool {
@@ -19,6 +21,16 @@ func (a *adaptiveCycleLength) sentDF(size int) {
 	a.cycleSentCount++
 }
 
-func (a *adaptiveCycleLength) shouldSendThisDF(size int) bool {
-	return a.cycleSentTotalSize/a.cycleSentCount > size
+// shouldSendThisDF decides whether a DF of size is worth sending rather than
+// starting a new cycle with a KF. ratio is the observed delivery ratio of DFs,
+// in [0, 1]. A DF is worth sending if it's smaller than average packet size
+// in the cycle so far, scaled down by ratio; so cycles get shorter as
+// references get lost more often, and grow back to their full length on
+// clean links. Cycles never exceed maxLength. With ratio 1 and no maxLength,
+// this is the same as comparing against the average alone.
+func (a *adaptiveCycleLength) shouldSendThisDF(size int, ratio float64) bool {
+	if a.maxLength != 0 && a.cycleSentCount >= a.maxLength {
+		return false
+	}
+	return float64(a.cycleSentTotalSize/a.cycleSentCount)*ratio > float64(size)
 }
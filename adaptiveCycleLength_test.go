@@ -0,0 +1,89 @@
+package ictl
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestAdaptiveCycleLength(t *testing.T) {
+	a := &adaptiveCycleLength{maxLength: 4}
+
+	a.sentKF(100)
+	if !a.shouldSendThisDF(40, 1) {
+		t.Fatalf("small DF should be sent on a clean link\n")
+	}
+	if a.shouldSendThisDF(40, 0.3) {
+		t.Fatalf("DF should not be sent when most references are lost\n")
+	}
+
+	for i := 1; i < 4; i++ {
+		a.sentDF(1)
+	}
+	if a.shouldSendThisDF(1, 1) {
+		t.Fatalf("cycle should not exceed max length\n")
+	}
+
+	a.maxLength = 0
+	if !a.shouldSendThisDF(1, 1) {
+		t.Fatalf("cycle length should be unlimited when max length is 0\n")
+	}
+}
+
+func TestMaxEncoderCycleLength(t *testing.T) {
+	config := DefaultEndpointConfig().SetMaxEncoderCycleLength(5)
+	endpoint := NewEndpoint(config)
+	data := make([]byte, 256) // identical messages produce tiny DFs
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	kfs := 0
+	for i := 0; i < 20; i++ {
+		packet, err := endpoint.Encode("test", data, 0)
+		if err != nil {
+			t.Fatalf("calling endpoint.Encode() error: %v\n", err)
+		}
+		var h header
+		h.frameType = packet.Slice()[0]
+		if h.getFrameType() == frameKF {
+			kfs++
+		}
+		packet.Done()
+	}
+	if kfs != 4 {
+		t.Fatalf("got %d KFs in 20 messages with max cycle length 5; expected 4\n", kfs)
+	}
+}
+
+func TestAdaptiveCycleLengthIgnoresReverseDirection(t *testing.T) {
+	endpoint := NewEndpoint(DefaultEndpointConfig())
+	// DFs decoded by the endpoint fail, as their KF is missing
+	pool := newSlicePool(1379)
+	for i := 0; i < 50; i++ {
+		packet, err := encode(pool, []byte{byte(i)}, 1, frameDF, CANone)
+		if err != nil {
+			t.Fatalf("calling encode() error: %v\n", err)
+		}
+		if _, err = endpoint.Decode("test", packet.Slice()); err == nil {
+			t.Fatalf("expected DF with missing reference to fail\n")
+		}
+		packet.Done()
+	}
+
+	data := make([]byte, 256) // identical messages produce tiny DFs
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		packet, err := endpoint.Encode("test", data, 0)
+		if err != nil {
+			t.Fatalf("calling endpoint.Encode() error: %v\n", err)
+		}
+		var h header
+		h.frameType = packet.Slice()[0]
+		if i > 0 && h.getFrameType() != frameDF {
+			t.Fatalf("message #%d: expected a DF; got frame type %d\n", i, h.getFrameType())
+		}
+		packet.Done()
+	}
+}
@@ -10,79 +10,156 @@ func initRing(r *ring.Ring, value interface{}) *ring.Ring {
 	return r
 }
 
+// forgetID clears the slot holding id in ring r, if any. It's used when an ID
+// is put again, e.g., after the ID counter wraps around, so that the slot of
+// the old entry doesn't evict the new one later. Cleared slots are nil, and
+// skipped when iterating.
+func forgetID(r *ring.Ring, id uint32) {
+	for i := r.Len(); i > 0; i-- {
+		if v, ok := r.Value.(uint32); ok && v == id {
+			r.Value = nil
+			return
+		}
+		r = r.Prev()
+	}
+}
+
 type sliceCache struct {
 	lastID *ring.Ring
-	slices map[uint16]*ReusableSlice
+	slices map[uint32]*ReusableSlice
 }
 
 func newSliceCache(size int) *sliceCache {
 	return &sliceCache{
 		lastID: initRing(ring.New(size), nil),
-		slices: make(map[uint16]*ReusableSlice),
+		slices: make(map[uint32]*ReusableSlice),
 	}
 }
 
-func (c *sliceCache) put(id uint16, slice *ReusableSlice) {
+// put adds slice with id, transferring ownership to the cache. If id is
+// already in the cache, e.g., because the ID counter has wrapped around, the
+// old slice is released and replaced.
+func (c *sliceCache) put(id uint32, slice *ReusableSlice) {
+	if oldSlice, ok := c.slices[id]; ok {
+		oldSlice.Done()
+		delete(c.slices, id)
+		forgetID(c.lastID, id)
+	}
 	c.lastID = c.lastID.Next()
 	if c.lastID.Value != nil {
-		oldId := *c.lastID.Value.(*uint16)
+		oldId := c.lastID.Value.(uint32)
 		if oldSlice, ok := c.slices[oldId]; ok {
 			oldSlice.Done()
 			delete(c.slices, oldId)
 		}
 	}
-	c.lastID.Value = &id
+	c.lastID.Value = id
 	c.slices[id] = slice
 }
 
-func (c *sliceCache) get(id uint16) (slice *ReusableSlice, ok bool) {
+func (c *sliceCache) get(id uint32) (slice *ReusableSlice, ok bool) {
 	if slice, ok = c.slices[id]; ok {
 		slice.AddOwner()
 	}
 	return
 }
 
+// clear releases all slices in the cache
+func (c *sliceCache) clear() {
+	for id, slice := range c.slices {
+		slice.Done()
+		delete(c.slices, id)
+	}
+	initRing(c.lastID, nil)
+}
+
+// ids returns IDs of slices currently in the cache, most recently put first
+func (c *sliceCache) ids() (ids []uint32) {
+	r := c.lastID
+	for i := r.Len(); i > 0; i-- {
+		if r.Value != nil {
+			id := r.Value.(uint32)
+			if _, ok := c.slices[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+		r = r.Prev()
+	}
+	return
+}
+
 type sliceWithConfidence struct {
 	slice      *ReusableSlice
 	confidence uint8
 }
 type sliceCacheWithConfidence struct {
 	lastID *ring.Ring
-	slices map[uint16]sliceWithConfidence
+	slices map[uint32]sliceWithConfidence
 }
 
 func newSliceCacheWithConfidence(size int) (c *sliceCacheWithConfidence) {
 	return &sliceCacheWithConfidence{
-		lastID: initRing(ring.New(size), uint16(0)),
-		slices: make(map[uint16]sliceWithConfidence),
+		lastID: initRing(ring.New(size), nil),
+		slices: make(map[uint32]sliceWithConfidence),
 	}
 }
 
-func (c *sliceCacheWithConfidence) put(id uint16, confidence uint8, slice *ReusableSlice) {
+// put is like sliceCache.put, with confidence of the slice
+func (c *sliceCacheWithConfidence) put(id uint32, confidence uint8, slice *ReusableSlice) {
+	if old, ok := c.slices[id]; ok {
+		old.slice.Done()
+		delete(c.slices, id)
+		forgetID(c.lastID, id)
+	}
 	c.lastID = c.lastID.Next()
-	oldId := c.lastID.Value.(uint16)
-	if oldSlice, ok := c.slices[oldId]; ok {
-		oldSlice.slice.Done()
-		delete(c.slices, oldId)
+	if c.lastID.Value != nil {
+		oldId := c.lastID.Value.(uint32)
+		if oldSlice, ok := c.slices[oldId]; ok {
+			oldSlice.slice.Done()
+			delete(c.slices, oldId)
+		}
 	}
 	c.lastID.Value = id
 	c.slices[id] = sliceWithConfidence{slice: slice, confidence: confidence}
 }
 
+func (c *sliceCacheWithConfidence) get(id uint32) (slice *ReusableSlice, ok bool) {
+	var s sliceWithConfidence
+	if s, ok = c.slices[id]; ok {
+		slice = s.slice
+		slice.AddOwner()
+	}
+	return
+}
+
+// clear releases all slices in the cache
+func (c *sliceCacheWithConfidence) clear() {
+	for id, s := range c.slices {
+		s.slice.Done()
+		delete(c.slices, id)
+	}
+	initRing(c.lastID, nil)
+}
+
 // Get the slice with largest confidence value, within last num slices inserted
 // by Put()
-func (c *sliceCacheWithConfidence) getMostConfident(num int) (id uint16, confidence uint8, slice *ReusableSlice) {
+func (c *sliceCacheWithConfidence) getMostConfident(num int) (id uint32, confidence uint8, slice *ReusableSlice) {
 	if num <= 0 {
 		panic(nil)
 	}
 
 	r := c.lastID
-	for i := num; i > 0; i-- {
-		currentID := r.Value.(uint16)
-		if currentSlice, currentOK := c.slices[currentID]; i == num || (currentOK && currentSlice.confidence > confidence) {
-			id = currentID
-			confidence = currentSlice.confidence
-			slice = currentSlice.slice
+	first := true
+	for i := r.Len(); i > 0 && num > 0; i-- {
+		if r.Value != nil {
+			currentID := r.Value.(uint32)
+			if currentSlice, currentOK := c.slices[currentID]; first || (currentOK && currentSlice.confidence > confidence) {
+				id = currentID
+				confidence = currentSlice.confidence
+				slice = currentSlice.slice
+			}
+			first = false
+			num--
 		}
 		r = r.Prev()
 	}
@@ -91,3 +168,19 @@ func (c *sliceCacheWithConfidence) getMostConfident(num int) (id uint16, confide
 
 	return
 }
+
+// Call fn for each slice in the cache, from most recently put to least
+// recently put. The confidence returned by fn replaces the stored one.
+func (c *sliceCacheWithConfidence) updateConfidence(fn func(id uint32, confidence uint8) uint8) {
+	r := c.lastID
+	for i := r.Len(); i > 0; i-- {
+		if r.Value != nil {
+			id := r.Value.(uint32)
+			if s, ok := c.slices[id]; ok {
+				s.confidence = fn(id, s.confidence)
+				c.slices[id] = s
+			}
+		}
+		r = r.Prev()
+	}
+}
@@ -0,0 +1,42 @@
+package ictl
+
+import "testing"
+
+func TestSliceCacheReusedID(t *testing.T) {
+	pool := newSlicePool(16)
+	c := newSliceCache(4)
+
+	old := pool.get()
+	old.AddOwner() // keep it to check it's released by the cache
+	c.put(1, old)
+	c.put(2, pool.get())
+	// ID 1 again, e.g., after the ID counter wrapped around
+	replacement := pool.get()
+	c.put(1, replacement)
+	if old.counter != 1 {
+		t.Fatalf("replaced slice has %d owners; expected 1\n", old.counter)
+	}
+	old.Done()
+
+	if got, ok := c.get(1); !ok || got != replacement {
+		t.Fatalf("ID 1 should map to the replacement\n")
+	} else {
+		got.Done()
+	}
+	if ids := c.ids(); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("unexpected IDs %v\n", ids)
+	}
+
+	// the slot of the old entry must not evict the replacement
+	c.put(3, pool.get())
+	c.put(4, pool.get())
+	c.put(5, pool.get())
+	if _, ok := c.slices[1]; !ok {
+		t.Fatalf("replacement evicted too early; IDs %v\n", c.ids())
+	}
+	c.put(6, pool.get())
+	if _, ok := c.slices[1]; ok {
+		t.Fatalf("replacement should have been evicted; IDs %v\n", c.ids())
+	}
+	c.clear()
+}
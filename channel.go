@@ -0,0 +1,105 @@
+package ictl
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// ErrNoChannelID is returned by DecodeAny when the packet doesn't carry a
+// channel ID, i.e., the peer doesn't have ChannelIDs enabled.
+var ErrNoChannelID = errors.New("packet doesn't carry a channel ID")
+
+// ChannelID returns the default channel ID of context, a 16-bit hash of its
+// name. Different names may end up with the same ID; use RegisterChannel to
+// assign IDs explicitly if that's a concern.
+func ChannelID(context string) uint16 {
+	h := fnv.New32a()
+	h.Write([]byte(context))
+	sum := h.Sum32()
+	return uint16(sum>>16) ^ uint16(sum)
+}
+
+// channelOf returns the channel ID of context named name.
+//
+// Caller must hold e.mapMu.
+func (e *endpoint) channelOf(name string) uint16 {
+	if id, ok := e.registeredIDs[name]; ok {
+		return id
+	}
+	return ChannelID(name)
+}
+
+// resolveChannel returns name of the context with channel ID id: the one
+// registered with it, otherwise a live context with it as default channel ID,
+// otherwise a name generated from id.
+//
+// Caller must hold e.mapMu.
+func (e *endpoint) resolveChannel(id uint16) string {
+	if name, ok := e.registeredNames[id]; ok {
+		return name
+	}
+	if name, ok := e.liveChannels[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("channel-%d", id)
+}
+
+// Caller must hold e.mapMu.
+func (e *endpoint) addLiveChannel(c *endpointContext) {
+	if _, ok := e.liveChannels[c.channel]; !ok {
+		e.liveChannels[c.channel] = c.name
+	}
+}
+
+// Caller must hold e.mapMu.
+func (e *endpoint) removeLiveChannel(c *endpointContext) {
+	if e.liveChannels[c.channel] == c.name {
+		delete(e.liveChannels, c.channel)
+	}
+}
+
+func (e *endpoint) RegisterChannel(context string, id uint16) (err error) {
+	e.mapMu.Lock()
+	defer e.mapMu.Unlock()
+	if e.closed {
+		err = ErrEndpointClosed
+		return
+	}
+	if name, ok := e.registeredNames[id]; ok && name != context {
+		err = fmt.Errorf("channel ID %d is already registered for context %q", id, name)
+		return
+	}
+	if old, ok := e.registeredIDs[context]; ok {
+		delete(e.registeredNames, old)
+	}
+	e.registeredNames[id] = context
+	e.registeredIDs[context] = id
+
+	if c := e.contexts[context]; c != nil {
+		e.removeLiveChannel(c)
+		c.channel = id
+		e.addLiveChannel(c)
+		if c.enc != nil {
+			c.enc.setChannel(id)
+		}
+	}
+	return
+}
+
+func (e *endpoint) DecodeAny(packet []byte) (context string, data *ReusableSlice, err error) {
+	var h header
+	if h, _, err = readHeader(packet); err != nil {
+		return
+	}
+	id, ok := h.getChannel()
+	if !ok {
+		err = ErrNoChannelID
+		return
+	}
+	e.mapMu.Lock()
+	context = e.resolveChannel(id)
+	e.mapMu.Unlock()
+	data, err = e.Decode(context, packet)
+	return
+}
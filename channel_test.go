@@ -0,0 +1,66 @@
+package ictl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestDecodeAny(t *testing.T) {
+	config := DefaultEndpointConfig().SetChannelIDs(true)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	if err := sender.RegisterChannel("status", 7); err != nil {
+		t.Fatalf("calling sender.RegisterChannel() error: %v\n", err)
+	}
+	if err := receiver.RegisterChannel("status", 7); err != nil {
+		t.Fatalf("calling receiver.RegisterChannel() error: %v\n", err)
+	}
+	if err := receiver.RegisterChannel("other", 7); err == nil {
+		t.Fatalf("registering a channel ID twice should fail\n")
+	}
+	// the receiver knows "position" as a live context, but not "video"
+	if _, err := receiver.Feedback("position"); err != nil {
+		t.Fatalf("calling receiver.Feedback() error: %v\n", err)
+	}
+
+	for _, c := range []struct {
+		sent     string
+		expected string
+	}{
+		{"status", "status"},
+		{"position", "position"},
+		{"video", fmt.Sprintf("channel-%d", ChannelID("video"))},
+	} {
+		for i := 0; i < 3; i++ {
+			message := []byte(fmt.Sprintf("%s #%d", c.sent, i))
+			packet, err := sender.Encode(c.sent, message, 0)
+			if err != nil {
+				t.Fatalf("calling sender.Encode() error: %v\n", err)
+			}
+			context, data, err := receiver.DecodeAny(packet.Slice())
+			packet.Done()
+			if err != nil {
+				t.Fatalf("calling receiver.DecodeAny() error: %v\n", err)
+			}
+			if context != c.expected {
+				t.Fatalf("packet of %q decoded in context %q; expected %q\n", c.sent, context, c.expected)
+			}
+			if !bytes.Equal(data.Slice(), message) {
+				t.Fatalf("decoded %q; expected %q\n", data.Slice(), message)
+			}
+			data.Done()
+		}
+	}
+
+	plain := NewEndpoint(DefaultEndpointConfig())
+	packet, err := plain.Encode("status", []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("calling plain.Encode() error: %v\n", err)
+	}
+	defer packet.Done()
+	if _, _, err = receiver.DecodeAny(packet.Slice()); err != ErrNoChannelID {
+		t.Fatalf("expected ErrNoChannelID; got %v\n", err)
+	}
+}
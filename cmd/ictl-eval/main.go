@@ -0,0 +1,144 @@
+// Command ictl-eval replays a recorded message trace through an ICTL encoder
+// and decoder pair across a simulated channel, and reports bandwidth saving,
+// delivery ratio, KF frequency and use of compression algorithms.
+//
+// Usage:
+//
+//	ictl-eval [flags] -trace messages.trace
+//
+// See package github.com/songgao/ictl/eval for the trace format. Loss models
+// are given as "none", "bernoulli:<p>", or "ge:<p>,<r>[,<loss good>,<loss
+// bad>]" for Gilbert-Elliott burst loss.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/songgao/ictl"
+	"github.com/songgao/ictl/eval"
+)
+
+func main() {
+	tracePath := flag.String("trace", "", "trace file to replay")
+	perContext := flag.Bool("per-context", false, "also report each context")
+
+	loss := flag.String("loss", "none", "loss model")
+	reorder := flag.Float64("reorder", 0, "probability that a packet is delayed behind later ones")
+	reorderDepth := flag.Int("reorder-depth", 3, "max number of packets a reordered packet is delayed behind")
+	duplicate := flag.Float64("duplicate", 0, "probability that a packet is delivered twice")
+	seed := flag.Int64("seed", 1, "random seed of the channel")
+	feedback := flag.Bool("feedback", false, "send feedback reports back after each KF")
+
+	cycleLength := flag.Uint("cycle-length", 0, "encoder cycle length; 0 for adaptive")
+	maxCycleLength := flag.Uint("max-cycle-length", 0, "max cycle length in adaptive mode; 0 for no limit")
+	lookback := flag.Int("lookback", 1, "confidence lookback")
+	algorithm := flag.String("algorithm", "auto", "compression algorithm: none, flate, gzip, lzw, zlib or auto")
+	maxPacketSize := flag.Int("max-packet-size", 1379, "max packet size")
+	maxMessageSize := flag.Int("max-message-size", 0, "max message size; 0 for max packet size")
+	checksum := flag.Bool("checksum", false, "include checksums")
+	sequence := flag.Bool("sequence", false, "include sequence numbers in DFs")
+	headerCompression := flag.Bool("header-compression", false, "use compressed DF headers")
+	parityGroup := flag.Int("parity-group", 0, "number of KFs covered by each parity frame; 0 to disable")
+	kfRepeats := flag.Int("kf-repeats", 0, "number of times each KF is repeated")
+	kfRepeatSpacing := flag.Int("kf-repeat-spacing", 1, "number of messages between repeats of a KF")
+	refreshSlices := flag.Int("refresh-slices", 0, "number of packets the reference is refreshed over instead of KFs; 0 to send KFs")
+	flag.Parse()
+
+	if *tracePath == "" {
+		fmt.Fprintln(os.Stderr, "-trace is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var sim eval.Simulation
+	var err error
+	if sim.Channel.Loss, err = eval.ParseLossModel(*loss); err != nil {
+		fail(err)
+	}
+	sim.Channel.Reorder = *reorder
+	sim.Channel.ReorderDepth = *reorderDepth
+	sim.Channel.Duplicate = *duplicate
+	sim.Channel.Seed = *seed
+	sim.Feedback = *feedback
+
+	var cmpAlgr ictl.CompressionAlgorithm
+	if cmpAlgr, err = eval.ParseCompressionAlgorithm(*algorithm); err != nil {
+		fail(err)
+	}
+	sim.Config = ictl.DefaultEndpointConfig().
+		SetEncoderCycleLength(uint16Flag("cycle-length", *cycleLength)).
+		SetMaxEncoderCycleLength(uint16Flag("max-cycle-length", *maxCycleLength)).
+		SetConfidenceLookback(*lookback).
+		SetCompressionAlgorithm(cmpAlgr).
+		SetMaxPacketSize(*maxPacketSize).
+		SetMaxMessageSize(*maxMessageSize).
+		SetChecksum(*checksum).
+		SetSequenceNumbers(*sequence).
+		SetHeaderCompression(*headerCompression).
+		SetParityGroupSize(*parityGroup).
+		SetKFRepeats(*kfRepeats).
+		SetKFRepeatSpacing(*kfRepeatSpacing).
+		SetRefreshSlices(*refreshSlices)
+
+	var f *os.File
+	if f, err = os.Open(*tracePath); err != nil {
+		fail(err)
+	}
+	trace, err := eval.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		fail(err)
+	}
+
+	total, contexts, err := sim.Run(trace)
+	if err != nil {
+		fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "CONTEXT\tMESSAGES\tRAW BYTES\tENCODED BYTES\tSAVING\tDELIVERY\tKF RATIO\tLOST\tMISSING REFS\tCORRUPTED\tALGORITHMS\t")
+	if *perContext {
+		var names []string
+		for name := range contexts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			printRow(w, name, *contexts[name])
+		}
+	}
+	printRow(w, "(total)", total)
+	w.Flush()
+	if total.FeedbackBytes > 0 {
+		fmt.Printf("feedback: %d bytes\n", total.FeedbackBytes)
+	}
+	if total.Duration > 0 {
+		seconds := total.Duration.Seconds()
+		fmt.Printf("duration %v: %.1f kbit/s raw, %.1f kbit/s encoded\n",
+			total.Duration, float64(total.RawBytes)*8/1000/seconds, float64(total.EncodedBytes)*8/1000/seconds)
+	}
+}
+
+func printRow(w *tabwriter.Writer, name string, r eval.Result) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f%%\t%.1f%%\t%.1f%%\t%d\t%d\t%d\t%s\t\n",
+		name, r.Messages, r.RawBytes, r.EncodedBytes, r.Saving()*100, r.DeliveryRatio()*100,
+		r.KFRatio()*100, r.PacketsLost, r.MissingReferences, r.Corrupted, r.AlgorithmMix())
+}
+
+// uint16Flag returns value v of flag name, failing if it's out of range
+func uint16Flag(name string, v uint) uint16 {
+	if v > math.MaxUint16 {
+		fail(fmt.Errorf("-%s must be at most %d; got %d", name, math.MaxUint16, v))
+	}
+	return uint16(v)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"time"
+)
+
+// capturedPacket is a link-layer frame read from a capture file
+type capturedPacket struct {
+	timestamp time.Time
+	linkType  uint32
+	data      []byte
+}
+
+// packetSource yields packets from a capture file; next returns io.EOF at the
+// end of it.
+type packetSource interface {
+	next() (packet capturedPacket, err error)
+}
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 0x00000001
+	pcapngSimplePacket    = 0x00000003
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngOptionEnd       = 0
+	pcapngOptionTSResol   = 9
+	maxCaptureRecordBytes = 1 << 24
+)
+
+// openCapture detects whether r is a classic pcap or a pcapng file
+func openCapture(r io.Reader) (source packetSource, err error) {
+	br := bufio.NewReader(r)
+	var magic []byte
+	if magic, err = br.Peek(4); err != nil {
+		err = fmt.Errorf("reading capture file: %v", err)
+		return
+	}
+	switch {
+	case binary.BigEndian.Uint32(magic) == pcapngSectionHeader:
+		source = &pcapngReader{r: br}
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicros,
+		binary.LittleEndian.Uint32(magic) == pcapMagicNanos,
+		binary.BigEndian.Uint32(magic) == pcapMagicMicros,
+		binary.BigEndian.Uint32(magic) == pcapMagicNanos:
+		source, err = newPcapReader(br)
+	default:
+		err = errors.New("not a pcap or pcapng file")
+	}
+	return
+}
+
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+}
+
+func newPcapReader(r io.Reader) (p *pcapReader, err error) {
+	var hdr [24]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	p = &pcapReader{r: r, order: binary.LittleEndian}
+	magic := p.order.Uint32(hdr[0:4])
+	if magic != pcapMagicMicros && magic != pcapMagicNanos {
+		p.order = binary.BigEndian
+		magic = p.order.Uint32(hdr[0:4])
+	}
+	p.nanos = magic == pcapMagicNanos
+	p.linkType = p.order.Uint32(hdr[20:24]) & 0x0fffffff // higher bits are FCS info
+	return
+}
+
+func (p *pcapReader) next() (packet capturedPacket, err error) {
+	var hdr [16]byte
+	if _, err = io.ReadFull(p.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated pcap record header")
+		}
+		return
+	}
+	sec := p.order.Uint32(hdr[0:4])
+	frac := p.order.Uint32(hdr[4:8])
+	length := p.order.Uint32(hdr[8:12])
+	if length > maxCaptureRecordBytes {
+		err = fmt.Errorf("pcap record too large (%d bytes)", length)
+		return
+	}
+	packet.data = make([]byte, length)
+	if _, err = io.ReadFull(p.r, packet.data); err != nil {
+		err = errors.New("truncated pcap record")
+		return
+	}
+	if p.nanos {
+		packet.timestamp = time.Unix(int64(sec), int64(frac))
+	} else {
+		packet.timestamp = time.Unix(int64(sec), int64(frac)*1000)
+	}
+	packet.linkType = p.linkType
+	return
+}
+
+type pcapngInterfaceInfo struct {
+	linkType uint32
+	perSec   float64 // timestamp units per second
+}
+
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterfaceInfo
+}
+
+func (p *pcapngReader) next() (packet capturedPacket, err error) {
+	for {
+		var blockType uint32
+		var body []byte
+		if blockType, body, err = p.readBlock(); err != nil {
+			return
+		}
+		switch blockType {
+		case pcapngSectionHeader:
+			p.interfaces = nil // interfaces are per section
+		case pcapngInterface:
+			if len(body) < 8 {
+				err = errors.New("truncated pcapng interface block")
+				return
+			}
+			info := pcapngInterfaceInfo{linkType: uint32(p.order.Uint16(body[0:2])), perSec: 1e6}
+			p.parseInterfaceOptions(body[8:], &info)
+			p.interfaces = append(p.interfaces, info)
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				err = errors.New("truncated pcapng packet block")
+				return
+			}
+			id := p.order.Uint32(body[0:4])
+			if int(id) >= len(p.interfaces) {
+				err = fmt.Errorf("pcapng packet on unknown interface %d", id)
+				return
+			}
+			ts := uint64(p.order.Uint32(body[4:8]))<<32 | uint64(p.order.Uint32(body[8:12]))
+			length := p.order.Uint32(body[12:16])
+			if uint64(length) > uint64(len(body)-20) {
+				err = errors.New("truncated pcapng packet block")
+				return
+			}
+			packet.data = body[20 : 20+length]
+			packet.linkType = p.interfaces[id].linkType
+			packet.timestamp = p.interfaces[id].time(ts)
+			return
+		case pcapngSimplePacket:
+			if len(p.interfaces) == 0 {
+				err = errors.New("pcapng packet without interface")
+				return
+			}
+			if len(body) < 4 {
+				err = errors.New("truncated pcapng packet block")
+				return
+			}
+			length := p.order.Uint32(body[0:4])
+			if uint64(length) > uint64(len(body)-4) {
+				length = uint32(len(body) - 4) // snapped
+			}
+			packet.data = body[4 : 4+length]
+			packet.linkType = p.interfaces[0].linkType
+			return
+		}
+		// other blocks, e.g., statistics or name resolution, are skipped
+	}
+}
+
+// readBlock reads a pcapng block, returning its body without type and length
+// fields. A section header block sets byte order for what follows.
+func (p *pcapngReader) readBlock() (blockType uint32, body []byte, err error) {
+	var hdr [8]byte
+	if _, err = io.ReadFull(p.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated pcapng block")
+		}
+		return
+	}
+	if binary.BigEndian.Uint32(hdr[0:4]) == pcapngSectionHeader {
+		var bom [4]byte
+		if _, err = io.ReadFull(p.r, bom[:]); err != nil {
+			err = errors.New("truncated pcapng section header")
+			return
+		}
+		switch {
+		case binary.LittleEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+			p.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+			p.order = binary.BigEndian
+		default:
+			err = errors.New("invalid pcapng byte-order magic")
+			return
+		}
+		blockType = pcapngSectionHeader
+		length := p.order.Uint32(hdr[4:8])
+		if length < 16 || length > maxCaptureRecordBytes {
+			err = fmt.Errorf("invalid pcapng block length %d", length)
+			return
+		}
+		_, err = io.CopyN(ioutil.Discard, p.r, int64(length-12))
+		return
+	}
+	if p.order == nil {
+		err = errors.New("pcapng block before section header")
+		return
+	}
+	blockType = p.order.Uint32(hdr[0:4])
+	length := p.order.Uint32(hdr[4:8])
+	if length < 12 || length%4 != 0 || length > maxCaptureRecordBytes {
+		err = fmt.Errorf("invalid pcapng block length %d", length)
+		return
+	}
+	rest := make([]byte, length-8)
+	if _, err = io.ReadFull(p.r, rest); err != nil {
+		err = errors.New("truncated pcapng block")
+		return
+	}
+	body = rest[:len(rest)-4] // without trailing block length
+	return
+}
+
+func (p *pcapngReader) parseInterfaceOptions(options []byte, info *pcapngInterfaceInfo) {
+	for len(options) >= 4 {
+		code := p.order.Uint16(options[0:2])
+		length := int(p.order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			return
+		}
+		if code == pcapngOptionTSResol && length >= 1 {
+			var perSec float64
+			if resol := options[4]; resol&0x80 == 0 {
+				perSec = math.Pow10(int(resol))
+			} else {
+				perSec = math.Pow(2, float64(resol&0x7f))
+			}
+			if perSec <= 1e18 { // finer resolutions don't fit in uint64 anyway
+				info.perSec = perSec
+			}
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+}
+
+func (i pcapngInterfaceInfo) time(ts uint64) time.Time {
+	sec := ts / uint64(i.perSec)
+	frac := float64(ts%uint64(i.perSec)) / i.perSec
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// Link types, see https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeLinuxSL2 = 276
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	ipProtoUDP = 17
+)
+
+// udpDatagram is a UDP datagram extracted from a captured packet
+type udpDatagram struct {
+	src, dst net.UDPAddr
+	payload  []byte
+}
+
+// extractUDP finds the UDP datagram carried in a captured packet; ok is false
+// if it doesn't carry a complete one, e.g., it's another protocol or an IP
+// fragment.
+func extractUDP(packet capturedPacket) (datagram udpDatagram, ok bool) {
+	data := packet.data
+	var etherType uint16
+	switch packet.linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case linkTypeLinuxSL2:
+		if len(data) < 20 {
+			return
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return
+		}
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if packet.linkType == linkTypeLoop || family > 0xffff {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		data = data[4:]
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 10, 24, 28, 30: // AF_INET6 differs among systems
+			etherType = etherTypeIPv6
+		}
+	case linkTypeRaw:
+		if len(data) < 1 {
+			return
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	case linkTypeIPv4:
+		etherType = etherTypeIPv4
+	case linkTypeIPv6:
+		etherType = etherTypeIPv6
+	}
+
+	var udp []byte
+	switch etherType {
+	case etherTypeIPv4:
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		flagsAndOffset := binary.BigEndian.Uint16(data[6:8])
+		if ihl < 20 || total < ihl || total > len(data) || data[9] != ipProtoUDP {
+			return
+		}
+		if flagsAndOffset&0x3fff != 0 { // more fragments, or not the first one
+			return
+		}
+		datagram.src.IP = net.IP(append([]byte(nil), data[12:16]...))
+		datagram.dst.IP = net.IP(append([]byte(nil), data[16:20]...))
+		udp = data[ihl:total]
+	case etherTypeIPv6:
+		if len(data) < 40 || data[0]>>4 != 6 {
+			return
+		}
+		total := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+		if total > len(data) {
+			return
+		}
+		datagram.src.IP = net.IP(append([]byte(nil), data[8:24]...))
+		datagram.dst.IP = net.IP(append([]byte(nil), data[24:40]...))
+		next, offset := data[6], 40
+		for next == 0 || next == 43 || next == 60 { // hop-by-hop, routing, destination options
+			if offset+8 > total {
+				return
+			}
+			next, offset = data[offset], offset+(int(data[offset+1])+1)*8
+		}
+		if next != ipProtoUDP || offset > total {
+			return
+		}
+		udp = data[offset:total]
+	default:
+		return
+	}
+
+	if len(udp) < 8 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		return
+	}
+	datagram.src.Port = int(binary.BigEndian.Uint16(udp[0:2]))
+	datagram.dst.Port = int(binary.BigEndian.Uint16(udp[2:4]))
+	datagram.payload = udp[8:length]
+	ok = true
+	return
+}
+
+// hexSource yields packets from lines of hex digits, one packet per line.
+// Whitespace within a line is ignored; empty lines and lines starting with
+// "#" are skipped. A line can be prefixed with a flow name and ":" to tell
+// packets of different flows apart.
+type hexSource struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newHexSource(r io.Reader) *hexSource {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCaptureRecordBytes)
+	return &hexSource{scanner: scanner}
+}
+
+// next returns payload of the next packet and the flow it belongs to, which
+// is empty if not specified
+func (s *hexSource) next() (flow string, payload []byte, err error) {
+	for s.scanner.Scan() {
+		s.line++
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			flow, line = string(bytes.TrimSpace(line[:i])), line[i+1:]
+		}
+		digits := bytes.Join(bytes.Fields(line), nil)
+		payload = make([]byte, len(digits)/2)
+		if _, err = hex.Decode(payload, digits); err != nil {
+			err = fmt.Errorf("line %d: %v", s.line, err)
+		}
+		return
+	}
+	if err = s.scanner.Err(); err == nil {
+		err = io.EOF
+	}
+	return
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/songgao/ictl"
+)
+
+// ethernetUDP builds an Ethernet frame carrying an IPv4 UDP datagram
+func ethernetUDP(srcPort, dstPort uint16, payload []byte) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 12)) // MAC addresses
+	binary.Write(&b, binary.BigEndian, uint16(etherTypeIPv4))
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = ipProtoUDP
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	b.Write(ip)
+	binary.Write(&b, binary.BigEndian, srcPort)
+	binary.Write(&b, binary.BigEndian, dstPort)
+	binary.Write(&b, binary.BigEndian, uint16(8+len(payload)))
+	binary.Write(&b, binary.BigEndian, uint16(0))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func pcapFile(frames [][]byte) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&b, le, uint32(pcapMagicMicros))
+	binary.Write(&b, le, uint16(2))
+	binary.Write(&b, le, uint16(4))
+	binary.Write(&b, le, int32(0))
+	binary.Write(&b, le, uint32(0))
+	binary.Write(&b, le, uint32(65535))
+	binary.Write(&b, le, uint32(linkTypeEthernet))
+	for i, frame := range frames {
+		binary.Write(&b, le, uint32(1000+i))
+		binary.Write(&b, le, uint32(500))
+		binary.Write(&b, le, uint32(len(frame)))
+		binary.Write(&b, le, uint32(len(frame)))
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+func pcapngBlock(b *bytes.Buffer, order binary.ByteOrder, blockType uint32, body []byte) {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	binary.Write(b, order, blockType)
+	binary.Write(b, order, uint32(12+len(body)))
+	b.Write(body)
+	binary.Write(b, order, uint32(12+len(body)))
+}
+
+func pcapngFile(order binary.ByteOrder, frames [][]byte) []byte {
+	var b bytes.Buffer
+	var body bytes.Buffer
+	binary.Write(&body, order, uint32(pcapngByteOrderMagic))
+	binary.Write(&body, order, uint16(1))
+	binary.Write(&body, order, uint16(0))
+	binary.Write(&body, order, int64(-1))
+	pcapngBlock(&b, order, pcapngSectionHeader, body.Bytes())
+
+	body.Reset()
+	binary.Write(&body, order, uint16(linkTypeEthernet))
+	binary.Write(&body, order, uint16(0))
+	binary.Write(&body, order, uint32(0))
+	binary.Write(&body, order, uint16(pcapngOptionTSResol))
+	binary.Write(&body, order, uint16(1))
+	body.Write([]byte{9, 0, 0, 0}) // nanoseconds
+	binary.Write(&body, order, uint32(0))
+	pcapngBlock(&b, order, pcapngInterface, body.Bytes())
+
+	for i, frame := range frames {
+		body.Reset()
+		ts := uint64(1000+i)*1e9 + 500
+		binary.Write(&body, order, uint32(0))
+		binary.Write(&body, order, uint32(ts>>32))
+		binary.Write(&body, order, uint32(ts))
+		binary.Write(&body, order, uint32(len(frame)))
+		binary.Write(&body, order, uint32(len(frame)))
+		body.Write(frame)
+		pcapngBlock(&b, order, pcapngEnhancedPacket, body.Bytes())
+	}
+	return b.Bytes()
+}
+
+func TestCaptureFormats(t *testing.T) {
+	frames := [][]byte{
+		ethernetUDP(5000, 6000, []byte("first")),
+		ethernetUDP(6000, 5000, []byte("second")),
+	}
+	for name, file := range map[string][]byte{
+		"pcap":      pcapFile(frames),
+		"pcapng-le": pcapngFile(binary.LittleEndian, frames),
+		"pcapng-be": pcapngFile(binary.BigEndian, frames),
+	} {
+		source, err := openCapture(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("%s: calling openCapture() error: %v\n", name, err)
+		}
+		for i, expected := range []string{"first", "second"} {
+			packet, err := source.next()
+			if err != nil {
+				t.Fatalf("%s: reading packet #%d error: %v\n", name, i, err)
+			}
+			if packet.timestamp.Unix() != int64(1000+i) {
+				t.Fatalf("%s: packet #%d has timestamp %v\n", name, i, packet.timestamp)
+			}
+			datagram, ok := extractUDP(packet)
+			if !ok || string(datagram.payload) != expected {
+				t.Fatalf("%s: packet #%d: got %q; expected %q\n", name, i, datagram.payload, expected)
+			}
+			if i == 0 && (datagram.src.String() != "10.0.0.1:5000" || datagram.dst.String() != "10.0.0.2:6000") {
+				t.Fatalf("%s: unexpected addresses %v -> %v\n", name, &datagram.src, &datagram.dst)
+			}
+		}
+		if _, err = source.next(); err != io.EOF {
+			t.Fatalf("%s: expected io.EOF at the end; got %v\n", name, err)
+		}
+	}
+}
+
+func TestInspectHex(t *testing.T) {
+	sender := ictl.NewEndpoint(ictl.DefaultEndpointConfig().SetEncoderCycleLength(4))
+	var dump bytes.Buffer
+	dump.WriteString("# captured on the vehicle\n")
+	for i := 0; i < 6; i++ {
+		packet, err := sender.Encode("test", []byte("periodic message"), 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		if i != 4 { // lose the second KF
+			fmt.Fprintf(&dump, "can: % X\n", packet.Slice())
+		}
+		packet.Done()
+	}
+
+	var out bytes.Buffer
+	i := newInspector(&out, ictl.DefaultEndpointConfig())
+	i.decode = true
+	if err := inspectHex(i, &dump); err != nil {
+		t.Fatalf("calling inspectHex() error: %v\n", err)
+	}
+	i.report()
+
+	f := i.flows["can"]
+	if f == nil || f.packets != 5 || f.frameTypes[ictl.FrameKF] != 1 || f.frameTypes[ictl.FrameDF] != 4 {
+		t.Fatalf("unexpected flow %+v\n%s", f, out.String())
+	}
+	if stats := f.endpoint.Stats(); stats.MessagesDecoded != 4 || stats.MissingReferences != 1 || f.decodeErrors != 1 {
+		t.Fatalf("unexpected stats %+v with %d decode errors\n%s", stats, f.decodeErrors, out.String())
+	}
+	if !strings.Contains(out.String(), "MISSING REFS") {
+		t.Fatalf("summary is missing\n%s", out.String())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/songgao/ictl"
+)
+
+// flow holds what's been seen in packets from one source to one destination
+type flow struct {
+	name     string
+	endpoint ictl.Endpoint // nil unless decoding
+
+	packets     uint64
+	bytes       uint64
+	headerBytes uint64
+	frameTypes  map[ictl.FrameType]uint64
+	algorithms  map[ictl.CompressionAlgorithm]uint64
+
+	parseErrors  uint64 // packets that aren't ICTL, or are corrupted
+	decodeErrors uint64
+}
+
+type inspector struct {
+	out     io.Writer
+	config  ictl.EndpointConfig
+	decode  bool // run packets through Endpoint.Decode
+	quiet   bool // don't print each packet
+	verbose bool // print decoded messages
+
+	flows map[string]*flow
+	order []*flow // in order of first appearance
+}
+
+func newInspector(out io.Writer, config ictl.EndpointConfig) *inspector {
+	return &inspector{
+		out:    out,
+		config: config,
+		flows:  make(map[string]*flow),
+	}
+}
+
+func (i *inspector) flow(name string) (f *flow) {
+	if f = i.flows[name]; f == nil {
+		f = &flow{
+			name:       name,
+			frameTypes: make(map[ictl.FrameType]uint64),
+			algorithms: make(map[ictl.CompressionAlgorithm]uint64),
+		}
+		if i.decode {
+			f.endpoint = ictl.NewEndpoint(i.config)
+		}
+		i.flows[name] = f
+		i.order = append(i.order, f)
+	}
+	return
+}
+
+// handle inspects an ICTL packet belonging to flow named name. timestamp is
+// zero if unknown.
+func (i *inspector) handle(timestamp time.Time, name string, packet []byte) {
+	f := i.flow(name)
+	f.packets++
+	f.bytes += uint64(len(packet))
+
+	var line []string
+	if !timestamp.IsZero() {
+		line = append(line, timestamp.Format("15:04:05.000000"))
+	}
+	line = append(line, name)
+
+	info, err := ictl.ParsePacket(packet)
+	if err != nil {
+		f.parseErrors++
+		line = append(line, fmt.Sprintf("not parsable (%d bytes): %v", len(packet), err))
+		i.print(line)
+		return
+	}
+	f.headerBytes += uint64(info.HeaderLength)
+	f.frameTypes[info.FrameType]++
+	f.algorithms[info.CompressionAlgorithm]++
+	line = append(line, info.String())
+
+	if i.decode && info.FrameType != ictl.FrameFeedback && info.FrameType != ictl.FrameRequest {
+		var data *ictl.ReusableSlice
+		if info.HasChannel {
+			var context string
+			context, data, err = f.endpoint.DecodeAny(packet)
+			line = append(line, "context="+context)
+		} else {
+			data, err = f.endpoint.Decode(name, packet)
+		}
+		switch {
+		case err != nil:
+			f.decodeErrors++
+			line = append(line, "decode error: "+err.Error())
+		case data == nil:
+			line = append(line, "(waiting for more fragments)")
+		default:
+			line = append(line, fmt.Sprintf("message=%dB", len(data.Slice())))
+			if i.verbose {
+				line = append(line, hex.EncodeToString(data.Slice()))
+			}
+			data.Done()
+		}
+	}
+	i.print(line)
+}
+
+func (i *inspector) print(line []string) {
+	if !i.quiet {
+		fmt.Fprintln(i.out, strings.Join(line, " "))
+	}
+}
+
+// report prints a summary of each flow
+func (i *inspector) report() {
+	w := tabwriter.NewWriter(i.out, 0, 4, 2, ' ', 0)
+	columns := "FLOW\tPACKETS\tBYTES\tHEADERS\tKF\tDF\tFEEDBACK\tALGORITHMS\tUNPARSABLE"
+	if i.decode {
+		columns += "\tMESSAGES\tMESSAGE BYTES\tMISSING REFS\tDECODE ERRORS\tRATIO"
+	}
+	fmt.Fprintln(w, columns)
+	for _, f := range i.order {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%d",
+			f.name, f.packets, f.bytes, f.headerBytes,
+			f.frameTypes[ictl.FrameKF], f.frameTypes[ictl.FrameDF], f.frameTypes[ictl.FrameFeedback],
+			algorithmMix(f.algorithms), f.parseErrors)
+		if i.decode {
+			stats := f.endpoint.Stats()
+			ratio := "-"
+			if stats.DecodedBytes > 0 {
+				ratio = fmt.Sprintf("%.3f", float64(stats.ReceivedBytes)/float64(stats.DecodedBytes))
+			}
+			fmt.Fprintf(w, "\t%d\t%d\t%d\t%d\t%s",
+				stats.MessagesDecoded, stats.DecodedBytes, stats.MissingReferences, f.decodeErrors, ratio)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	if i.decode {
+		fmt.Fprintln(i.out, "RATIO is bytes of packets decoded over bytes of messages reconstructed from them.")
+	}
+}
+
+// algorithmMix formats counts of packets by compression algorithm, e.g.,
+// "flate:10,none:2"
+func algorithmMix(algorithms map[ictl.CompressionAlgorithm]uint64) string {
+	var keys []int
+	for a := range algorithms {
+		keys = append(keys, int(a))
+	}
+	sort.Ints(keys)
+	var parts []string
+	for _, a := range keys {
+		parts = append(parts, fmt.Sprintf("%v:%d", ictl.CompressionAlgorithm(a), algorithms[ictl.CompressionAlgorithm(a)]))
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ",")
+}
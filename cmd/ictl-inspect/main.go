@@ -0,0 +1,110 @@
+// Command ictl-inspect prints ICTL packets found in a packet capture, or in
+// hex dumps, and summarizes them per flow.
+//
+// Usage:
+//
+//	ictl-inspect [flags] -pcap capture.pcapng -port 5000
+//	ictl-inspect [flags] -hex dump.txt
+//
+// Classic pcap and pcapng files are supported; UDP payloads to or from -port
+// (any port if 0) are taken as ICTL packets, and each direction between two
+// addresses is a flow. In hex dumps, each line is a packet in hex digits,
+// optionally prefixed with a flow name and ":".
+//
+// With -decode, packets of each flow are decoded with an Endpoint, as a
+// receiver would, which reports missing references and the compression
+// ratio. Packets carrying channel IDs are decoded with DecodeAny.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/songgao/ictl"
+)
+
+func main() {
+	pcapPath := flag.String("pcap", "", "pcap or pcapng file to read")
+	hexPath := flag.String("hex", "", `file of hex lines to read; "-" for stdin`)
+	port := flag.Int("port", 0, "UDP port of ICTL traffic in captures; 0 for any")
+	decode := flag.Bool("decode", false, "decode packets of each flow")
+	maxMessageSize := flag.Int("max-message-size", 65535, "max size of decoded messages")
+	quiet := flag.Bool("q", false, "only print the summary")
+	verbose := flag.Bool("v", false, "print decoded messages in hex")
+	flag.Parse()
+
+	if (*pcapPath == "") == (*hexPath == "") {
+		fmt.Fprintln(os.Stderr, "exactly one of -pcap and -hex is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := ictl.DefaultEndpointConfig().SetMaxPacketSize(65535).SetMaxMessageSize(*maxMessageSize)
+	i := newInspector(os.Stdout, config)
+	i.decode, i.quiet, i.verbose = *decode, *quiet, *verbose
+
+	var err error
+	if *pcapPath != "" {
+		err = withFile(*pcapPath, func(r io.Reader) error { return inspectCapture(i, r, *port) })
+	} else {
+		err = withFile(*hexPath, func(r io.Reader) error { return inspectHex(i, r) })
+	}
+	i.report()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func withFile(path string, fn func(r io.Reader) error) (err error) {
+	if path == "-" {
+		return fn(os.Stdin)
+	}
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+func inspectCapture(i *inspector, r io.Reader, port int) (err error) {
+	var source packetSource
+	if source, err = openCapture(r); err != nil {
+		return
+	}
+	for {
+		var packet capturedPacket
+		if packet, err = source.next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+		datagram, ok := extractUDP(packet)
+		if !ok || (port != 0 && datagram.src.Port != port && datagram.dst.Port != port) {
+			continue
+		}
+		name := datagram.src.String() + "->" + datagram.dst.String()
+		i.handle(packet.timestamp, name, datagram.payload)
+	}
+}
+
+func inspectHex(i *inspector, r io.Reader) (err error) {
+	source := newHexSource(r)
+	for {
+		var name string
+		var payload []byte
+		if name, payload, err = source.next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+		if name == "" {
+			name = "-"
+		}
+		i.handle(time.Time{}, name, payload)
+	}
+}
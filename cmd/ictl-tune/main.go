@@ -0,0 +1,166 @@
+// Command ictl-tune replays a recorded message trace with each combination
+// of encoder cycle length, confidence lookback and compression algorithm
+// across a simulated channel, and recommends the combination that saves the
+// most bandwidth while delivering at least a given portion of messages.
+//
+// Usage:
+//
+//	ictl-tune [flags] -trace messages.trace
+//
+// Values to sweep are given as comma-separated lists, e.g., -cycle-lengths
+// 0,8,32. Channel flags are the same as ictl-eval's.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/songgao/ictl"
+	"github.com/songgao/ictl/eval"
+)
+
+func main() {
+	tracePath := flag.String("trace", "", "trace file to replay")
+	minDelivery := flag.Float64("min-delivery", 0.95, "min delivery ratio of the recommended configuration")
+	runs := flag.Int("runs", 1, "number of runs of each configuration, with consecutive seeds")
+	top := flag.Int("top", 20, "number of configurations to list; 0 for all")
+
+	cycleLengths := flag.String("cycle-lengths", "0,4,8,16,32,64", "encoder cycle lengths to sweep; 0 for adaptive")
+	lookbacks := flag.String("lookbacks", "1,2,4", "confidence lookbacks to sweep")
+	algorithms := flag.String("algorithms", "auto,flate,zlib,lzw,none", "compression algorithms to sweep")
+
+	loss := flag.String("loss", "none", "loss model")
+	reorder := flag.Float64("reorder", 0, "probability that a packet is delayed behind later ones")
+	reorderDepth := flag.Int("reorder-depth", 3, "max number of packets a reordered packet is delayed behind")
+	duplicate := flag.Float64("duplicate", 0, "probability that a packet is delivered twice")
+	seed := flag.Int64("seed", 1, "random seed of the channel")
+	feedback := flag.Bool("feedback", false, "send feedback reports back after each KF")
+
+	maxCycleLength := flag.Uint("max-cycle-length", 0, "max cycle length in adaptive mode; 0 for no limit")
+	maxPacketSize := flag.Int("max-packet-size", 1379, "max packet size")
+	maxMessageSize := flag.Int("max-message-size", 0, "max message size; 0 for max packet size")
+	checksum := flag.Bool("checksum", false, "include checksums")
+	sequence := flag.Bool("sequence", false, "include sequence numbers in DFs")
+	headerCompression := flag.Bool("header-compression", false, "use compressed DF headers")
+	flag.Parse()
+
+	if *tracePath == "" {
+		fmt.Fprintln(os.Stderr, "-trace is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var sim eval.Simulation
+	var err error
+	if sim.Channel.Loss, err = eval.ParseLossModel(*loss); err != nil {
+		fail(err)
+	}
+	sim.Channel.Reorder = *reorder
+	sim.Channel.ReorderDepth = *reorderDepth
+	sim.Channel.Duplicate = *duplicate
+	sim.Channel.Seed = *seed
+	sim.Feedback = *feedback
+	sim.Config = ictl.DefaultEndpointConfig().
+		SetMaxEncoderCycleLength(uint16Flag("max-cycle-length", *maxCycleLength)).
+		SetMaxPacketSize(*maxPacketSize).
+		SetMaxMessageSize(*maxMessageSize).
+		SetChecksum(*checksum).
+		SetSequenceNumbers(*sequence).
+		SetHeaderCompression(*headerCompression)
+
+	tuner := eval.NewTuner(sim, *minDelivery)
+	tuner.Runs = *runs
+	tuner.CycleLengths = nil
+	for _, v := range splitList(*cycleLengths) {
+		var n uint64
+		if n, err = strconv.ParseUint(v, 10, 16); err != nil {
+			fail(fmt.Errorf("invalid cycle length %q", v))
+		}
+		tuner.CycleLengths = append(tuner.CycleLengths, uint16(n))
+	}
+	tuner.ConfidenceLookbacks = nil
+	for _, v := range splitList(*lookbacks) {
+		var n int
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			fail(fmt.Errorf("invalid confidence lookback %q", v))
+		}
+		tuner.ConfidenceLookbacks = append(tuner.ConfidenceLookbacks, n)
+	}
+	tuner.Algorithms = nil
+	for _, v := range splitList(*algorithms) {
+		var a ictl.CompressionAlgorithm
+		if a, err = eval.ParseCompressionAlgorithm(v); err != nil {
+			fail(err)
+		}
+		tuner.Algorithms = append(tuner.Algorithms, a)
+	}
+
+	var f *os.File
+	if f, err = os.Open(*tracePath); err != nil {
+		fail(err)
+	}
+	trace, err := eval.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		fail(err)
+	}
+
+	candidates, err := tuner.Tune(trace)
+	if err != nil {
+		fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "RANK\tCYCLE LENGTH\tLOOKBACK\tALGORITHM\tENCODED BYTES\tSAVING\tDELIVERY\tKF RATIO\tMISSING REFS\tOK\t")
+	for i, c := range candidates {
+		if *top > 0 && i >= *top {
+			break
+		}
+		cycleLength := strconv.Itoa(int(c.CycleLength))
+		if c.CycleLength == 0 {
+			cycleLength = "adaptive"
+		}
+		ok := ""
+		if c.Feasible {
+			ok = "yes"
+		}
+		r := c.Result
+		fmt.Fprintf(w, "%d\t%s\t%d\t%v\t%d\t%.1f%%\t%.1f%%\t%.1f%%\t%d\t%s\t\n",
+			i+1, cycleLength, c.ConfidenceLookback, c.Algorithm, r.EncodedBytes, r.Saving()*100,
+			r.DeliveryRatio()*100, r.KFRatio()*100, r.MissingReferences, ok)
+	}
+	w.Flush()
+
+	if len(candidates) == 0 || !candidates[0].Feasible {
+		fmt.Fprintf(os.Stderr, "no configuration delivers at least %.1f%% of messages\n", *minDelivery*100)
+		os.Exit(1)
+	}
+	fmt.Printf("recommended: %s\n", candidates[0].Flags())
+}
+
+func splitList(s string) (values []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return
+}
+
+// uint16Flag returns value v of flag name, failing if it's out of range
+func uint16Flag(name string, v uint) uint16 {
+	if v > math.MaxUint16 {
+		fail(fmt.Errorf("-%s must be at most %d; got %d", name, math.MaxUint16, v))
+	}
+	return uint16(v)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -1,119 +1,840 @@
 package ictl
 
-import "fmt"
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+// ErrChecksumMismatch is returned by Decode when the reconstructed message
+// doesn't match the checksum carried in the packet, e.g., when a DF is
+// decoded against a wrong KF.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
 
 type encoder struct {
-	pool    *slicePool
+	pool    *slicePool // for packets
+	msgPool *slicePool // for messages
 	sentKFs *sliceCacheWithConfidence
 
-	idCounter          uint16
+	idCounter          uint32 // wraps at 1<<16 unless extendedIDs
 	cycleLength        uint16
 	confidenceLookback int
 	cmpAlgr            CompressionAlgorithm
+	checksum           bool
+	sequence           bool
+	channelIDs         bool
+	channel            uint16
+	extendedIDs        bool
+	headerCompression  bool
+
+	lastKFID uint32 // ID of the latest KF sent
+	kfsSent  int    // number of KFs sent since the encoder was created
+	epoch    uint16 // see flagEpoch
+
+	// whether the next encode call sends a KF, as requested by ForceKeyFrame
+	// or a resync request
+	forceKF bool
+
+	maxRetransmits     int
+	retransmitInterval time.Duration
+	retransmits        map[uint32]retransmitState // by KF ID
+
+	parityGroupSize int
+	parityIDs       []uint32 // KFs sent since the latest parity frame
+
+	kfRepeats       int
+	kfRepeatSpacing int
+	repeatID        uint32 // latest KF sent, to be repeated
+	repeatsLeft     int
+	repeatIn        int // messages until the next repeat
+
+	refreshSlices     int
+	refreshData       *ReusableSlice // reference being refreshed; nil if none
+	refreshID         uint32
+	refreshIndex      int // of the next segment
+	refreshConfidence uint8
+	refreshed         map[uint32]bool // cached KFs sent as refreshes, by ID
+
+	// frames to be sent after the packet returned by the latest encode call
+	// with maxFragments of 1; see Endpoint.Pending
+	pending []*ReusableSlice
 
 	adaptive *adaptiveCycleLength
 	dStats   *decoderStats
+
+	// delivery ratio reported by the receiver through feedback; negative if
+	// none has been received yet
+	reportedRatio float64
+
+	stats Stats
+
+	closed bool
+	mu     *sync.Mutex
 }
 
-func newEncoder(pool *slicePool, config endpointConfig, dStats *decoderStats) *encoder {
+func newEncoder(pool *slicePool, msgPool *slicePool, config endpointConfig, channel uint16, dStats *decoderStats) *encoder {
 	return &encoder{
 		pool:               pool,
+		msgPool:            msgPool,
 		sentKFs:            newSliceCacheWithConfidence(32),
 		cycleLength:        config.cycleLength,
 		confidenceLookback: config.confidenceLookback,
 		cmpAlgr:            config.cmpAlgr,
-		adaptive:           new(adaptiveCycleLength),
+		checksum:           config.checksum,
+		sequence:           config.sequenceNumbers,
+		channelIDs:         config.channelIDs,
+		channel:            channel,
+		extendedIDs:        config.extendedIDs,
+		headerCompression:  config.headerCompression,
+		epoch:              newEpoch(),
+		maxRetransmits:     config.maxRetransmits,
+		retransmitInterval: config.retransmitInterval,
+		retransmits:        make(map[uint32]retransmitState),
+		parityGroupSize:    config.parityGroupSize,
+		kfRepeats:          config.kfRepeats,
+		kfRepeatSpacing:    config.kfRepeatSpacing,
+		refreshSlices:      config.refreshSlices,
+		refreshed:          make(map[uint32]bool),
+		adaptive:           &adaptiveCycleLength{maxLength: int(config.maxCycleLength)},
 		dStats:             dStats,
+		reportedRatio:      -1,
+		mu:                 new(sync.Mutex),
+	}
+}
+
+// newEpoch returns a random epoch for a new encoder
+func newEpoch() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil { // fall back to the clock
+		return uint16(time.Now().UnixNano())
 	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// setConfig applies config to a live encoder
+func (e *encoder) setConfig(config endpointConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cycleLength = config.cycleLength
+	e.confidenceLookback = config.confidenceLookback
+	e.cmpAlgr = config.cmpAlgr
+	e.checksum = config.checksum
+	e.sequence = config.sequenceNumbers
+	e.channelIDs = config.channelIDs
+	e.extendedIDs = config.extendedIDs
+	e.headerCompression = config.headerCompression
+	e.maxRetransmits = config.maxRetransmits
+	e.retransmitInterval = config.retransmitInterval
+	if e.parityGroupSize != config.parityGroupSize {
+		e.parityGroupSize = config.parityGroupSize
+		e.parityIDs = nil
+	}
+	e.kfRepeats = config.kfRepeats
+	e.kfRepeatSpacing = config.kfRepeatSpacing
+	if e.repeatsLeft > e.kfRepeats {
+		e.repeatsLeft = e.kfRepeats
+	}
+	if e.refreshSlices != config.refreshSlices {
+		e.refreshSlices = config.refreshSlices
+		e.abortRefresh()
+	}
+	if !e.extendedIDs {
+		e.idCounter &= 0xFFFF
+	}
+	e.adaptive.maxLength = int(config.maxCycleLength)
+}
+
+// header returns a header for a frame carrying data
+func (e *encoder) header(frameType uint8, id uint32, data []byte) (h header) {
+	h.setFrameType(frameType)
+	h.setFrameID(id)
+	if e.extendedIDs {
+		h.setExtendedIDs()
+	}
+	if e.checksum {
+		h.setChecksum(crc32.Checksum(data, crc32c))
+	}
+	if e.channelIDs {
+		h.setChannel(e.channel)
+	}
+	return
+}
+
+// setChannel changes channel ID carried in packets of the encoder
+func (e *encoder) setChannel(channel uint16) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.channel = channel
 }
 
-func (e *encoder) encKF(id uint16, data *ReusableSlice, confidence uint8) (packet *ReusableSlice, err error) {
-	if packet, err = encode(e.pool, data.Slice(), uint16(id), frameKF, e.cmpAlgr); err != nil {
+func (e *encoder) encKF(id uint32, data *ReusableSlice, confidence uint8, maxFragments int) (packets []*ReusableSlice, err error) {
+	h := e.header(frameKF, id, data.Slice())
+	if e.headerCompression {
+		h.setEpoch(e.epoch)
+	}
+	if packets, err = encodeFragments(e.pool, e.msgPool, data.Slice(), h, e.cmpAlgr, maxFragments); err != nil {
+		data.Done()
 		return
 	}
-	e.sentKFs.put(uint16(id), confidence, data) // transferring ownership of data
+	e.sentKFs.put(id, confidence, data) // transferring ownership of data
+	delete(e.refreshed, id)
+	e.lastKFID = id
+	e.kfsSent++
+	packets = append(packets, e.sentKFForParity(id)...)
 	return
 }
 
-func (e *encoder) encDF(data *ReusableSlice, confidence uint8) (packet *ReusableSlice, err error) {
-	refID, _, ref := e.sentKFs.getMostConfident(e.confidenceLookback)
-	payload := e.pool.get() // temporary buffer to store uncompress data
+// encDF never fragments; it fails with ErrPacketTooLarge if the DF doesn't fit
+// in a packet. With header compression, a compressed header is used if the
+// reference is the latest KF sent, and is known to be held by the receiver,
+// i.e., has maxConfidence; the full header is used otherwise. It's also used
+// for DFs referencing the first KF since the encoder was created: if that's
+// after a restart, and the first KF is lost, the receiver still holds the
+// latest KF of the previous epoch, and would match the reference against it.
+func (e *encoder) encDF(data *ReusableSlice, confidence uint8) (packets []*ReusableSlice, err error) {
+	refID, refConfidence, ref := e.sentKFs.getMostConfident(e.confidenceLookback)
+	defer ref.Done()
+	payload := e.msgPool.get() // temporary buffer to store uncompress data
 	defer payload.Done()
-	xor(ref.Slice(), data.Slice(), payload)
+	prefixed, err := diff(ref.Slice(), data.Slice(), payload)
+	h := e.header(frameDF, refID, data.Slice())
+	if e.sequence {
+		h.setSequence(e.idCounter)
+	}
 	data.Done()
-	if packet, err = encode(e.pool, payload.Slice(), uint16(refID), frameDF, e.cmpAlgr); err != nil {
+	if err != nil {
+		return
+	}
+	if prefixed {
+		h.setLengthPrefix()
+	}
+	if e.headerCompression && refID == e.lastKFID && refConfidence == maxConfidence && e.kfsSent > 1 {
+		compressed := h
+		compressed.setCompressed()
+		if packets, err = encodeFragments(e.pool, e.msgPool, payload.Slice(), compressed, e.cmpAlgr, 1); err == nil {
+			return
+		}
+	}
+	if packets, err = encodeFragments(e.pool, e.msgPool, payload.Slice(), h, e.cmpAlgr, 1); err != nil {
 		return
 	}
 	return
 }
 
-func (e *encoder) encode(data *ReusableSlice, confidence uint8) (packet *ReusableSlice, err error) {
-	if e.cycleLength != 0 { // fixed cycle length
-		if e.idCounter%e.cycleLength == 0 { // KF; just send the data
-			packet, err = e.encKF(e.idCounter, data, confidence)
+// encode encodes data into packets. A KF is split into at most maxFragments
+// fragments if it doesn't fit in one packet. A DF is never fragmented; a KF is
+// sent instead if it doesn't fit. A repeat of the latest KF may follow, if
+// it's due. With maxFragments of 1, as used by Encode and EncodeReusable, only
+// the packet of the message is returned, and frames that follow it, i.e.,
+// parity frames and repeats, are kept in pending instead, replacing those of
+// the previous call.
+func (e *encoder) encode(data *ReusableSlice, confidence uint8, maxFragments int) (packets []*ReusableSlice, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		err = errContextClosed
+		return
+	}
+
+	releasePackets(e.pending)
+	e.pending = nil
+
+	rawSize := len(data.Slice())
+
+	if e.forceKF {
+		e.abortRefresh()
+		if packets, err = e.encKF(e.idCounter, data, confidence, maxFragments); err == nil {
+			e.forceKF = false
+			e.stats.ForcedKFs++
+			if e.cycleLength == 0 {
+				e.adaptive.sentKF(packetsSize(packets))
+			}
+		}
+	} else if e.refreshData != nil { // refresh in progress; DF with the next segment
+		if packets, err = e.encRefreshDF(data, maxFragments); err == nil && e.cycleLength == 0 {
+			e.adaptive.sentDF(packetsSize(packets))
+		}
+	} else if e.cycleLength != 0 { // fixed cycle length
+		if e.idCounter%uint32(e.cycleLength) == 0 { // KF; just send the data, or start a refresh
+			packets, err = e.encKFOrRefresh(data, confidence, maxFragments)
 		} else { // DF; find a proper previously sent KF, and build differential data
-			packet, err = e.encDF(data, confidence)
+			data.AddOwner()
+			if packets, err = e.encDF(data, confidence); err != nil { // fall back to KF
+				packets, err = e.encKF(e.idCounter, data, confidence, maxFragments)
+			} else {
+				data.Done()
+			}
 		}
 	} else { // adaptive cycle length
 		if e.adaptive.first() {
-			packet, err = e.encKF(e.idCounter, data, confidence)
-			e.adaptive.sentKF(len(packet.Slice()))
+			if packets, err = e.encKF(e.idCounter, data, confidence, maxFragments); err == nil {
+				e.adaptive.sentKF(packetsSize(packets))
+			}
 		} else {
 			data.AddOwner()
-			packet, err = e.encDF(data, confidence)
-			if e.adaptive.shouldSendThisDF(len(packet.Slice())) {
-				e.adaptive.sentDF(len(packet.Slice()))
+			packets, err = e.encDF(data, confidence)
+			if err == nil && e.adaptive.shouldSendThisDF(packetsSize(packets), e.deliveryRatio()) {
+				e.adaptive.sentDF(packetsSize(packets))
 				data.Done()
 			} else {
-				packet.Done()
-				packet, err = e.encKF(e.idCounter, data, confidence)
-				e.adaptive.sentKF(len(packet.Slice()))
+				releasePackets(packets)
+				if packets, err = e.encKFOrRefresh(data, confidence, maxFragments); err == nil {
+					e.adaptive.sentKF(packetsSize(packets))
+				}
 			}
 		}
 	}
 
-	e.idCounter++
+	if err == nil {
+		e.stats.encoded(rawSize, packets)
+		if h, _, _ := readHeader(packets[0].Slice()); h.getFrameType() == frameKF {
+			e.repeatID, e.repeatsLeft, e.repeatIn = e.idCounter, e.kfRepeats, e.kfRepeatSpacing
+		} else {
+			packets = append(packets, e.repeat()...)
+		}
+		if maxFragments == 1 && len(packets) > 1 {
+			e.pending, packets = packets[1:], packets[:1]
+		}
+		e.idCounter++
+		if !e.extendedIDs {
+			e.idCounter &= 0xFFFF
+		}
+	}
 
 	return
 }
 
+func packetsSize(packets []*ReusableSlice) (size int) {
+	for _, p := range packets {
+		size += len(p.Slice())
+	}
+	return
+}
+
+func releasePackets(packets []*ReusableSlice) {
+	for _, p := range packets {
+		p.Done()
+	}
+}
+
+// deliveryRatio returns the delivery ratio of this encoder's DFs reported by
+// the receiver, or 1 if there's no report yet. Local decoders aren't asked, as
+// they see the reverse direction, which may be on a different path.
+func (e *encoder) deliveryRatio() float64 {
+	if e.reportedRatio >= 0 {
+		return e.reportedRatio
+	}
+	return 1
+}
+
+// handleFeedback adjusts confidence of sent KFs according to IDs of KFs the
+// receiver reports to hold. Reported KFs are raised to maxConfidence. KFs sent
+// before the most recent reported one but missing from the report are
+// considered lost and lowered to 0. KFs sent after it are left untouched, as
+// the report may have been generated before they arrived.
+func (e *encoder) handleFeedback(ids []uint32, ratio float64) (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		err = errContextClosed
+		return
+	}
+
+	e.reportedRatio = ratio
+
+	held := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		held[id] = true
+	}
+	reached := false
+	e.sentKFs.updateConfidence(func(id uint32, confidence uint8) uint8 {
+		if held[id] {
+			reached = true
+			return maxConfidence
+		} else if reached {
+			return 0
+		}
+		return confidence
+	})
+	return
+}
+
+type retransmitState struct {
+	count int       // number of times the KF has been retransmitted
+	last  time.Time // of the latest retransmission
+}
+
+// retransmit re-encodes KFs listed in a NACK that are still cached, marked as
+// retransmissions. KFs that have been retransmitted maxRetransmits times, or
+// within retransmitInterval, are skipped.
+func (e *encoder) retransmit(ids []uint32, maxFragments int, now time.Time) (packets []*ReusableSlice, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		err = errContextClosed
+		return
+	}
+
+	for id := range e.retransmits { // forget KFs no longer cached
+		if _, ok := e.sentKFs.slices[id]; !ok {
+			delete(e.retransmits, id)
+		}
+	}
+
+	for _, id := range ids {
+		state := e.retransmits[id]
+		if state.count >= e.maxRetransmits || (state.count > 0 && now.Sub(state.last) < e.retransmitInterval) {
+			continue
+		}
+		var kf []*ReusableSlice
+		if kf, err = e.encCopy(id, maxFragments); err != nil {
+			releasePackets(packets)
+			packets = nil
+			return
+		}
+		if kf == nil {
+			continue
+		}
+		packets = append(packets, kf...)
+		e.retransmits[id] = retransmitState{count: state.count + 1, last: now}
+		e.stats.KFsRetransmitted++
+		e.stats.EncodedBytes += uint64(packetsSize(kf))
+	}
+	return
+}
+
+// encCopy re-encodes cached KF id, marked as a retransmission; packets is nil
+// if it's no longer cached. A refreshed reference is also marked as a refresh
+// in a single segment, since its message has been delivered with the first
+// segment, and isn't to be delivered again.
+//
+// Caller must hold e.mu.
+func (e *encoder) encCopy(id uint32, maxFragments int) (packets []*ReusableSlice, err error) {
+	data, ok := e.sentKFs.get(id)
+	if !ok {
+		return
+	}
+	defer data.Done()
+	h := e.header(frameKF, id, data.Slice())
+	if e.headerCompression {
+		h.setEpoch(e.epoch)
+	}
+	h.setRetransmit()
+	if e.refreshed[id] {
+		h.setRefresh(id, 0, 1, uint32(len(data.Slice())))
+	}
+	packets, err = encodeFragments(e.pool, e.msgPool, data.Slice(), h, e.cmpAlgr, maxFragments)
+	return
+}
+
+// repeat counts a message encoded as a DF towards the next repeat of the
+// latest KF, returning packets of the repeat if it's due. Like parity frames,
+// repeats are fragmented if needed, since they're sent separately anyway.
+//
+// Caller must hold e.mu.
+func (e *encoder) repeat() (packets []*ReusableSlice) {
+	if e.repeatsLeft == 0 {
+		return
+	}
+	if e.repeatIn--; e.repeatIn > 0 {
+		return
+	}
+	e.repeatsLeft--
+	e.repeatIn = e.kfRepeatSpacing
+	var err error
+	if packets, err = e.encCopy(e.repeatID, maxFragments); err != nil || packets == nil {
+		e.repeatsLeft = 0 // the KF won't encode any better next time
+		return
+	}
+	e.stats.KFsRepeated++
+	e.stats.EncodedBytes += uint64(packetsSize(packets))
+	return
+}
+
+// forceKeyFrame makes the next encode call send a KF
+func (e *encoder) forceKeyFrame() (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		err = errContextClosed
+		return
+	}
+	e.forceKF = true
+	return
+}
+
+// close releases all cached KFs
+func (e *encoder) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.sentKFs.clear()
+	releasePackets(e.pending)
+	e.pending = nil
+	e.abortRefresh()
+}
+
+// takePending returns frames kept in pending, which the caller now owns
+func (e *encoder) takePending() (packets []*ReusableSlice, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		err = errContextClosed
+		return
+	}
+
+	packets, e.pending = e.pending, nil
+	return
+}
+
 type decoder struct {
-	pool    *slicePool
-	rcvdKFs *sliceCache
+	pool      *slicePool // for messages
+	rcvdKFs   *sliceCache
+	fragments *reassembler
+	sequence  sequenceTracker
+
+	// ID of the latest KF received, the implied reference of DFs with
+	// compressed header, and epoch of its encoder; see setLatestKF
+	latestKF     uint32
+	hasLatestKF  bool
+	epoch        uint16
+	hasEpoch     bool
+	prevEpoch    uint16 // epoch replaced by the current one
+	hasPrevEpoch bool
+
+	// set when a DF can't be decoded due to missing reference, until a KF
+	// arrives; missingRef is the latest reference found missing
+	needResync bool
+	missingRef uint32
+	lastResync time.Time // when the latest resync request was built
+
+	// references found missing, to be NACKed, oldest first
+	missingRefs []missingRef
+
+	jitter *jitterBuffer // nil if disabled
+
+	refresh *refreshAssembly // nil if no refresh is in progress
 
 	dStats *decoderStats
+
+	stats Stats
+
+	closed bool
+	mu     *sync.Mutex
 }
 
-func newDecoder(pool *slicePool, dStats *decoderStats) *decoder {
+func newDecoder(msgPool *slicePool, config endpointConfig, dStats *decoderStats) *decoder {
 	return &decoder{
-		pool:    pool,
-		rcvdKFs: newSliceCache(32),
-		dStats:  dStats,
+		pool:      msgPool,
+		rcvdKFs:   newSliceCache(32),
+		fragments: newReassembler(config.fragmentTimeout),
+		jitter:    newJitterBuffer(config),
+		dStats:    dStats,
+		mu:        new(sync.Mutex),
 	}
 }
 
-func (e *decoder) decode(packet []byte) (data *ReusableSlice, err error) {
-	var header header
+// decode decodes packet arriving at now
+func (e *decoder) decode(packet []byte, now time.Time) (data *ReusableSlice, seq SequenceInfo, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		err = errContextClosed
+		return
+	}
+
+	data, seq, _, _, err = e.decodeLocked(packet, false, now)
+	return
+}
+
+// decodeLocked decodes packet arriving at now, returning header of the frame.
+// If hold is true, a DF whose reference is missing is put in the jitter buffer
+// instead of failing, and held is true.
+//
+// Caller must hold e.mu.
+func (e *decoder) decodeLocked(packet []byte, hold bool, now time.Time) (data *ReusableSlice, seq SequenceInfo, header header, held bool, err error) {
+	e.stats.received(packet)
+	defer func() {
+		if err == nil && data != nil {
+			e.stats.MessagesDecoded++
+			e.stats.DecodedBytes += uint64(len(data.Slice()))
+		}
+	}()
+
+	var compressed []byte
+	if header, compressed, err = readHeader(packet); err != nil {
+		return
+	}
+	if header.compressed {
+		if !e.hasLatestKF || refCheck(e.latestKF) != uint8(header.frameID) {
+			e.stats.DFsReceived++
+			e.stats.MissingReferences++
+			e.dStats.decoded(false)
+			e.needResync, e.missingRef = true, e.latestKF // actual reference is unknown, so not NACKed
+			err = errors.New("compressed header doesn't match latest KF")
+			return
+		}
+		header.frameID = e.latestKF
+	}
+	if _, _, fragmented := header.getFragment(); fragmented {
+		var complete bool
+		if compressed, complete = e.fragments.add(header, compressed, now); !complete {
+			return // wait for the rest of fragments
+		}
+	}
 	var payload *ReusableSlice
-	if header, payload /* uncompressed payload */, err = decode(e.pool, packet); err != nil {
+	if payload /* uncompressed payload */, err = decompress(e.pool, header, compressed); err != nil {
 		return
 	}
 
+	// a retransmitted KF has been tracked, if not lost, as the original one;
+	// tracking it again would count it as a duplicate or out of order
+	if (header.frameType == frameKF && !header.isRetransmit()) || header.frameType == frameDF {
+		seq = e.sequence.track(header)
+		e.stats.sequenced(seq)
+	}
+
 	if header.frameType == frameKF { // in KF, uncompressed payload is the data
-		payload.AddOwner()
-		e.rcvdKFs.put(header.frameID, payload) // 1st owner
-		data = payload                         // 2nd owner
+		e.stats.KFsReceived++
+		if err = verifyChecksum(header, payload.Slice()); err != nil {
+			payload.Done()
+			return
+		}
+		if cached, ok := e.rcvdKFs.get(header.frameID); ok {
+			duplicate := bytes.Equal(cached.Slice(), payload.Slice())
+			cached.Done()
+			if duplicate { // keep the cached one, so that the cache order isn't disturbed
+				e.stats.DuplicateKFs++
+				e.setLatestKF(header)
+				if header.isRetransmit() { // already delivered
+					payload.Done()
+					return
+				}
+				data = payload
+				return
+			}
+		}
+		e.putKF(header, payload)
+		if _, _, _, _, refresh := header.getRefresh(); refresh { // already delivered with its first segment
+			if e.refresh != nil && e.refresh.id == header.frameID {
+				e.clearRefresh()
+			}
+			payload.Done()
+			return
+		}
+		data = payload
 	} else if header.frameType == frameDF { // in DF, uncompressed payload is differential data
 		defer payload.Done()
+		e.stats.DFsReceived++
+		if _, _, _, _, refresh := header.getRefresh(); refresh {
+			if err = e.addRefreshSegment(header, payload); err != nil {
+				return
+			}
+		}
 		ref, ok := e.rcvdKFs.get(header.frameID)
+		if !ok && hold {
+			e.stats.DFsHeld++
+			e.missingReference(header.frameID)
+			payload.AddOwner()
+			e.jitter.hold(header, payload, now)
+			held = true
+			return
+		}
 		e.dStats.decoded(ok)
 		if !ok {
+			e.stats.MissingReferences++
+			e.missingReference(header.frameID)
 			err = fmt.Errorf("referenced frame (id=%d)is missing", header.frameID)
 			return
 		}
-		data = e.pool.get()
-		xor(ref.Slice(), payload.Slice(), data)
+		data, err = e.patchDF(header, payload, ref)
+		ref.Done()
+	} else if header.frameType == frameParity {
+		defer payload.Done()
+		var id uint32
+		if id, data, err = e.recoverKF(header, payload.Slice()); data != nil {
+			e.stats.KFsRecovered++
+			header.frameType, header.frameID = frameKF, id
+			e.putKF(header, data)
+		}
+	} else {
+		payload.Done()
+		err = fmt.Errorf("unexpected frame type %d", header.frameType)
+	}
+
+	return
+}
+
+// putKF caches KF with header h and message data, adding an owner to data
+//
+// Caller must hold e.mu.
+func (e *decoder) putKF(h header, data *ReusableSlice) {
+	e.foundReference(h.frameID)
+	e.setLatestKF(h)
+	e.needResync = false
+	e.lastResync = time.Time{}
+	data.AddOwner()
+	e.rcvdKFs.put(h.frameID, data)
+}
+
+// patchDF reconstructs the message of a DF with header h from its
+// differential data diff, and its reference ref
+func (e *decoder) patchDF(h header, diff *ReusableSlice, ref *ReusableSlice) (data *ReusableSlice, err error) {
+	data = e.pool.get()
+	if err = patch(ref.Slice(), diff.Slice(), h.hasLengthPrefix(), data); err == nil {
+		err = verifyChecksum(h, data.Slice())
+	}
+	if err != nil {
+		data.Done()
+		data = nil
+	}
+	return
+}
+
+func verifyChecksum(h header, data []byte) (err error) {
+	if checksum, ok := h.getChecksum(); ok && checksum != crc32.Checksum(data, crc32c) {
+		err = ErrChecksumMismatch
+	}
+	return
+}
+
+// feedback builds a report listing KFs currently held by the decoder
+func (e *decoder) feedback() (report *ReusableSlice, err error) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		err = errContextClosed
+		return
+	}
+	ids := e.rcvdKFs.ids()
+	e.mu.Unlock()
+	report, err = encodeFeedback(e.pool, ids, e.dStats.successRatio())
+	return
+}
+
+type missingRef struct {
+	id       uint32
+	nacks    int       // number of NACKs it has been listed in
+	lastNACK time.Time // of the latest one
+}
+
+// missingReference records that reference id of a DF is missing, so that a
+// resync request is built by resyncRequest, and id is listed in NACKs
+func (e *decoder) missingReference(id uint32) {
+	e.needResync = true
+	e.missingRef = id
+	for _, m := range e.missingRefs {
+		if m.id == id {
+			return
+		}
+	}
+	if len(e.missingRefs) == maxMissingRefs {
+		e.missingRefs = e.missingRefs[1:]
 	}
+	e.missingRefs = append(e.missingRefs, missingRef{id: id})
+}
 
+// foundReference stops NACKing KF id
+func (e *decoder) foundReference(id uint32) {
+	for i, m := range e.missingRefs {
+		if m.id == id {
+			e.missingRefs = append(e.missingRefs[:i], e.missingRefs[i+1:]...)
+			return
+		}
+	}
+}
+
+// nack builds a NACK listing missing references that haven't been NACKed
+// within nackInterval, or maxNACKs times. request is nil if there are none.
+func (e *decoder) nack(now time.Time) (request *ReusableSlice, err error) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		err = errContextClosed
+		return
+	}
+	var ids []uint32
+	for i := range e.missingRefs {
+		m := &e.missingRefs[i]
+		if m.nacks >= maxNACKs || (m.nacks > 0 && now.Sub(m.lastNACK) < nackInterval) {
+			continue
+		}
+		m.nacks++
+		m.lastNACK = now
+		ids = append(ids, m.id)
+	}
+	if len(ids) > 0 {
+		e.stats.NACKs++
+	}
+	e.mu.Unlock()
+	if len(ids) > 0 {
+		request, err = encodeNACK(e.pool, ids)
+	}
+	return
+}
+
+// resyncRequest builds a resync request if a reference has been found
+// missing since the latest KF, and no request has been built within
+// resyncInterval. request is nil otherwise.
+func (e *decoder) resyncRequest(now time.Time) (request *ReusableSlice, err error) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		err = errContextClosed
+		return
+	}
+	if !e.needResync || now.Sub(e.lastResync) < resyncInterval {
+		e.mu.Unlock()
+		return
+	}
+	e.lastResync = now
+	e.stats.ResyncRequests++
+	id := e.missingRef
+	e.mu.Unlock()
+	request, err = encodeRequest(e.pool, requestResync, id)
 	return
 }
+
+// close releases all cached KFs
+func (e *decoder) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.rcvdKFs.clear()
+	e.jitter.clear()
+	e.clearRefresh()
+}
+
+// setLatestKF updates the latest KF with a KF with header h that has just
+// arrived. Within an epoch, it only moves forward, so that a late or duplicate
+// KF doesn't take over. A KF of a new epoch comes from a restarted encoder,
+// whose IDs start over, and becomes the latest KF even if its ID is behind;
+// a late KF of the epoch it replaced is ignored. KFs without epoch, sent
+// without header compression, only move it forward.
+//
+// Caller must hold e.mu.
+func (e *decoder) setLatestKF(h header) {
+	epoch, ok := h.getEpoch()
+	switch {
+	case ok && e.hasPrevEpoch && epoch == e.prevEpoch:
+		return
+	case ok && (!e.hasEpoch || epoch != e.epoch):
+		if e.hasEpoch {
+			e.prevEpoch, e.hasPrevEpoch = e.epoch, true
+		}
+		e.epoch, e.hasEpoch = epoch, true
+	case e.hasLatestKF && seqDelta(h.frameID, e.latestKF, h.extendedIDs) <= 0:
+		return
+	}
+	e.latestKF, e.hasLatestKF = h.frameID, true
+}
@@ -2,6 +2,7 @@ package ictl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 )
@@ -23,9 +24,12 @@ func compress(c compressor, output []byte, data []byte) (length int, err error)
 }
 
 func compressFindBest(output []byte, data []byte) (cmp compressor, length int, err error) {
+	// in order of algorithm, so that ties are broken the same way every time
 	var exhaustive []compressor
-	for _, v := range compressors {
-		exhaustive = append(exhaustive, v())
+	for a := CompressionAlgorithm(0); a < CAAuto; a++ {
+		if v, ok := compressors[a]; ok {
+			exhaustive = append(exhaustive, v())
+		}
 	}
 
 	var l int
@@ -48,68 +52,200 @@ func compressFindBest(output []byte, data []byte) (cmp compressor, length int, e
 	return
 }
 
-func encode(pool *slicePool, payload []byte, id uint16, frameType uint8, cmpAlgr CompressionAlgorithm) (packet *ReusableSlice, err error) {
+// ErrPacketTooLarge is returned when an encoded packet doesn't fit in
+// MaxPacketSize, or a fragmented one doesn't fit in the max number of
+// fragments.
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// ErrMessageTooLarge is returned when a message exceeds MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// max number of fragments a frame can be split into
+const maxFragments = 255
+
+// compressWith compresses data into output with cmpAlgr, or the best
+// algorithm if cmpAlgr is CAAuto. If length exceeds cap(output), compressed
+// data didn't fit and output doesn't hold it.
+func compressWith(cmpAlgr CompressionAlgorithm, output []byte, data []byte) (cmp compressor, length int, err error) {
+	if cmpAlgr == CAAuto {
+		cmp, length, err = compressFindBest(output, data)
+		return
+	}
+	creator, ok := compressors[cmpAlgr]
+	if !ok {
+		err = errors.New("unknown compression algorithm")
+		return
+	}
+	cmp = creator()
+	length, err = compress(cmp, output, data)
+	return
+}
+
+func encode(pool *slicePool, payload []byte, id uint32, frameType uint8, cmpAlgr CompressionAlgorithm) (packet *ReusableSlice, err error) {
+	var header header
+	header.setFrameID(id)
+	header.setFrameType(frameType)
+	packet, err = encodeWithHeader(pool, payload, header, cmpAlgr)
+	return
+}
+
+// encodeWithHeader is like encode, but takes a header with all fields except
+// compression options and algorithm already set.
+func encodeWithHeader(pool *slicePool, payload []byte, header header, cmpAlgr CompressionAlgorithm) (packet *ReusableSlice, err error) {
 	packet = pool.get()
 	cleanup := func() {
 		packet.Done()
 		packet = nil
 	}
 
+	hl := header.length()
 	var cmp compressor
 	var l int
-	if cmpAlgr == CAAuto {
-		if cmp, l, err = compressFindBest(packet.Slice()[4:], payload); err != nil {
-			cleanup()
-			return
+	if cmp, l, err = compressWith(cmpAlgr, packet.Slice()[hl:], payload); err != nil {
+		cleanup()
+		return
+	}
+	if hl+l > packet.Cap() { // compressed data didn't fit and went elsewhere
+		cleanup()
+		err = ErrPacketTooLarge
+		return
+	}
+	packet.Resize(hl + l)
+
+	header.setCompressionOptions(cmp.getOptionsForHeader())
+	header.setCompressionAlgorithm(cmp.getCompressionAlgorithm())
+	if err = header.writeTo(bytes.NewBuffer(packet.Slice()[0:0:hl])); err != nil {
+		cleanup()
+		return
+	}
+
+	return
+}
+
+// encodeFragments is like encodeWithHeader, but compresses payload into a
+// slice from msgPool first. If the result doesn't fit in a packet from
+// packetPool, it's split into fragments, at most limit of them;
+// ErrPacketTooLarge is returned if that's not enough.
+func encodeFragments(packetPool, msgPool *slicePool, payload []byte, header header, cmpAlgr CompressionAlgorithm, limit int) (packets []*ReusableSlice, err error) {
+	compressed := msgPool.get()
+	defer compressed.Done()
+	var cmp compressor
+	var l int
+	if cmp, l, err = compressWith(cmpAlgr, compressed.Slice(), payload); err != nil {
+		return
+	}
+	if l > compressed.Cap() {
+		err = ErrPacketTooLarge
+		return
+	}
+	compressed.Resize(l)
+	header.setCompressionOptions(cmp.getOptionsForHeader())
+	header.setCompressionAlgorithm(cmp.getCompressionAlgorithm())
+
+	packet := packetPool.get()
+	packets = append(packets, packet)
+	cleanup := func() {
+		for _, p := range packets {
+			p.Done()
 		}
-	} else {
-		var creator compressorCreator
-		var ok bool
-		if creator, ok = compressors[cmpAlgr]; !ok {
+		packets = nil
+	}
+
+	if header.length()+l <= packet.Cap() { // fits in one packet
+		err = writePacket(packet, header, compressed.Slice())
+		if err != nil {
 			cleanup()
-			err = errors.New("unknown compression algorithm")
-			return
 		}
-		cmp = creator()
-		if l, err = compress(cmp, packet.Slice()[4:], payload); err != nil {
+		return
+	}
+
+	header.setFragment(0, 0)
+	per := packet.Cap() - header.length()
+	count := (l + per - 1) / per
+	if count > limit || count > maxFragments {
+		cleanup()
+		err = ErrPacketTooLarge
+		return
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			packet = packetPool.get()
+			packets = append(packets, packet)
+		}
+		end := (i + 1) * per
+		if end > l {
+			end = l
+		}
+		header.setFragment(uint8(i), uint8(count))
+		if err = writePacket(packet, header, compressed.Slice()[i*per:end]); err != nil {
 			cleanup()
 			return
 		}
 	}
-	packet.Resize(l + 4)
+	return
+}
 
-	var header header
-	header.setFrameID(id)
-	header.setFrameType(frameType)
-	header.setCompressionOptions(cmp.getOptionsForHeader())
-	header.setCompressionAlgorithm(cmp.getCompressionAlgorithm())
-	if err = header.writeTo(bytes.NewBuffer(packet.Slice()[0:0:4])); err != nil {
-		cleanup()
+// writePacket writes header followed by compressed payload into packet
+func writePacket(packet *ReusableSlice, header header, compressed []byte) (err error) {
+	hl := header.length()
+	packet.Resize(hl + len(compressed))
+	if err = header.writeTo(bytes.NewBuffer(packet.Slice()[0:0:hl])); err != nil {
 		return
 	}
+	copy(packet.Slice()[hl:], compressed)
+	return
+}
 
+// readHeader reads header of packet; rest is what follows the header
+func readHeader(packet []byte) (header header, rest []byte, err error) {
+	reader := bytes.NewReader(packet)
+	if err = header.readFrom(reader); err != nil {
+		return
+	}
+	rest = packet[len(packet)-reader.Len():]
 	return
 }
 
 func decode(pool *slicePool, packet []byte) (header header, payload *ReusableSlice, err error) {
+	var compressed []byte
+	if header, compressed, err = readHeader(packet); err != nil {
+		return
+	}
+	payload, err = decompress(pool, header, compressed)
+	return
+}
+
+// decompress decompresses payload of a frame described by header into a
+// slice from pool
+func decompress(pool *slicePool, header header, compressed []byte) (payload *ReusableSlice, err error) {
 	payload = pool.get()
 	cleanup := func() {
 		payload.Done()
 		payload = nil
 	}
 
-	reader := bytes.NewReader(packet)
-	header.readFrom(reader)
-	c := compressors[header.getCompressionAlgorithm()]()
+	creator, ok := compressors[header.getCompressionAlgorithm()]
+	if !ok {
+		cleanup()
+		err = errors.New("unknown compression algorithm")
+		return
+	}
+	c := creator()
 	c.setOptionsFromHeader(header.getCompressionOptions())
 	var r io.ReadCloser
-	if r, err = c.decompressor(reader); err != nil {
+	if r, err = c.decompressor(bytes.NewReader(compressed)); err != nil {
 		cleanup()
 		return
 	}
 	var l int
-	if l, err = r.Read(payload.Slice()); err != nil {
+	if l, err = io.ReadFull(r, payload.Slice()); err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil // payload shorter than the buffer
+	} else if err != nil {
+		cleanup()
+		return
+	} else if n, _ := r.Read(make([]byte, 1)); n > 0 {
 		cleanup()
+		err = ErrMessageTooLarge
 		return
 	}
 	if err = r.Close(); err != nil {
@@ -121,18 +257,71 @@ func decode(pool *slicePool, packet []byte) (header header, payload *ReusableSli
 	return
 }
 
-// calling xor, unlike other functions, doesn't transfer ownership
-func xor(a, b []byte, output *ReusableSlice) {
-	c := output.Slice()
-	var i int
-	for i = 0; i < len(a) && i < len(b); i++ {
-		c[i] = a[i] ^ b[i]
+// diff writes into output the differential data of data against ref, and
+// returns whether it's length-prefixed. If data is at least as long as ref,
+// it's ref XOR data, with ref zero-padded to length of data; that's the
+// original layout, where length of data is implied as the longer of ref and
+// the XOR, so any decoder reconstructs it correctly. Otherwise, it's the
+// length of data as a uvarint, followed by ref XOR data, with ref truncated
+// to length of data. Trailing zeros of the XOR are trimmed where the length
+// is implied without them. Calling diff doesn't transfer ownership.
+func diff(ref, data []byte, output *ReusableSlice) (prefixed bool, err error) {
+	o := output.Slice()[:output.Cap()]
+	if binary.MaxVarintLen64+len(data) > len(o) {
+		err = ErrMessageTooLarge
+		return
+	}
+	n := 0
+	if prefixed = len(data) < len(ref); prefixed {
+		n = binary.PutUvarint(o, uint64(len(data)))
+	}
+	end := n
+	if len(data) > len(ref) {
+		end = len(data)
+	}
+	for i := range data {
+		var r byte
+		if i < len(ref) {
+			r = ref[i]
+		}
+		if o[n+i] = r ^ data[i]; o[n+i] != 0 && n+i >= end {
+			end = n + i + 1
+		}
+	}
+	output.Resize(end)
+	return
+}
+
+// patch reverses diff, reconstructing data from ref and differential data d,
+// which is length-prefixed if prefixed is true, into output. Calling patch
+// doesn't transfer ownership.
+func patch(ref, d []byte, prefixed bool, output *ReusableSlice) (err error) {
+	length := uint64(len(d))
+	if len(ref) > len(d) {
+		length = uint64(len(ref))
+	}
+	if prefixed {
+		var n int
+		if length, n = binary.Uvarint(d); n <= 0 {
+			err = errors.New("malformed differential data")
+			return
+		}
+		d = d[n:]
 	}
-	for ; i < len(a); i++ {
-		c[i] = a[i] ^ 0
+	if length > uint64(output.Cap()) || uint64(len(d)) > length {
+		err = errors.New("malformed differential data")
+		return
 	}
-	for ; i < len(b); i++ {
-		c[i] = b[i] ^ 0
+	output.Resize(int(length))
+	o := output.Slice()
+	for i := range o {
+		o[i] = 0
+		if i < len(ref) {
+			o[i] = ref[i]
+		}
+		if i < len(d) {
+			o[i] ^= d[i]
+		}
 	}
-	output.Resize(i)
+	return
 }
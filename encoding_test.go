@@ -1,6 +1,9 @@
 package ictl
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 func TestEncoding(t *testing.T) {
 	lipsum := "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat. Duis aute irure dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur. Excepteur sint occaecat cupidatat non proident, sunt in culpa qui officia deserunt mollit anim id est laborum."
@@ -29,7 +32,10 @@ func TestEncoding(t *testing.T) {
 	t.Logf("KF compressing/decompressing test passed\n")
 
 	payload2 = pool.get()
-	xor(payload1.Slice(), []byte(lipsum2), payload2)
+	var prefixed bool
+	if prefixed, err = diff(payload1.Slice(), []byte(lipsum2), payload2); err != nil {
+		t.Fatalf("error computing differential data: %v\n", err)
+	}
 	if packet2, err = encode(pool, payload2.Slice(), 42, frameDF, CAAuto); err != nil {
 		t.Fatalf("error encoding DF: %v\n", err)
 	}
@@ -43,7 +49,9 @@ func TestEncoding(t *testing.T) {
 	packet2.Done()
 
 	data := pool.get()
-	xor(payload1.Slice(), payload2.Slice(), data)
+	if err = patch(payload1.Slice(), payload2.Slice(), prefixed, data); err != nil {
+		t.Fatalf("error patching differential data: %v\n", err)
+	}
 	payload1.Done()
 	payload2.Done()
 	got = string(data.Slice())
@@ -53,3 +61,46 @@ func TestEncoding(t *testing.T) {
 
 	t.Logf("DF compressing/decompressing test passed\n")
 }
+
+func TestDiffLayouts(t *testing.T) {
+	pool := newSlicePool(64)
+	ref := []byte("reference message")
+	for _, c := range []struct {
+		data     string
+		prefixed bool
+	}{
+		{"reference massage", false},
+		{"reference message with a tail", false},
+		{"reference", true},
+		{"", true},
+	} {
+		d := pool.get()
+		prefixed, err := diff(ref, []byte(c.data), d)
+		if err != nil {
+			t.Fatalf("calling diff() error: %v\n", err)
+		}
+		if prefixed != c.prefixed {
+			t.Fatalf("%q: expected prefixed=%v\n", c.data, c.prefixed)
+		}
+		// the original layout is plain XOR, as decoders without length
+		// prefix support expect
+		if !prefixed && len(d.Slice()) > len(c.data) {
+			t.Fatalf("%q: unexpected differential data %x\n", c.data, d.Slice())
+		}
+		data := pool.get()
+		if err = patch(ref, d.Slice(), prefixed, data); err != nil {
+			t.Fatalf("calling patch() error: %v\n", err)
+		}
+		if !bytes.Equal(data.Slice(), []byte(c.data)) {
+			t.Fatalf("patched %q; expected %q\n", data.Slice(), c.data)
+		}
+		data.Done()
+		d.Done()
+	}
+
+	d := pool.get()
+	if _, err := diff(ref, make([]byte, 64), d); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge; got %v\n", err)
+	}
+	d.Done()
+}
@@ -1,68 +1,391 @@
 package ictl
 
-import "sync"
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
 
 type Endpoint interface {
+	// Encode and EncodeReusable fail with ErrPacketTooLarge if a KF doesn't
+	// fit in one packet; use EncodeFragments for large messages.
 	Encode(context string, data []byte, confidence uint8) (packet *ReusableSlice, err error)
 	EncodeReusable(context string, data *ReusableSlice, confidence uint8) (packet *ReusableSlice, err error)
+
+	// EncodeFragments is like Encode, but KFs that don't fit in MaxPacketSize
+	// are split into multiple packets, each to be sent separately.
+	EncodeFragments(context string, data []byte, confidence uint8) (packets []*ReusableSlice, err error)
+
+	// Pending returns frames to be sent right after the packet returned by
+	// the latest Encode or EncodeReusable call in context, i.e., parity frames
+	// and repeats of KFs (see SetParityGroupSize and SetKFRepeats), which
+	// EncodeFragments returns along with the message instead. Frames not
+	// taken before the next message is encoded in context are dropped.
+	Pending(context string) (packets []*ReusableSlice, err error)
+
+	// Decode returns nil data and nil err if packet is a fragment of a
+	// message which is not complete yet, a retransmitted or repeated KF which
+	// has been received before, or a parity frame not rebuilding any lost KF.
+	// A parity frame that does returns the message of the rebuilt KF.
 	Decode(context string, packet []byte) (data *ReusableSlice, err error)
+
+	// DecodeWithSequence is like Decode, but also tells whether the message
+	// arrived after a gap, as a duplicate, or out of order. seq is returned
+	// even if the message cannot be decoded, e.g., due to missing reference.
+	DecodeWithSequence(context string, packet []byte) (data *ReusableSlice, seq SequenceInfo, err error)
+
+	// DecodeMessages is like Decode, but uses the jitter buffer if enabled
+	// (see SetJitterBufferSize): DFs arriving before the KF they reference are
+	// held instead of failing, and decoded when it arrives. It returns all
+	// messages that become available: the one decoded from packet, if any,
+	// and held ones released by it. Expired DFs are dropped, and only when
+	// DecodeMessages is called. messages may be non-empty even if err is not
+	// nil.
+	DecodeMessages(context string, packet []byte) (messages []*ReusableSlice, err error)
+
+	// DecodeAny is like Decode, but finds out the context from the channel ID
+	// carried in packet, which requires the peer to have ChannelIDs enabled.
+	// The context is the one registered with the channel ID by
+	// RegisterChannel, or a live context whose name hashes to it (see
+	// ChannelID), or otherwise one named "channel-<id>".
+	DecodeAny(packet []byte) (context string, data *ReusableSlice, err error)
+
+	// RegisterChannel assigns channel ID id to context, in place of the
+	// default ChannelID(context). It's used both for channel IDs carried in
+	// packets encoded in context, and for resolving channel IDs in DecodeAny;
+	// so peers should register the same IDs.
+	RegisterChannel(context string, id uint16) (err error)
+
+	// Feedback builds an acknowledgement report listing KFs that the decoder
+	// of context currently holds. The report should be sent back to the peer,
+	// which passes it to HandleFeedback.
+	Feedback(context string) (report *ReusableSlice, err error)
+
+	// HandleFeedback updates confidence of KFs sent in context according to a
+	// report built by the peer's Feedback. KFs known to be held by the peer
+	// are preferred as references of DFs, within ConfidenceLookback most
+	// recent KFs. The delivery ratio in the report is used in adaptive cycle
+	// length decisions; until a report arrives, no loss is assumed.
+	// HandleFeedback also takes requests built by the peer's ResyncRequest.
+	HandleFeedback(context string, report []byte) (err error)
+
+	// ForceKeyFrame makes the next message encoded in context be sent as a
+	// KF, e.g., when a receiver has restarted or joined mid-stream.
+	ForceKeyFrame(context string) (err error)
+
+	// ResyncRequest builds a request for the peer to send a KF in context,
+	// if the decoder of context has failed to decode a DF due to missing
+	// reference since the latest KF it received. request is nil if there's
+	// nothing to request, or if a request has been built within the last
+	// 200ms. The request should be sent back to the peer, which passes it to
+	// HandleFeedback, making its encoder act as if ForceKeyFrame was called.
+	ResyncRequest(context string) (request *ReusableSlice, err error)
+
+	// NACK builds a request for the peer to retransmit KFs that DFs decoded
+	// in context have referenced but found missing. Each KF is listed at most
+	// 3 times, 200ms apart, until it arrives; request is nil if there's
+	// nothing to list. The request should be sent back to the peer, which
+	// passes it to Retransmit.
+	NACK(context string) (request *ReusableSlice, err error)
+
+	// Retransmit answers a NACK built by the peer, returning packets of the
+	// listed KFs that are still cached by the encoder of context, marked as
+	// retransmissions, to be sent to the peer. Each KF is retransmitted at
+	// most MaxRetransmits times, RetransmitInterval apart; packets is empty
+	// if nothing is to be retransmitted.
+	Retransmit(context string, nack []byte) (packets []*ReusableSlice, err error)
+
+	// CloseContext releases the encoder and decoder of context, returning
+	// their cached slices to the pool. Using context again afterwards starts
+	// it over, as if it had never been used.
+	CloseContext(context string) (err error)
+
+	// SetContextConfig overrides endpoint config for context, taking effect
+	// immediately if the context is live. MaxPacketSize, MaxMessageSize,
+	// FragmentTimeout, MaxContexts, ContextIdleTimeout and jitter buffer
+	// settings are endpoint-wide and ignored in overrides. Passing nil config
+	// removes the override.
+	SetContextConfig(context string, config EndpointConfig)
+
+	// SetContextPrefixConfig is like SetContextConfig, but applies to all
+	// contexts with names starting with prefix. Overrides set with
+	// SetContextConfig take precedence, followed by the one with longest
+	// matching prefix.
+	SetContextPrefixConfig(prefix string, config EndpointConfig)
+
+	// Stats returns counters accumulated over all contexts, including closed
+	// ones.
+	Stats() (stats Stats)
+
+	// ContextStats returns counters of a live context; ok is false if context
+	// doesn't exist.
+	ContextStats(context string) (stats Stats, ok bool)
+
+	// Close closes all contexts. The Endpoint cannot be used afterwards.
+	Close() (err error)
 }
 
 type endpoint struct {
-	config endpointConfig
-	pool   *slicePool
+	config  endpointConfig
+	pool    *slicePool // for packets
+	msgPool *slicePool // for messages
+
+	overrides       map[string]endpointConfig // by context name
+	prefixOverrides map[string]endpointConfig // by context name prefix
 
-	encoders map[string]*encoder
-	decoders map[string]*decoder
+	// channel IDs assigned with RegisterChannel
+	registeredNames map[uint16]string
+	registeredIDs   map[string]uint16
+	// live contexts by channel ID, first one wins on collisions
+	liveChannels map[uint16]string
+
+	contexts map[string]*endpointContext
+	lru      *list.List // of *endpointContext, most recently used first
+	closed   bool
 	mapMu    *sync.Mutex
 
-	dStats *decoderStats
+	closedStats Stats // accumulated from contexts that have been closed
 }
 
+// msgPoolSlack is how many bytes slices of the message pool have beyond
+// MaxMessageSize, to leave room for what's added to messages when handled
+// internally: the length prefix of DFs, at most binary.MaxVarintLen64 bytes,
+// compression overhead of messages that don't compress, which is a few bytes
+// per block plus the gzip header and trailer, and the KF list of parity
+// frames, at most 1+maxParityGroupSize*12 bytes.
+const msgPoolSlack = 128
+
 func NewEndpoint(config EndpointConfig) Endpoint {
 	e := &endpoint{
 		config: *(config.(*endpointConfig)), // copy
 	}
 	e.pool = newSlicePool(e.config.maxPacketSize)
-	e.encoders = make(map[string]*encoder)
-	e.decoders = make(map[string]*decoder)
+	e.msgPool = newSlicePool(e.config.MaxMessageSize() + msgPoolSlack)
+	e.overrides = make(map[string]endpointConfig)
+	e.prefixOverrides = make(map[string]endpointConfig)
+	e.registeredNames = make(map[uint16]string)
+	e.registeredIDs = make(map[string]uint16)
+	e.liveChannels = make(map[uint16]string)
+	e.contexts = make(map[string]*endpointContext)
+	e.lru = list.New()
 	e.mapMu = new(sync.Mutex)
 
-	e.dStats = newDecoderStats(100)
-
 	return e
 }
 
+// now returns the current time according to the configured clock
+func (e *endpoint) now() time.Time {
+	return e.config.Clock()()
+}
+
 // data is copied to a ReusableSlice internally, i.e., caller can use the data
 // slice for other purposes safely
 func (e *endpoint) Encode(context string, data []byte, confidence uint8) (packet *ReusableSlice, err error) {
-	d := e.pool.get()
-	copy(d.Slice(), data)
-	d.Resize(len(data))
+	var d *ReusableSlice
+	if d, err = e.copyMessage(data); err != nil {
+		return
+	}
 	packet, err = e.EncodeReusable(context, d, confidence)
 	return
 }
 
 func (e *endpoint) EncodeReusable(context string, data *ReusableSlice, confidence uint8) (packet *ReusableSlice, err error) {
-	e.mapMu.Lock()
-	enc, ok := e.encoders[context]
-	if !ok {
-		enc = newEncoder(e.pool, e.config, e.dStats)
-		e.encoders[context] = enc
-	}
-	e.mapMu.Unlock()
-	packet, err = enc.encode(data, confidence)
+	var packets []*ReusableSlice
+	if packets, err = e.encode(context, data, confidence, 1); err != nil {
+		return
+	}
+	packet = packets[0]
+	return
+}
+
+// data is copied to a ReusableSlice internally, i.e., caller can use the data
+// slice for other purposes safely
+func (e *endpoint) EncodeFragments(context string, data []byte, confidence uint8) (packets []*ReusableSlice, err error) {
+	var d *ReusableSlice
+	if d, err = e.copyMessage(data); err != nil {
+		return
+	}
+	packets, err = e.encode(context, d, confidence, maxFragments)
 	return
 }
 
+func (e *endpoint) copyMessage(data []byte) (d *ReusableSlice, err error) {
+	if len(data) > e.config.MaxMessageSize() {
+		err = ErrMessageTooLarge
+		return
+	}
+	d = e.msgPool.get()
+	copy(d.Slice(), data)
+	d.Resize(len(data))
+	return
+}
+
+func (e *endpoint) encode(context string, data *ReusableSlice, confidence uint8, maxFragments int) (packets []*ReusableSlice, err error) {
+	var enc *encoder
+	for {
+		if enc, err = e.getEncoder(context); err != nil {
+			data.Done()
+			return
+		}
+		if packets, err = enc.encode(data, confidence, maxFragments); err != errContextClosed {
+			return
+		}
+	}
+}
+
 func (e *endpoint) Decode(context string, packet []byte) (data *ReusableSlice, err error) {
-	e.mapMu.Lock()
-	dec, ok := e.decoders[context]
-	if !ok {
-		dec = newDecoder(e.pool, e.dStats)
-		e.decoders[context] = dec
-	}
-	e.mapMu.Unlock()
-	data, err = dec.decode(packet)
+	data, _, err = e.DecodeWithSequence(context, packet)
+	return
+}
+
+func (e *endpoint) DecodeWithSequence(context string, packet []byte) (data *ReusableSlice, seq SequenceInfo, err error) {
+	var dec *decoder
+	for {
+		if dec, err = e.getDecoder(context); err != nil {
+			return
+		}
+		if data, seq, err = dec.decode(packet, e.now()); err != errContextClosed {
+			return
+		}
+	}
+}
+
+func (e *endpoint) DecodeMessages(context string, packet []byte) (messages []*ReusableSlice, err error) {
+	var dec *decoder
+	for {
+		if dec, err = e.getDecoder(context); err != nil {
+			return
+		}
+		if messages, err = dec.decodeMessages(packet, e.now()); err != errContextClosed {
+			return
+		}
+	}
+}
+
+func (e *endpoint) Feedback(context string) (report *ReusableSlice, err error) {
+	var dec *decoder
+	for {
+		if dec, err = e.getDecoder(context); err != nil {
+			return
+		}
+		if report, err = dec.feedback(); err != errContextClosed {
+			return
+		}
+	}
+}
+
+func (e *endpoint) HandleFeedback(context string, report []byte) (err error) {
+	var h header
+	if h, _, err = readHeader(report); err != nil {
+		return
+	}
+	if h.getFrameType() == frameRequest {
+		err = e.handleRequest(context, report)
+		return
+	}
+
+	var ids []uint32
+	var ratio float64
+	if ids, ratio, err = decodeFeedback(e.pool, report); err != nil {
+		return
+	}
+	var enc *encoder
+	if enc, err = e.lookupEncoder(context); err != nil {
+		return
+	}
+	if enc == nil {
+		err = fmt.Errorf("feedback for unknown context %q", context)
+		return
+	}
+	if err = enc.handleFeedback(ids, ratio); err == errContextClosed {
+		err = nil // report is about KFs that are gone anyway
+	}
+	return
+}
+
+func (e *endpoint) handleRequest(context string, request []byte) (err error) {
+	var kind uint8
+	if kind, _, _, err = decodeRequest(e.pool, request); err != nil {
+		return
+	}
+	if kind != requestResync {
+		err = errors.New("NACKs are to be answered with Retransmit")
+		return
+	}
+	err = e.ForceKeyFrame(context)
+	return
+}
+
+func (e *endpoint) Pending(context string) (packets []*ReusableSlice, err error) {
+	var enc *encoder
+	for {
+		if enc, err = e.getEncoder(context); err != nil {
+			return
+		}
+		if packets, err = enc.takePending(); err != errContextClosed {
+			return
+		}
+	}
+}
+
+func (e *endpoint) ForceKeyFrame(context string) (err error) {
+	var enc *encoder
+	for {
+		if enc, err = e.getEncoder(context); err != nil {
+			return
+		}
+		if err = enc.forceKeyFrame(); err != errContextClosed {
+			return
+		}
+	}
+}
+
+func (e *endpoint) ResyncRequest(context string) (request *ReusableSlice, err error) {
+	var dec *decoder
+	for {
+		if dec, err = e.getDecoder(context); err != nil {
+			return
+		}
+		if request, err = dec.resyncRequest(e.now()); err != errContextClosed {
+			return
+		}
+	}
+}
+
+func (e *endpoint) NACK(context string) (request *ReusableSlice, err error) {
+	var dec *decoder
+	for {
+		if dec, err = e.getDecoder(context); err != nil {
+			return
+		}
+		if request, err = dec.nack(e.now()); err != errContextClosed {
+			return
+		}
+	}
+}
+
+func (e *endpoint) Retransmit(context string, nack []byte) (packets []*ReusableSlice, err error) {
+	var kind uint8
+	var ids []uint32
+	if kind, _, ids, err = decodeRequest(e.pool, nack); err != nil {
+		return
+	}
+	if kind != requestNACK {
+		err = fmt.Errorf("not a NACK (request kind %d)", kind)
+		return
+	}
+	var enc *encoder
+	if enc, err = e.lookupEncoder(context); err != nil {
+		return
+	}
+	if enc == nil {
+		err = fmt.Errorf("NACK for unknown context %q", context)
+		return
+	}
+	if packets, err = enc.retransmit(ids, maxFragments, e.now()); err == errContextClosed {
+		err = nil // KFs are gone anyway
+	}
 	return
 }
@@ -1,45 +1,251 @@
 package ictl
 
+import "time"
+
 type EndpointConfig interface {
 	MaxPacketSize() int
+	MaxMessageSize() int
+	FragmentTimeout() time.Duration
 	CompressionAlgorithm() CompressionAlgorithm
 	EncoderCycleLength() uint16
+	MaxEncoderCycleLength() uint16
 	ConfidenceLookback() int
+	MaxContexts() int
+	ContextIdleTimeout() time.Duration
+	Checksum() bool
+	SequenceNumbers() bool
+	ChannelIDs() bool
+	ExtendedIDs() bool
+	HeaderCompression() bool
+	MaxRetransmits() int
+	RetransmitInterval() time.Duration
+	JitterBufferSize() int
+	JitterBufferTimeout() time.Duration
+	JitterBufferInOrder() bool
+	ParityGroupSize() int
+	KFRepeats() int
+	KFRepeatSpacing() int
+	RefreshSlices() int
+	Clock() func() time.Time
+
+	// returns a copy of the config, which can be changed without affecting
+	// the original
+	Clone() EndpointConfig
 
 	SetConfidenceLookback(int) EndpointConfig
 	SetMaxPacketSize(int) EndpointConfig
+
+	// max size of messages; KFs that don't fit in MaxPacketSize are split
+	// into fragments by EncodeFragments. Set to 0 to use MaxPacketSize.
+	SetMaxMessageSize(int) EndpointConfig
+
+	// fragments of a KF not completed within this are dropped by decoders
+	SetFragmentTimeout(time.Duration) EndpointConfig
+
 	SetCompressionAlgorithm(CompressionAlgorithm) EndpointConfig
 
 	// set to 0 to use adaptive
 	SetEncoderCycleLength(uint16) EndpointConfig
+
+	// upper limit of cycle length in adaptive mode; 0, the default, for no
+	// limit
+	SetMaxEncoderCycleLength(uint16) EndpointConfig
+
+	// max number of contexts kept by an endpoint; least recently used ones are
+	// closed when exceeded. Set to 0 for no limit.
+	SetMaxContexts(int) EndpointConfig
+
+	// contexts not used for longer than this are closed; set to 0 to keep idle
+	// contexts forever
+	SetContextIdleTimeout(time.Duration) EndpointConfig
+
+	// whether encoders include a checksum of the original message in packets,
+	// which decoders verify after reconstructing the message
+	SetChecksum(bool) EndpointConfig
+
+	// whether encoders include sequence numbers in DFs, so that decoders can
+	// detect lost, duplicate and out-of-order messages. KFs always carry it.
+	SetSequenceNumbers(bool) EndpointConfig
+
+	// whether encoders include channel ID of the context in packets, so that
+	// the peer can find out the context with DecodeAny
+	SetChannelIDs(bool) EndpointConfig
+
+	// whether encoders use 32-bit frame IDs and sequence numbers instead of
+	// 16-bit ones, which wrap around every 65536 messages. Packets with
+	// extended IDs use header version 2, which older decoders reject.
+	SetExtendedIDs(bool) EndpointConfig
+
+	// whether encoders use a 1-byte compressed header for DFs referencing the
+	// latest KF, once it's known to be held by the peer, i.e., acknowledged
+	// through feedback or encoded with confidence 255, except for the first
+	// cycle of a new context. Only DFs without optional header fields are
+	// compressed, so it has no effect with Checksum, SequenceNumbers or
+	// ChannelIDs enabled. KFs carry a 2-byte epoch, so that the peer follows
+	// the encoder across restarts. Decoders that don't support it reject
+	// both, so the peer has to be upgraded first.
+	SetHeaderCompression(bool) EndpointConfig
+
+	// max number of times each KF is retransmitted in answer to NACKs; set to
+	// 0 to ignore NACKs
+	SetMaxRetransmits(int) EndpointConfig
+
+	// min interval between retransmissions of the same KF, so that NACKs
+	// sent again before the retransmission arrives don't trigger another one
+	SetRetransmitInterval(time.Duration) EndpointConfig
+
+	// max number of messages held in the jitter buffer of each decoder, which
+	// holds DFs arriving before the KF they reference, instead of failing
+	// them; set to 0 to disable. The jitter buffer is only used by
+	// DecodeMessages, and is endpoint-wide, i.e., ignored in overrides.
+	SetJitterBufferSize(int) EndpointConfig
+
+	// max time a DF is held in the jitter buffer before it's dropped
+	SetJitterBufferTimeout(time.Duration) EndpointConfig
+
+	// whether messages decoded while DFs are held in the jitter buffer wait
+	// behind them, so that messages are delivered in the order they arrived,
+	// rather than as soon as they're available
+	SetJitterBufferInOrder(bool) EndpointConfig
+
+	// number of KFs covered by each parity frame: after every that many KFs,
+	// the encoder sends the XOR of them, from which the decoder can rebuild
+	// any one of them that is lost. Set to 0 to disable; at most 8. Parity
+	// frames are returned by EncodeFragments after packets of the KF
+	// completing a group, and by Pending after Encode and EncodeReusable.
+	SetParityGroupSize(int) EndpointConfig
+
+	// number of times each KF is repeated after it's sent, so that a lost KF
+	// is likely made up for by a copy before many DFs referencing it fail.
+	// Copies are marked like retransmissions, so that decoders holding the KF
+	// already drop them, and don't count them in sequence statistics. They're
+	// returned by EncodeFragments after packets of later messages sent as
+	// DFs, one every KFRepeatSpacing messages, and by Pending after Encode and
+	// EncodeReusable. A new KF cancels pending repeats of the previous one.
+	// Set to 0 to disable.
+	SetKFRepeats(int) EndpointConfig
+
+	// number of messages between repeats of a KF, and between the KF and its
+	// first repeat; at least 1
+	SetKFRepeatSpacing(int) EndpointConfig
+
+	// number of packets the reference is refreshed over, instead of sending
+	// KFs: where a KF is due, the message becomes the new reference, and it
+	// and the following messages are sent as DFs against the current
+	// reference, each carrying a segment of the new one. The decoder caches
+	// the new reference as a KF once it has all segments, and later DFs
+	// reference it. So packet sizes stay flat, rather than bursting with each
+	// KF. The first message, and messages sent after ForceKeyFrame or a
+	// resync request, are still sent as KFs. Set to 0 to send KFs; at most
+	// 255.
+	SetRefreshSlices(int) EndpointConfig
+
+	// function returning the current time, which timeouts and rate limits
+	// are measured with, e.g., fragment and jitter buffer timeouts, idle
+	// eviction and retransmit intervals. It's time.Now by default; tests and
+	// simulations set a virtual clock, so that results don't depend on the
+	// wall clock. Set to nil for time.Now.
+	SetClock(func() time.Time) EndpointConfig
 }
 
 func DefaultEndpointConfig() EndpointConfig {
 	return &endpointConfig{
-		maxPacketSize:      1379,
-		cmpAlgr:            CAAuto,
-		cycleLength:        0,
-		confidenceLookback: 1,
+		maxPacketSize:       1379,
+		cmpAlgr:             CAAuto,
+		cycleLength:         0,
+		confidenceLookback:  1,
+		fragmentTimeout:     time.Second,
+		maxRetransmits:      3,
+		retransmitInterval:  100 * time.Millisecond,
+		jitterBufferTimeout: 50 * time.Millisecond,
+		kfRepeatSpacing:     1,
 	}
 }
 
 type endpointConfig struct {
-	maxPacketSize      int
-	cmpAlgr            CompressionAlgorithm
-	cycleLength        uint16
-	confidenceLookback int
+	maxPacketSize       int
+	maxMessageSize      int
+	fragmentTimeout     time.Duration
+	cmpAlgr             CompressionAlgorithm
+	cycleLength         uint16
+	maxCycleLength      uint16
+	confidenceLookback  int
+	maxContexts         int
+	contextIdleTimeout  time.Duration
+	checksum            bool
+	sequenceNumbers     bool
+	channelIDs          bool
+	extendedIDs         bool
+	headerCompression   bool
+	maxRetransmits      int
+	retransmitInterval  time.Duration
+	jitterBufferSize    int
+	jitterBufferTimeout time.Duration
+	jitterBufferInOrder bool
+	parityGroupSize     int
+	kfRepeats           int
+	kfRepeatSpacing     int
+	refreshSlices       int
+	clock               func() time.Time // nil for time.Now
 }
 
 func (e *endpointConfig) MaxPacketSize() int                         { return e.maxPacketSize }
+func (e *endpointConfig) FragmentTimeout() time.Duration             { return e.fragmentTimeout }
 func (e *endpointConfig) CompressionAlgorithm() CompressionAlgorithm { return e.cmpAlgr }
 func (e *endpointConfig) EncoderCycleLength() uint16                 { return e.cycleLength }
+func (e *endpointConfig) MaxEncoderCycleLength() uint16              { return e.maxCycleLength }
 func (e *endpointConfig) ConfidenceLookback() int                    { return e.confidenceLookback }
+func (e *endpointConfig) MaxContexts() int                           { return e.maxContexts }
+func (e *endpointConfig) ContextIdleTimeout() time.Duration          { return e.contextIdleTimeout }
+func (e *endpointConfig) Checksum() bool                             { return e.checksum }
+func (e *endpointConfig) SequenceNumbers() bool                      { return e.sequenceNumbers }
+func (e *endpointConfig) ChannelIDs() bool                           { return e.channelIDs }
+func (e *endpointConfig) ExtendedIDs() bool                          { return e.extendedIDs }
+func (e *endpointConfig) HeaderCompression() bool                    { return e.headerCompression }
+func (e *endpointConfig) MaxRetransmits() int                        { return e.maxRetransmits }
+func (e *endpointConfig) RetransmitInterval() time.Duration          { return e.retransmitInterval }
+func (e *endpointConfig) JitterBufferSize() int                      { return e.jitterBufferSize }
+func (e *endpointConfig) JitterBufferTimeout() time.Duration         { return e.jitterBufferTimeout }
+func (e *endpointConfig) JitterBufferInOrder() bool                  { return e.jitterBufferInOrder }
+func (e *endpointConfig) ParityGroupSize() int                       { return e.parityGroupSize }
+func (e *endpointConfig) KFRepeats() int                             { return e.kfRepeats }
+func (e *endpointConfig) KFRepeatSpacing() int                       { return e.kfRepeatSpacing }
+func (e *endpointConfig) RefreshSlices() int                         { return e.refreshSlices }
+
+func (e *endpointConfig) Clock() func() time.Time {
+	if e.clock == nil {
+		return time.Now
+	}
+	return e.clock
+}
+
+func (e *endpointConfig) Clone() EndpointConfig {
+	c := *e
+	return &c
+}
 
 func (e *endpointConfig) SetMaxPacketSize(v int) EndpointConfig {
 	e.maxPacketSize = v
 	return e
 }
 
+func (e *endpointConfig) MaxMessageSize() int {
+	if e.maxMessageSize == 0 {
+		return e.maxPacketSize
+	}
+	return e.maxMessageSize
+}
+
+func (e *endpointConfig) SetMaxMessageSize(v int) EndpointConfig {
+	e.maxMessageSize = v
+	return e
+}
+
+func (e *endpointConfig) SetFragmentTimeout(timeout time.Duration) EndpointConfig {
+	e.fragmentTimeout = timeout
+	return e
+}
+
 func (e *endpointConfig) SetCompressionAlgorithm(v CompressionAlgorithm) EndpointConfig {
 	e.cmpAlgr = v
 	return e
@@ -50,6 +256,11 @@ func (e *endpointConfig) SetEncoderCycleLength(cycleLength uint16) EndpointConfi
 	return e
 }
 
+func (e *endpointConfig) SetMaxEncoderCycleLength(maxCycleLength uint16) EndpointConfig {
+	e.maxCycleLength = maxCycleLength
+	return e
+}
+
 func (e *endpointConfig) SetConfidenceLookback(confidenceLookback int) EndpointConfig {
 	e.confidenceLookback = confidenceLookback
 	if confidenceLookback < 1 {
@@ -57,3 +268,109 @@ func (e *endpointConfig) SetConfidenceLookback(confidenceLookback int) EndpointC
 	}
 	return e
 }
+
+func (e *endpointConfig) SetMaxContexts(maxContexts int) EndpointConfig {
+	e.maxContexts = maxContexts
+	if maxContexts < 0 {
+		panic("invalid maxContexts")
+	}
+	return e
+}
+
+func (e *endpointConfig) SetContextIdleTimeout(timeout time.Duration) EndpointConfig {
+	e.contextIdleTimeout = timeout
+	return e
+}
+
+func (e *endpointConfig) SetChecksum(checksum bool) EndpointConfig {
+	e.checksum = checksum
+	return e
+}
+
+func (e *endpointConfig) SetSequenceNumbers(sequenceNumbers bool) EndpointConfig {
+	e.sequenceNumbers = sequenceNumbers
+	return e
+}
+
+func (e *endpointConfig) SetChannelIDs(channelIDs bool) EndpointConfig {
+	e.channelIDs = channelIDs
+	return e
+}
+
+func (e *endpointConfig) SetExtendedIDs(extendedIDs bool) EndpointConfig {
+	e.extendedIDs = extendedIDs
+	return e
+}
+
+func (e *endpointConfig) SetHeaderCompression(headerCompression bool) EndpointConfig {
+	e.headerCompression = headerCompression
+	return e
+}
+
+func (e *endpointConfig) SetMaxRetransmits(maxRetransmits int) EndpointConfig {
+	e.maxRetransmits = maxRetransmits
+	if maxRetransmits < 0 {
+		panic("invalid maxRetransmits")
+	}
+	return e
+}
+
+func (e *endpointConfig) SetRetransmitInterval(interval time.Duration) EndpointConfig {
+	e.retransmitInterval = interval
+	return e
+}
+
+func (e *endpointConfig) SetJitterBufferSize(size int) EndpointConfig {
+	e.jitterBufferSize = size
+	if size < 0 {
+		panic("invalid jitterBufferSize")
+	}
+	return e
+}
+
+func (e *endpointConfig) SetJitterBufferTimeout(timeout time.Duration) EndpointConfig {
+	e.jitterBufferTimeout = timeout
+	return e
+}
+
+func (e *endpointConfig) SetJitterBufferInOrder(inOrder bool) EndpointConfig {
+	e.jitterBufferInOrder = inOrder
+	return e
+}
+
+func (e *endpointConfig) SetParityGroupSize(size int) EndpointConfig {
+	e.parityGroupSize = size
+	if size < 0 || size > maxParityGroupSize {
+		panic("invalid parityGroupSize")
+	}
+	return e
+}
+
+func (e *endpointConfig) SetKFRepeats(repeats int) EndpointConfig {
+	e.kfRepeats = repeats
+	if repeats < 0 {
+		panic("invalid kfRepeats")
+	}
+	return e
+}
+
+func (e *endpointConfig) SetKFRepeatSpacing(spacing int) EndpointConfig {
+	e.kfRepeatSpacing = spacing
+	if spacing < 1 {
+		panic("invalid kfRepeatSpacing")
+	}
+	return e
+}
+
+func (e *endpointConfig) SetRefreshSlices(slices int) EndpointConfig {
+	e.refreshSlices = slices
+	if slices < 0 || slices > maxRefreshSlices {
+		panic("invalid refreshSlices")
+	}
+	return e
+}
+
+func (e *endpointConfig) SetClock(clock func() time.Time) EndpointConfig {
+	e.clock = clock
+	return e
+}
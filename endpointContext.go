@@ -0,0 +1,239 @@
+package ictl
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrEndpointClosed is returned by methods of an Endpoint that has been
+// closed.
+var ErrEndpointClosed = errors.New("endpoint is closed")
+
+// errContextClosed is returned by encoders and decoders that have been closed,
+// e.g., evicted by another goroutine while being used. Endpoint retries with a
+// new context when getting it.
+var errContextClosed = errors.New("context is closed")
+
+type endpointContext struct {
+	name    string
+	channel uint16
+	enc     *encoder // nil until first used for encoding
+	dec     *decoder // nil until first used for decoding
+
+	dStats *decoderStats // shared by enc and dec
+
+	lastUsed time.Time
+	elem     *list.Element // in endpoint.lru
+}
+
+func (c *endpointContext) close() {
+	if c.enc != nil {
+		c.enc.close()
+	}
+	if c.dec != nil {
+		c.dec.close()
+	}
+}
+
+func closeContexts(contexts []*endpointContext) {
+	for _, c := range contexts {
+		c.close()
+	}
+}
+
+// touchContext looks up context named name and marks it as most recently
+// used. If it doesn't exist and create is true, a new context is created. The
+// result is nil if it doesn't exist and create is false. Contexts that are
+// idle for too long or exceed the max number of contexts are removed, and
+// returned as evicted, which caller should close after unlocking mapMu.
+//
+// Caller must hold e.mapMu.
+func (e *endpoint) touchContext(name string, create bool) (c *endpointContext, evicted []*endpointContext, err error) {
+	if e.closed {
+		err = ErrEndpointClosed
+		return
+	}
+
+	now := e.now()
+	if c = e.contexts[name]; c != nil {
+		e.lru.MoveToFront(c.elem)
+	} else if create {
+		c = &endpointContext{name: name, channel: e.channelOf(name), dStats: newDecoderStats(100)}
+		c.elem = e.lru.PushFront(c)
+		e.contexts[name] = c
+		e.addLiveChannel(c)
+	}
+	if c != nil {
+		c.lastUsed = now
+	}
+
+	for back := e.lru.Back(); back != nil && back.Value != c; back = e.lru.Back() {
+		oldest := back.Value.(*endpointContext)
+		if (e.config.maxContexts == 0 || e.lru.Len() <= e.config.maxContexts) &&
+			(e.config.contextIdleTimeout == 0 || now.Sub(oldest.lastUsed) <= e.config.contextIdleTimeout) {
+			break
+		}
+		e.removeContext(oldest)
+		evicted = append(evicted, oldest)
+	}
+
+	return
+}
+
+// Caller must hold e.mapMu.
+func (e *endpoint) removeContext(c *endpointContext) {
+	e.closedStats.add(c.stats())
+	e.lru.Remove(c.elem)
+	e.removeLiveChannel(c)
+	delete(e.contexts, c.name)
+}
+
+func (e *endpoint) getEncoder(context string) (enc *encoder, err error) {
+	var c *endpointContext
+	var evicted []*endpointContext
+	e.mapMu.Lock()
+	if c, evicted, err = e.touchContext(context, true); err == nil {
+		if c.enc == nil {
+			c.enc = newEncoder(e.pool, e.msgPool, e.configFor(context), c.channel, c.dStats)
+		}
+		enc = c.enc
+	}
+	e.mapMu.Unlock()
+	closeContexts(evicted)
+	return
+}
+
+func (e *endpoint) getDecoder(context string) (dec *decoder, err error) {
+	var c *endpointContext
+	var evicted []*endpointContext
+	e.mapMu.Lock()
+	if c, evicted, err = e.touchContext(context, true); err == nil {
+		if c.dec == nil {
+			c.dec = newDecoder(e.msgPool, e.config, c.dStats)
+		}
+		dec = c.dec
+	}
+	e.mapMu.Unlock()
+	closeContexts(evicted)
+	return
+}
+
+// lookupEncoder is like getEncoder, but doesn't create a new encoder; enc is
+// nil if context doesn't have one.
+func (e *endpoint) lookupEncoder(context string) (enc *encoder, err error) {
+	var c *endpointContext
+	var evicted []*endpointContext
+	e.mapMu.Lock()
+	if c, evicted, err = e.touchContext(context, false); err == nil && c != nil {
+		enc = c.enc
+	}
+	e.mapMu.Unlock()
+	closeContexts(evicted)
+	return
+}
+
+func (e *endpoint) CloseContext(context string) (err error) {
+	e.mapMu.Lock()
+	if e.closed {
+		err = ErrEndpointClosed
+		e.mapMu.Unlock()
+		return
+	}
+	c := e.contexts[context]
+	if c != nil {
+		e.removeContext(c)
+	}
+	e.mapMu.Unlock()
+	if c != nil {
+		c.close()
+	}
+	return
+}
+
+func (e *endpoint) Close() (err error) {
+	e.mapMu.Lock()
+	if e.closed {
+		err = ErrEndpointClosed
+		e.mapMu.Unlock()
+		return
+	}
+	e.closed = true
+	var closing []*endpointContext
+	for _, c := range e.contexts {
+		e.closedStats.add(c.stats())
+		closing = append(closing, c)
+	}
+	e.contexts = nil
+	e.liveChannels = nil
+	e.lru.Init()
+	e.mapMu.Unlock()
+	closeContexts(closing)
+	return
+}
+
+// configFor returns the config applied to context named name.
+//
+// Caller must hold e.mapMu.
+func (e *endpoint) configFor(name string) endpointConfig {
+	if config, ok := e.overrides[name]; ok {
+		return config
+	}
+	longest := -1
+	config := e.config
+	for prefix, override := range e.prefixOverrides {
+		if len(prefix) > longest && strings.HasPrefix(name, prefix) {
+			longest = len(prefix)
+			config = override
+		}
+	}
+	return config
+}
+
+func (e *endpoint) SetContextConfig(context string, config EndpointConfig) {
+	e.mapMu.Lock()
+	defer e.mapMu.Unlock()
+	if config == nil {
+		delete(e.overrides, context)
+	} else {
+		e.overrides[context] = e.overrideFrom(config)
+	}
+	e.reconfigureContexts()
+}
+
+func (e *endpoint) SetContextPrefixConfig(prefix string, config EndpointConfig) {
+	e.mapMu.Lock()
+	defer e.mapMu.Unlock()
+	if config == nil {
+		delete(e.prefixOverrides, prefix)
+	} else {
+		e.prefixOverrides[prefix] = e.overrideFrom(config)
+	}
+	e.reconfigureContexts()
+}
+
+// overrideFrom copies config, keeping endpoint-wide settings from e.config
+func (e *endpoint) overrideFrom(config EndpointConfig) (override endpointConfig) {
+	override = *(config.(*endpointConfig)) // copy
+	override.maxPacketSize = e.config.maxPacketSize
+	override.maxMessageSize = e.config.maxMessageSize
+	override.fragmentTimeout = e.config.fragmentTimeout
+	override.maxContexts = e.config.maxContexts
+	override.contextIdleTimeout = e.config.contextIdleTimeout
+	override.jitterBufferSize = e.config.jitterBufferSize
+	override.jitterBufferTimeout = e.config.jitterBufferTimeout
+	override.jitterBufferInOrder = e.config.jitterBufferInOrder
+	return
+}
+
+// reconfigureContexts applies current config to encoders of live contexts.
+//
+// Caller must hold e.mapMu.
+func (e *endpoint) reconfigureContexts() {
+	for name, c := range e.contexts {
+		if c.enc != nil {
+			c.enc.setConfig(e.configFor(name))
+		}
+	}
+}
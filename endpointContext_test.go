@@ -0,0 +1,162 @@
+package ictl
+
+import (
+	"testing"
+	"time"
+)
+
+func contextNames(e Endpoint) (names map[string]bool) {
+	ep := e.(*endpoint)
+	ep.mapMu.Lock()
+	defer ep.mapMu.Unlock()
+	names = make(map[string]bool)
+	for name := range ep.contexts {
+		names[name] = true
+	}
+	return
+}
+
+func encodeAndDrop(t *testing.T, e Endpoint, context string) {
+	packet, err := e.Encode(context, []byte("hello, "+context), 0)
+	if err != nil {
+		t.Fatalf("calling Encode() error: %v\n", err)
+	}
+	packet.Done()
+}
+
+func TestCloseContext(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(10)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	for i := 0; i < 2; i++ {
+		packet, err := sender.Encode("test", []byte("hello"), 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		if i == 1 {
+			if err = receiver.CloseContext("test"); err != nil {
+				t.Fatalf("calling receiver.CloseContext() error: %v\n", err)
+			}
+		}
+		data, err := receiver.Decode("test", packet.Slice())
+		packet.Done()
+		if i == 1 {
+			if err == nil {
+				t.Fatalf("DF decoded after KF has been released by CloseContext\n")
+			}
+		} else if err != nil {
+			t.Fatalf("calling receiver.Decode() error: %v\n", err)
+		} else {
+			data.Done()
+		}
+	}
+
+	if err := sender.CloseContext("test"); err != nil {
+		t.Fatalf("calling sender.CloseContext() error: %v\n", err)
+	}
+	packet, err := sender.Encode("test", []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("calling sender.Encode() error: %v\n", err)
+	}
+	data, err := receiver.Decode("test", packet.Slice())
+	packet.Done()
+	if err != nil {
+		t.Fatalf("context should start over with a KF after being closed: %v\n", err)
+	}
+	data.Done()
+}
+
+func TestMaxContexts(t *testing.T) {
+	e := NewEndpoint(DefaultEndpointConfig().SetMaxContexts(2))
+	encodeAndDrop(t, e, "a")
+	encodeAndDrop(t, e, "b")
+	encodeAndDrop(t, e, "a")
+	encodeAndDrop(t, e, "c")
+
+	names := contextNames(e)
+	if len(names) != 2 || !names["a"] || !names["c"] {
+		t.Fatalf("expected contexts a and c; got %v\n", names)
+	}
+}
+
+func TestContextIdleTimeout(t *testing.T) {
+	e := NewEndpoint(DefaultEndpointConfig().SetContextIdleTimeout(20 * time.Millisecond))
+	encodeAndDrop(t, e, "a")
+	encodeAndDrop(t, e, "b")
+	time.Sleep(50 * time.Millisecond)
+	encodeAndDrop(t, e, "b")
+
+	names := contextNames(e)
+	if len(names) != 1 || !names["b"] {
+		t.Fatalf("expected only context b; got %v\n", names)
+	}
+}
+
+func TestEndpointClose(t *testing.T) {
+	e := NewEndpoint(DefaultEndpointConfig())
+	encodeAndDrop(t, e, "a")
+	if err := e.Close(); err != nil {
+		t.Fatalf("calling Close() error: %v\n", err)
+	}
+	if _, err := e.Encode("a", []byte("hello"), 0); err != ErrEndpointClosed {
+		t.Fatalf("Encode() on closed endpoint returned %v; expected ErrEndpointClosed\n", err)
+	}
+	if _, err := e.Decode("a", []byte{}); err != ErrEndpointClosed {
+		t.Fatalf("Decode() on closed endpoint returned %v; expected ErrEndpointClosed\n", err)
+	}
+	if err := e.Close(); err != ErrEndpointClosed {
+		t.Fatalf("second Close() returned %v; expected ErrEndpointClosed\n", err)
+	}
+}
+
+func frameTypes(t *testing.T, e Endpoint, context string, n int) (types []uint8) {
+	for i := 0; i < n; i++ {
+		packet, err := e.Encode(context, []byte("hello, "+context), 0)
+		if err != nil {
+			t.Fatalf("calling Encode() error: %v\n", err)
+		}
+		var h header
+		h.frameType = packet.Slice()[0]
+		types = append(types, h.getFrameType())
+		packet.Done()
+	}
+	return
+}
+
+func countKFs(types []uint8) (kfs int) {
+	for _, ty := range types {
+		if ty == frameKF {
+			kfs++
+		}
+	}
+	return
+}
+
+func TestContextConfigOverrides(t *testing.T) {
+	e := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(10))
+	e.SetContextPrefixConfig("can/", DefaultEndpointConfig().SetEncoderCycleLength(2))
+	e.SetContextPrefixConfig("can/diag/", DefaultEndpointConfig().SetEncoderCycleLength(5))
+	e.SetContextConfig("can/diag/dtc", DefaultEndpointConfig().SetEncoderCycleLength(1))
+
+	for context, expected := range map[string]int{
+		"other":        1,
+		"can/speed":    5,
+		"can/diag/obd": 2,
+		"can/diag/dtc": 10,
+	} {
+		if kfs := countKFs(frameTypes(t, e, context, 10)); kfs != expected {
+			t.Fatalf("got %d KFs in 10 messages in context %s; expected %d\n", kfs, context, expected)
+		}
+	}
+
+	// live context picks up the change
+	e.SetContextConfig("other", DefaultEndpointConfig().SetEncoderCycleLength(1))
+	if kfs := countKFs(frameTypes(t, e, "other", 10)); kfs != 10 {
+		t.Fatalf("got %d KFs in 10 messages after reconfiguring; expected 10\n", kfs)
+	}
+	e.SetContextConfig("other", nil)
+	if kfs := countKFs(frameTypes(t, e, "other", 10)); kfs != 1 {
+		t.Fatalf("got %d KFs in 10 messages after removing override; expected 1\n", kfs)
+	}
+}
@@ -3,6 +3,7 @@ package ictl
 import (
 	"bytes"
 	"crypto/rand"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -108,3 +109,189 @@ func BenchmarkDefaultFlateIdentical(b *testing.B) {
 		}
 	}
 }
+
+func TestEndpointVariableLength(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8)
+	endpoint1 := NewEndpoint(config)
+	endpoint2 := NewEndpoint(config)
+
+	msgs := []string{
+		"speed=42;heading=180;lights=on",
+		"speed=42;heading=180",               // shrinking
+		"speed=42;heading=180;lights=",       // growing, but shorter than KF
+		"speed=42;heading=180;lights=on;x",   // longer than KF
+		"speed=42;heading=180;lights=on\x00", // trailing zero
+		"",                                   // empty
+		"speed=4",
+		"speed=42;heading=180;lights=on", // identical to KF
+	}
+	for i := 0; i < 2; i++ { // cross cycle boundary
+		for j, msg := range msgs {
+			packet, err := endpoint1.Encode("test", []byte(msg), 0)
+			if err != nil {
+				t.Fatalf("calling endpoint1.Encode() error: %v\n", err)
+			}
+			// only DFs shorter than the KF need the length prefix
+			var h header
+			if err = h.readFrom(bytes.NewReader(packet.Slice())); err != nil {
+				t.Fatalf("error reading header: %v\n", err)
+			}
+			if j > 0 && h.hasLengthPrefix() != (len(msg) < len(msgs[0])) {
+				t.Fatalf("%q: unexpected header %+v\n", msg, h)
+			}
+			rcvd, err := endpoint2.Decode("test", packet.Slice())
+			if err != nil {
+				t.Fatalf("calling endpoint2.Decode() error: %v\n", err)
+			}
+			packet.Done()
+			if got := string(rcvd.Slice()); got != msg {
+				t.Fatalf("decoded data is not equal to sent data: %q != %q\n", got, msg)
+			}
+			rcvd.Done()
+		}
+	}
+}
+
+func TestEndpointChecksum(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(4).SetChecksum(true)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	send := func(msg string) (data *ReusableSlice, err error) {
+		packet, err := sender.Encode("test", []byte(msg), 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		defer packet.Done()
+		return receiver.Decode("test", packet.Slice())
+	}
+
+	if data, err := send("speed=42;heading=180"); err != nil {
+		t.Fatalf("calling receiver.Decode() error: %v\n", err)
+	} else if string(data.Slice()) != "speed=42;heading=180" {
+		t.Fatalf("decoded data is not equal to sent data: %q\n", data.Slice())
+	} else {
+		data.Done()
+	}
+
+	// sender restarts, and the new KF with the same ID gets lost; the DF then
+	// gets decoded against the stale KF
+	sender.CloseContext("test")
+	packet, err := sender.Encode("test", []byte("speed=10;heading=090"), 0)
+	if err != nil {
+		t.Fatalf("calling sender.Encode() error: %v\n", err)
+	}
+	packet.Done()
+	if _, err = send("speed=11;heading=090"); err != ErrChecksumMismatch {
+		t.Fatalf("decoding against wrong KF returned %v; expected ErrChecksumMismatch\n", err)
+	}
+}
+
+func TestEndpointHeaderCompression(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(4).SetCompressionAlgorithm(CANone).SetHeaderCompression(true)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	send := func(i int, confidence uint8) (packet *ReusableSlice, message []byte) {
+		message = []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, byte(i)}
+		packet, err := sender.Encode("can", message, confidence)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		return packet, message
+	}
+	receive := func(i int, packet *ReusableSlice, message []byte) {
+		data, err := receiver.Decode("can", packet.Slice())
+		if err != nil {
+			t.Fatalf("message #%d: calling receiver.Decode() error: %v\n", i, err)
+		}
+		if !bytes.Equal(data.Slice(), message) {
+			t.Fatalf("message #%d: decoded %x; expected %x\n", i, data.Slice(), message)
+		}
+		data.Done()
+	}
+
+	// the KF isn't known to be held by the receiver; full headers
+	for i := 0; i < 4; i++ {
+		packet, message := send(i, 0)
+		if h, _, _ := readHeader(packet.Slice()); h.compressed {
+			t.Fatalf("message #%d: compressed header before KF is acknowledged\n", i)
+		}
+		receive(i, packet, message)
+		packet.Done()
+	}
+
+	// optimistically assumed to be held
+	for i := 4; i < 8; i++ {
+		packet, message := send(i, maxConfidence)
+		if h, _, _ := readHeader(packet.Slice()); h.compressed != (h.getFrameType() == frameDF) {
+			t.Fatalf("message #%d: only DFs should have compressed headers\n", i)
+		}
+		receive(i, packet, message)
+		packet.Done()
+	}
+
+	if stats := sender.Stats(); stats.KFsSent != 2 || stats.DFsSent != 6 || stats.Algorithms[CANone] != 8 {
+		t.Fatalf("unexpected sender stats: %+v\n", stats)
+	}
+
+	// KF #8 is lost; DFs referencing it must not be decoded against KF #4
+	packet, _ := send(8, maxConfidence)
+	packet.Done()
+	for i := 9; i < 12; i++ {
+		packet, _ := send(i, maxConfidence)
+		if data, err := receiver.Decode("can", packet.Slice()); err == nil {
+			data.Done()
+			t.Fatalf("message #%d: decoded against a wrong KF\n", i)
+		}
+		packet.Done()
+	}
+
+	// late and duplicate KFs must not move the implied reference back
+	late := make(map[int][]byte)
+	for i := 12; i < 20; i++ {
+		packet, message := send(i, maxConfidence)
+		if i%4 == 0 {
+			late[i] = append([]byte(nil), packet.Slice()...)
+		}
+		receive(i, packet, message)
+		packet.Done()
+		if i == 16 {
+			for _, k := range []int{12, 16, 12} {
+				if data, err := receiver.Decode("can", late[k]); err == nil {
+					data.Done()
+				}
+			}
+		}
+	}
+
+	// the sender restarts, with IDs starting over; DFs of its first cycle have
+	// full headers, and its KFs become the implied reference although their
+	// IDs are behind, while a late KF from before the restart doesn't
+	sender.CloseContext("can")
+	for i := 0; i < 8; i++ {
+		packet, message := send(i, maxConfidence)
+		if h, _, _ := readHeader(packet.Slice()); h.compressed != (i > 4) {
+			t.Fatalf("message #%d after restart: unexpected header %+v\n", i, h)
+		}
+		receive(i, packet, message)
+		packet.Done()
+		if i == 4 {
+			if data, err := receiver.Decode("can", late[16]); err == nil {
+				data.Done()
+			}
+		}
+	}
+}
+
+func TestEndpointConfigClone(t *testing.T) {
+	config := DefaultEndpointConfig().SetChecksum(true).SetHeaderCompression(true)
+	clone := config.Clone()
+	if !reflect.DeepEqual(clone, config) {
+		t.Fatalf("clone %+v != original %+v\n", clone, config)
+	}
+	clone.SetChecksum(false).SetEncoderCycleLength(8)
+	if !config.Checksum() || config.EncoderCycleLength() != 0 {
+		t.Fatalf("changing the clone changed the original: %+v\n", config)
+	}
+}
@@ -0,0 +1,140 @@
+package eval
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LossModel describes how packets are lost in a channel.
+type LossModel interface {
+	// NewProcess starts a loss process in the initial state of the model,
+	// drawing random numbers from rng.
+	NewProcess(rng *rand.Rand) LossProcess
+}
+
+// LossProcess decides loss of packets one after another.
+type LossProcess interface {
+	// Lost decides whether the next packet is lost.
+	Lost() bool
+}
+
+// Bernoulli loses each packet independently with probability P.
+type Bernoulli struct {
+	P float64
+}
+
+func (m Bernoulli) NewProcess(rng *rand.Rand) LossProcess {
+	return &bernoulliProcess{p: m.P, rng: rng}
+}
+
+func (m Bernoulli) String() string {
+	return fmt.Sprintf("bernoulli:%g", m.P)
+}
+
+type bernoulliProcess struct {
+	p   float64
+	rng *rand.Rand
+}
+
+func (p *bernoulliProcess) Lost() bool {
+	return p.rng.Float64() < p.p
+}
+
+// GilbertElliott is a two-state Markov loss model producing burst losses.
+// The channel moves from the good state to the bad one with probability P,
+// and back with probability R, before each packet. Packets are lost with
+// probability LossGood in the good state, and LossBad in the bad state. It
+// starts in the good state.
+type GilbertElliott struct {
+	P        float64
+	R        float64
+	LossGood float64
+	LossBad  float64
+}
+
+func (m GilbertElliott) NewProcess(rng *rand.Rand) LossProcess {
+	return &gilbertElliottProcess{model: m, rng: rng}
+}
+
+func (m GilbertElliott) String() string {
+	return fmt.Sprintf("ge:%g,%g,%g,%g", m.P, m.R, m.LossGood, m.LossBad)
+}
+
+type gilbertElliottProcess struct {
+	model GilbertElliott
+	bad   bool
+	rng   *rand.Rand
+}
+
+func (p *gilbertElliottProcess) Lost() bool {
+	if p.bad {
+		p.bad = p.rng.Float64() >= p.model.R
+	} else {
+		p.bad = p.rng.Float64() < p.model.P
+	}
+	if p.bad {
+		return p.rng.Float64() < p.model.LossBad
+	}
+	return p.rng.Float64() < p.model.LossGood
+}
+
+// ParseLossModel parses a loss model from a spec: "none",
+// "bernoulli:<p>", or "ge:<p>,<r>[,<loss good>,<loss bad>]" for
+// Gilbert-Elliott, where loss in the good and bad states default to 0 and 1.
+func ParseLossModel(spec string) (model LossModel, err error) {
+	name, args := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, args = spec[:i], spec[i+1:]
+	}
+	var values []float64
+	if args != "" {
+		for _, arg := range strings.Split(args, ",") {
+			var v float64
+			if v, err = strconv.ParseFloat(strings.TrimSpace(arg), 64); err != nil || v < 0 || v > 1 {
+				err = fmt.Errorf("invalid probability %q in loss model %q", arg, spec)
+				return
+			}
+			values = append(values, v)
+		}
+	}
+	switch {
+	case name == "none" && len(values) == 0:
+		model = nil
+	case name == "bernoulli" && len(values) == 1:
+		model = Bernoulli{P: values[0]}
+	case name == "ge" && len(values) == 2:
+		model = GilbertElliott{P: values[0], R: values[1], LossBad: 1}
+	case name == "ge" && len(values) == 4:
+		model = GilbertElliott{P: values[0], R: values[1], LossGood: values[2], LossBad: values[3]}
+	default:
+		err = fmt.Errorf("invalid loss model %q", spec)
+	}
+	return
+}
+
+// Channel describes impairments of a simulated channel.
+type Channel struct {
+	Loss LossModel // nil for no loss
+
+	// probability that a packet is delayed behind later packets, and max
+	// number of packets it's delayed behind (3 if 0)
+	Reorder      float64
+	ReorderDepth int
+
+	// probability that a packet is delivered twice
+	Duplicate float64
+
+	// probability that a bit of a packet is flipped
+	Corrupt float64
+
+	// packets are delivered Delay plus a random portion of Jitter after
+	// they're sent; jitter also reorders packets sent close together
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// seed of the random number generator, so that runs are reproducible
+	Seed int64
+}
@@ -0,0 +1,167 @@
+package eval
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/songgao/ictl"
+)
+
+// Simulation replays traces from a sender Endpoint to a receiver Endpoint,
+// both created from Config, across Channel. Each context of a trace is
+// encoded and decoded in a context of the same name.
+type Simulation struct {
+	Config  ictl.EndpointConfig
+	Channel Channel
+
+	// whether the receiver sends a feedback report back after each KF it
+	// decodes, across a channel with the same impairments
+	Feedback bool
+}
+
+// Result holds what happened in a simulation, over all contexts or a single
+// one.
+type Result struct {
+	Messages     int
+	RawBytes     uint64 // size of messages in the trace
+	EncodedBytes uint64 // size of packets sent by the sender, excluding feedback
+	Packets      int    // sent by the sender, excluding feedback
+	KFs          int
+	DFs          int
+
+	// number of packets sent with each compression algorithm, indexed by
+	// CompressionAlgorithm
+	Algorithms [ictl.CAAuto]uint64
+
+	// impairments of packets sent by the sender
+	PacketsLost       int
+	PacketsDuplicated int
+	PacketsReordered  int
+
+	Delivered         int // messages reconstructed correctly, counted once each
+	Corrupted         int // reconstructed messages differing from the original
+	DecodeErrors      int // packets the receiver failed to decode
+	MissingReferences int // DFs the receiver failed to decode due to missing KF
+
+	FeedbackBytes uint64 // size of feedback reports sent by the receiver
+
+	// time between the first and the last message
+	Duration time.Duration
+}
+
+// Saving returns the portion of bandwidth saved, i.e.,
+// 1 - EncodedBytes / RawBytes.
+func (r Result) Saving() float64 {
+	if r.RawBytes == 0 {
+		return 0
+	}
+	return 1 - float64(r.EncodedBytes)/float64(r.RawBytes)
+}
+
+// DeliveryRatio returns the portion of messages reconstructed correctly.
+func (r Result) DeliveryRatio() float64 {
+	if r.Messages == 0 {
+		return 1
+	}
+	return float64(r.Delivered) / float64(r.Messages)
+}
+
+// KFRatio returns the portion of messages sent as KFs.
+func (r Result) KFRatio() float64 {
+	if r.Messages == 0 {
+		return 0
+	}
+	return float64(r.KFs) / float64(r.Messages)
+}
+
+// AlgorithmMix formats numbers of packets sent with each compression
+// algorithm, e.g., "none:2,flate:10".
+func (r Result) AlgorithmMix() string {
+	var algorithms []string
+	for a, n := range r.Algorithms {
+		if n > 0 {
+			algorithms = append(algorithms, fmt.Sprintf("%v:%d", ictl.CompressionAlgorithm(a), n))
+		}
+	}
+	return strings.Join(algorithms, ",")
+}
+
+// String summarizes r in one line.
+func (r Result) String() string {
+	return fmt.Sprintf("messages=%d raw=%dB encoded=%dB saving=%.1f%% delivery=%.1f%% KFs=%.1f%% algorithms=%s",
+		r.Messages, r.RawBytes, r.EncodedBytes, r.Saving()*100, r.DeliveryRatio()*100, r.KFRatio()*100,
+		r.AlgorithmMix())
+}
+
+func (r *Result) add(o Result) {
+	r.Messages += o.Messages
+	r.RawBytes += o.RawBytes
+	r.EncodedBytes += o.EncodedBytes
+	r.Packets += o.Packets
+	r.KFs += o.KFs
+	r.DFs += o.DFs
+	for i := range r.Algorithms {
+		r.Algorithms[i] += o.Algorithms[i]
+	}
+	r.PacketsLost += o.PacketsLost
+	r.PacketsDuplicated += o.PacketsDuplicated
+	r.PacketsReordered += o.PacketsReordered
+	r.Delivered += o.Delivered
+	r.Corrupted += o.Corrupted
+	r.DecodeErrors += o.DecodeErrors
+	r.MissingReferences += o.MissingReferences
+	r.FeedbackBytes += o.FeedbackBytes
+}
+
+// Run replays trace, returning results over all contexts, and for each
+// context. Endpoints run on a virtual clock following times of records.
+func (s Simulation) Run(trace []Record) (total Result, contexts map[string]*Result, err error) {
+	var now time.Time
+	config := s.Config
+	if config == nil {
+		config = ictl.DefaultEndpointConfig()
+	}
+	config = config.Clone().SetClock(func() time.Time { return now })
+	sender := ictl.NewEndpoint(config)
+	defer sender.Close()
+	receiver := ictl.NewEndpoint(config)
+	defer receiver.Close()
+	backward := s.Channel
+	backward.Seed++
+	session := NewSession(sender, receiver, NewLink(s.Channel), NewLink(backward))
+	session.Feedback = s.Feedback
+
+	for index, record := range trace {
+		now = record.Time
+		if err = session.Send(record.Context, record.Message, now); err != nil {
+			err = fmt.Errorf("encoding record #%d: %v", index, err)
+			return
+		}
+		if err = session.Deliver(now); err != nil {
+			return
+		}
+	}
+	if err = session.Flush(now); err != nil {
+		return
+	}
+
+	total, contexts = session.Results()
+	if len(trace) > 0 {
+		total.Duration = trace[len(trace)-1].Time.Sub(trace[0].Time)
+	}
+	return
+}
+
+// ParseCompressionAlgorithm returns the algorithm named name, as printed by
+// CompressionAlgorithm.String, e.g., "flate" or "auto".
+func ParseCompressionAlgorithm(name string) (algorithm ictl.CompressionAlgorithm, err error) {
+	for a := ictl.CompressionAlgorithm(0); a <= ictl.CAAuto; a++ {
+		if a.String() == name {
+			algorithm = a
+			return
+		}
+	}
+	err = fmt.Errorf("unknown compression algorithm %q", name)
+	return
+}
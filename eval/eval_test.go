@@ -0,0 +1,107 @@
+package eval
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/songgao/ictl"
+)
+
+// vehicleTrace generates a trace of periodic messages of two contexts, where
+// consecutive messages differ in a few bytes
+func vehicleTrace(n int) (trace []Record) {
+	rng := rand.New(rand.NewSource(42))
+	start := time.Unix(1500000000, 0)
+	state := map[string][]byte{"can": make([]byte, 64), "status": make([]byte, 200)}
+	for _, s := range state {
+		rng.Read(s)
+	}
+	for i := 0; i < n; i++ {
+		context := "can"
+		if i%4 == 3 {
+			context = "status"
+		}
+		s := state[context]
+		binary.BigEndian.PutUint32(s[0:4], uint32(i))
+		s[4+rng.Intn(len(s)-4)] = byte(rng.Intn(256))
+		trace = append(trace, Record{
+			Time:    start.Add(time.Duration(i) * 10 * time.Millisecond),
+			Context: context,
+			Message: append([]byte(nil), s...),
+		})
+	}
+	return
+}
+
+func TestSimulationPerfectChannel(t *testing.T) {
+	trace := vehicleTrace(400)
+	sim := Simulation{Config: ictl.DefaultEndpointConfig()}
+	total, contexts, err := sim.Run(trace)
+	if err != nil {
+		t.Fatalf("calling Run() error: %v\n", err)
+	}
+	if total.Messages != 400 || total.Delivered != 400 || total.Corrupted != 0 || total.DecodeErrors != 0 {
+		t.Fatalf("unexpected result: %+v\n", total)
+	}
+	if total.Saving() < 0.5 {
+		t.Fatalf("saving %.2f is lower than expected\n", total.Saving())
+	}
+	if len(contexts) != 2 || contexts["status"].Messages != 100 {
+		t.Fatalf("unexpected per-context results: %v\n", contexts)
+	}
+	if total.Duration != 3990*time.Millisecond {
+		t.Fatalf("unexpected duration %v\n", total.Duration)
+	}
+}
+
+func TestSimulationImpairments(t *testing.T) {
+	trace := vehicleTrace(1000)
+	for _, channel := range []Channel{
+		{Loss: Bernoulli{P: 0.1}, Seed: 1},
+		{Loss: GilbertElliott{P: 0.02, R: 0.3, LossBad: 1}, Seed: 2},
+		{Reorder: 0.1, Duplicate: 0.1, Seed: 3},
+	} {
+		config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(8).SetCompressionAlgorithm(ictl.CAFlate)
+		sim := Simulation{Config: config, Channel: channel}
+		total, _, err := sim.Run(trace)
+		if err != nil {
+			t.Fatalf("calling Run() error: %v\n", err)
+		}
+		if total.Corrupted != 0 {
+			t.Fatalf("%+v: %d messages corrupted\n", channel, total.Corrupted)
+		}
+		if channel.Loss != nil {
+			if total.PacketsLost == 0 || total.DeliveryRatio() > 0.95 || total.MissingReferences == 0 {
+				t.Fatalf("%+v: unexpected result %v\n", channel, total)
+			}
+		} else if total.PacketsReordered == 0 || total.PacketsDuplicated == 0 || total.DeliveryRatio() < 0.9 {
+			t.Fatalf("%+v: unexpected result %+v\n", channel, total)
+		}
+
+		again, _, _ := sim.Run(trace)
+		if again != total {
+			t.Fatalf("%+v: same seed gave different results\n%+v\n%+v\n", channel, total, again)
+		}
+	}
+}
+
+func TestParseLossModel(t *testing.T) {
+	for spec, expected := range map[string]LossModel{
+		"none":              nil,
+		"bernoulli:0.1":     Bernoulli{P: 0.1},
+		"ge:0.01,0.5":       GilbertElliott{P: 0.01, R: 0.5, LossBad: 1},
+		"ge:0.01,0.5,0,0.8": GilbertElliott{P: 0.01, R: 0.5, LossBad: 0.8},
+	} {
+		model, err := ParseLossModel(spec)
+		if err != nil || model != expected {
+			t.Fatalf("%q: got %v, %v; expected %v\n", spec, model, err, expected)
+		}
+	}
+	for _, spec := range []string{"bernoulli", "bernoulli:2", "ge:0.1", "fancy:0.1"} {
+		if _, err := ParseLossModel(spec); err == nil {
+			t.Fatalf("%q should be rejected\n", spec)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package eval
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Packet is a packet carried by a Link. Context and Index are not touched by
+// the link; they're for the caller to tell packets apart.
+type Packet struct {
+	Data    []byte
+	Context string
+	Index   int
+}
+
+// LinkStats holds counters of a Link.
+type LinkStats struct {
+	Sent       int
+	Lost       int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+	Delivered  int
+}
+
+type inFlight struct {
+	Packet
+	due  time.Time
+	held int // number of packets to be sent before this one is delivered
+}
+
+// Link is a one-way in-memory link with impairments described by a Channel.
+// It runs on a virtual clock passed in by the caller, so that delays don't
+// slow simulations down, and draws all randomness from a seeded source, so
+// that runs are reproducible. It's not safe for concurrent use.
+type Link struct {
+	channel  Channel
+	rng      *rand.Rand
+	loss     LossProcess
+	inFlight []inFlight
+	stats    LinkStats
+}
+
+// NewLink returns a Link with impairments described by channel.
+func NewLink(channel Channel) *Link {
+	l := &Link{channel: channel, rng: rand.New(rand.NewSource(channel.Seed))}
+	if channel.Loss != nil {
+		l.loss = channel.Loss.NewProcess(l.rng)
+	}
+	return l
+}
+
+// Send sends a copy of p into the link at time now.
+func (l *Link) Send(p Packet, now time.Time) {
+	l.stats.Sent++
+	for i := range l.inFlight {
+		l.inFlight[i].held--
+	}
+	if l.loss != nil && l.loss.Lost() {
+		l.stats.Lost++
+		return
+	}
+	copies := 1
+	if l.channel.Duplicate > 0 && l.rng.Float64() < l.channel.Duplicate {
+		l.stats.Duplicated++
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		f := inFlight{Packet: p, due: now.Add(l.channel.Delay)}
+		f.Data = append([]byte(nil), p.Data...)
+		if l.channel.Jitter > 0 {
+			f.due = f.due.Add(time.Duration(l.rng.Int63n(int64(l.channel.Jitter))))
+		}
+		if l.channel.Reorder > 0 && l.rng.Float64() < l.channel.Reorder {
+			depth := l.channel.ReorderDepth
+			if depth <= 0 {
+				depth = 3
+			}
+			l.stats.Reordered++
+			f.held = 1 + l.rng.Intn(depth)
+		}
+		if len(f.Data) > 0 && l.channel.Corrupt > 0 && l.rng.Float64() < l.channel.Corrupt {
+			l.stats.Corrupted++
+			bit := l.rng.Intn(len(f.Data) * 8)
+			f.Data[bit/8] ^= 1 << uint(bit%8)
+		}
+		l.inFlight = append(l.inFlight, f)
+	}
+}
+
+// Receive returns packets that come out of the link by time now, in the
+// order they arrive.
+func (l *Link) Receive(now time.Time) (packets []Packet) {
+	return l.release(func(f inFlight) bool {
+		return f.held <= 0 && !f.due.After(now)
+	})
+}
+
+// Flush returns all packets still in the link, in the order they'd arrive.
+func (l *Link) Flush() (packets []Packet) {
+	return l.release(func(inFlight) bool { return true })
+}
+
+// Stats returns counters of the link.
+func (l *Link) Stats() LinkStats {
+	return l.stats
+}
+
+func (l *Link) release(ready func(inFlight) bool) (packets []Packet) {
+	var out, still []inFlight
+	for _, f := range l.inFlight {
+		if ready(f) {
+			out = append(out, f)
+		} else {
+			still = append(still, f)
+		}
+	}
+	l.inFlight = still
+	sort.SliceStable(out, func(i, j int) bool { return out[i].due.Before(out[j].due) })
+	for _, f := range out {
+		packets = append(packets, f.Packet)
+	}
+	l.stats.Delivered += len(packets)
+	return
+}
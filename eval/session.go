@@ -0,0 +1,278 @@
+package eval
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/songgao/ictl"
+)
+
+// Session sends messages from a sender Endpoint to a receiver Endpoint across
+// a forward Link, and carries feedback reports and requests back across a
+// backward Link. Decoded messages that aren't the one sent in the packet
+// they're decoded from, e.g., released by the jitter buffer or rebuilt from a
+// parity frame, are matched with sent ones by content. It's shared by
+// Simulation and package ictltest. It's not safe for concurrent use.
+type Session struct {
+	Sender, Receiver ictl.Endpoint
+	Forward          *Link
+	Backward         *Link
+
+	// if set, the receiver sends a feedback report back after each KF it
+	// decodes
+	Feedback bool
+
+	// if set, the receiver sends a resync request or a NACK back when it
+	// fails to decode a DF due to missing reference; the sender answers NACKs
+	// by retransmitting KFs
+	Resync bool
+	NACK   bool
+
+	// if set, the receiver decodes with DecodeMessages, so that its jitter
+	// buffer is used if enabled
+	DecodeMessages bool
+
+	messages  [][]byte
+	contexts  []string      // of messages
+	kfs       map[kfKey]int // index of messages sent as KFs, for retransmissions
+	delivered []bool
+	results   map[string]*Result
+	errs      []error
+}
+
+type kfKey struct {
+	context string
+	id      uint32
+}
+
+// NewSession returns a Session from sender to receiver across forward and
+// backward.
+func NewSession(sender, receiver ictl.Endpoint, forward, backward *Link) *Session {
+	return &Session{
+		Sender:   sender,
+		Receiver: receiver,
+		Forward:  forward,
+		Backward: backward,
+		kfs:      make(map[kfKey]int),
+		results:  make(map[string]*Result),
+	}
+}
+
+// Send encodes message in context at the sender, and sends packets into the
+// forward link at time now. Packets are delivered by Deliver or Flush.
+func (s *Session) Send(context string, message []byte, now time.Time) (err error) {
+	var packets []*ictl.ReusableSlice
+	if packets, err = s.Sender.EncodeFragments(context, message, 0); err != nil {
+		return
+	}
+	index := len(s.messages)
+	s.messages = append(s.messages, append([]byte(nil), message...))
+	s.contexts = append(s.contexts, context)
+	s.delivered = append(s.delivered, false)
+
+	r := s.result(context)
+	r.Messages++
+	r.RawBytes += uint64(len(message))
+	for i, packet := range packets {
+		info, _ := ictl.ParsePacket(packet.Slice())
+		if i == 0 {
+			if info.FrameType == ictl.FrameKF {
+				r.KFs++
+				s.kfs[kfKey{context, info.FrameID}] = index
+			} else {
+				r.DFs++
+			}
+		}
+		r.Packets++
+		r.EncodedBytes += uint64(len(packet.Slice()))
+		r.Algorithms[info.CompressionAlgorithm]++
+
+		before := s.Forward.Stats()
+		s.Forward.Send(Packet{Data: packet.Slice(), Context: context, Index: index}, now)
+		after := s.Forward.Stats()
+		r.PacketsLost += after.Lost - before.Lost
+		r.PacketsDuplicated += after.Duplicated - before.Duplicated
+		r.PacketsReordered += after.Reordered - before.Reordered
+		packet.Done()
+	}
+	return
+}
+
+// Deliver delivers packets that come out of the links by time now, including
+// feedback reports, requests and retransmissions they cause. Errors of decoding are
+// counted in results and kept in Errors, rather than returned, since a lossy
+// link is expected to cause them.
+func (s *Session) Deliver(now time.Time) (err error) {
+	for {
+		forward, backward := s.Forward.Receive(now), s.Backward.Receive(now)
+		if len(forward) == 0 && len(backward) == 0 {
+			return
+		}
+		if err = s.deliver(forward, backward, now); err != nil {
+			return
+		}
+	}
+}
+
+// Flush delivers all packets still in the links at time now, including
+// feedback reports, requests and retransmissions they cause.
+func (s *Session) Flush(now time.Time) (err error) {
+	for {
+		forward, backward := s.Forward.Flush(), s.Backward.Flush()
+		if len(forward) == 0 && len(backward) == 0 {
+			return
+		}
+		if err = s.deliver(forward, backward, now); err != nil {
+			return
+		}
+	}
+}
+
+// Results returns what happened to messages sent so far, over all contexts
+// and for each context.
+func (s *Session) Results() (total Result, contexts map[string]*Result) {
+	contexts = make(map[string]*Result)
+	for context, r := range s.results {
+		c := *r
+		if stats, ok := s.Receiver.ContextStats(context); ok {
+			c.MissingReferences = int(stats.MissingReferences)
+		}
+		contexts[context] = &c
+		total.add(c)
+	}
+	return
+}
+
+// Errors returns errors the receiver returned in decoding.
+func (s *Session) Errors() []error {
+	return s.errs
+}
+
+func (s *Session) result(context string) (r *Result) {
+	if r = s.results[context]; r == nil {
+		r = new(Result)
+		s.results[context] = r
+	}
+	return
+}
+
+func (s *Session) deliver(forward, backward []Packet, now time.Time) (err error) {
+	for _, packet := range forward {
+		if s.DecodeMessages {
+			if err = s.decodeMessages(packet, now); err != nil {
+				return
+			}
+			continue
+		}
+		var data *ictl.ReusableSlice
+		if data, err = s.Receiver.Decode(packet.Context, packet.Data); err != nil {
+			if err = s.decodeError(packet.Context, err, now); err != nil {
+				return
+			}
+			continue
+		}
+		if data == nil { // fragment of an incomplete message
+			continue
+		}
+		s.count(packet, data)
+
+		info, _ := ictl.ParsePacket(packet.Data)
+		if s.Feedback && (info.FrameType == ictl.FrameKF || info.FrameType == ictl.FrameParity) {
+			var report *ictl.ReusableSlice
+			if report, err = s.Receiver.Feedback(packet.Context); err != nil {
+				return
+			}
+			s.result(packet.Context).FeedbackBytes += uint64(len(report.Slice()))
+			s.Backward.Send(Packet{Data: report.Slice(), Context: packet.Context, Index: -1}, now)
+			report.Done()
+		}
+	}
+	for _, packet := range backward {
+		// reports and requests may be corrupted by the link, so errors are
+		// ignored
+		if info, _ := ictl.ParsePacket(packet.Data); info.FrameType == ictl.FrameRequest {
+			if retransmitted, err := s.Sender.Retransmit(packet.Context, packet.Data); err == nil {
+				for _, kf := range retransmitted {
+					info, _ := ictl.ParsePacket(kf.Slice())
+					index, ok := s.kfs[kfKey{packet.Context, info.FrameID}]
+					if !ok {
+						index = -1
+					}
+					s.Forward.Send(Packet{Data: kf.Slice(), Context: packet.Context, Index: index}, now)
+					kf.Done()
+				}
+				continue
+			}
+		}
+		s.Sender.HandleFeedback(packet.Context, packet.Data)
+	}
+	return
+}
+
+// decodeMessages decodes packet with DecodeMessages, matching messages it
+// returns with sent ones
+func (s *Session) decodeMessages(packet Packet, now time.Time) (err error) {
+	messages, decodeErr := s.Receiver.DecodeMessages(packet.Context, packet.Data)
+	for _, data := range messages {
+		s.count(packet, data)
+	}
+	if decodeErr != nil {
+		err = s.decodeError(packet.Context, decodeErr, now)
+	}
+	return
+}
+
+// decodeError records decodeErr of decoding a packet in context, and sends
+// a NACK or a resync request back if enabled
+func (s *Session) decodeError(context string, decodeErr error, now time.Time) (err error) {
+	s.result(context).DecodeErrors++
+	s.errs = append(s.errs, decodeErr)
+	if s.NACK {
+		if err = s.sendBack(context, s.Receiver.NACK, now); err != nil {
+			return
+		}
+	}
+	if s.Resync {
+		err = s.sendBack(context, s.Receiver.ResyncRequest, now)
+	}
+	return
+}
+
+// count counts data decoded from packet, and releases it
+func (s *Session) count(packet Packet, data *ictl.ReusableSlice) {
+	r := s.result(packet.Context)
+	index := packet.Index
+	if index < 0 || !bytes.Equal(data.Slice(), s.messages[index]) {
+		index = s.find(packet.Context, data.Slice())
+	}
+	if index < 0 {
+		r.Corrupted++
+	} else if !s.delivered[index] {
+		s.delivered[index] = true
+		r.Delivered++
+	}
+	data.Done()
+}
+
+// find returns index of the latest undelivered message sent in context equal
+// to message, or -1 if there's none
+func (s *Session) find(context string, message []byte) int {
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if !s.delivered[i] && s.contexts[i] == context && bytes.Equal(s.messages[i], message) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sendBack sends a request built by build, if any, from the receiver to the
+// sender
+func (s *Session) sendBack(context string, build func(string) (*ictl.ReusableSlice, error), now time.Time) (err error) {
+	var request *ictl.ReusableSlice
+	if request, err = build(context); err != nil || request == nil {
+		return
+	}
+	s.Backward.Send(Packet{Data: request.Slice(), Context: context, Index: -1}, now)
+	request.Done()
+	return
+}
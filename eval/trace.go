@@ -0,0 +1,96 @@
+// Package eval replays recorded message traces through an ICTL encoder and
+// decoder pair across a simulated lossy channel, to measure bandwidth saving
+// and delivery under a given EndpointConfig.
+package eval
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Record is a message in a trace.
+type Record struct {
+	Time    time.Time
+	Context string
+	Message []byte
+}
+
+// Trace files are sequences of records, each prefixed by its length (not
+// including the prefix itself) as a big-endian uint32. A record consists of:
+//
+//	timestamp     int64, big-endian, nanoseconds since Unix epoch
+//	context       uint8 length, followed by the name
+//	message       the rest of the record
+
+// max size of a record, to reject garbage before allocating for it
+const maxRecordSize = 1 << 24
+
+// WriteRecord appends record to a trace being written to w.
+func WriteRecord(w io.Writer, record Record) (err error) {
+	if len(record.Context) > 255 {
+		err = fmt.Errorf("context name %q too long", record.Context)
+		return
+	}
+	length := 8 + 1 + len(record.Context) + len(record.Message)
+	if length > maxRecordSize {
+		err = errors.New("message too large")
+		return
+	}
+	buf := make([]byte, 4+length)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(length))
+	binary.BigEndian.PutUint64(buf[4:12], uint64(record.Time.UnixNano()))
+	buf[12] = uint8(len(record.Context))
+	copy(buf[13:], record.Context)
+	copy(buf[13+len(record.Context):], record.Message)
+	_, err = w.Write(buf)
+	return
+}
+
+// ReadRecord reads the next record of a trace from r. It returns io.EOF at
+// the end of the trace.
+func ReadRecord(r io.Reader) (record Record, err error) {
+	var prefix [4]byte
+	if _, err = io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated trace record")
+		}
+		return
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length < 9 || length > maxRecordSize {
+		err = fmt.Errorf("invalid trace record length %d", length)
+		return
+	}
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		err = errors.New("truncated trace record")
+		return
+	}
+	nameLength := int(buf[8])
+	if 9+nameLength > len(buf) {
+		err = errors.New("malformed trace record")
+		return
+	}
+	record.Time = time.Unix(0, int64(binary.BigEndian.Uint64(buf[0:8])))
+	record.Context = string(buf[9 : 9+nameLength])
+	record.Message = buf[9+nameLength:]
+	return
+}
+
+// ReadTrace reads all records of a trace from r.
+func ReadTrace(r io.Reader) (trace []Record, err error) {
+	for {
+		var record Record
+		if record, err = ReadRecord(r); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			err = fmt.Errorf("record #%d: %v", len(trace), err)
+			return
+		}
+		trace = append(trace, record)
+	}
+}
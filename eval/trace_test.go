@@ -0,0 +1,36 @@
+package eval
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	records := []Record{
+		{Time: time.Unix(1500000000, 1), Context: "can", Message: []byte{1, 2, 3}},
+		{Time: time.Unix(1500000000, 2), Context: "gps", Message: []byte{}},
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		if err := WriteRecord(&buf, r); err != nil {
+			t.Fatalf("calling WriteRecord() error: %v\n", err)
+		}
+	}
+	trace, err := ReadTrace(&buf)
+	if err != nil {
+		t.Fatalf("calling ReadTrace() error: %v\n", err)
+	}
+	if len(trace) != len(records) {
+		t.Fatalf("read %d records; expected %d\n", len(trace), len(records))
+	}
+	for i := range records {
+		if !trace[i].Time.Equal(records[i].Time) || trace[i].Context != records[i].Context || !bytes.Equal(trace[i].Message, records[i].Message) {
+			t.Fatalf("record #%d: read %+v; expected %+v\n", i, trace[i], records[i])
+		}
+	}
+
+	if _, err = ReadTrace(bytes.NewReader([]byte{0, 0, 0, 20, 1})); err == nil {
+		t.Fatalf("truncated trace should fail\n")
+	}
+}
@@ -0,0 +1,113 @@
+package eval
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/songgao/ictl"
+)
+
+// Tuner sweeps encoder parameters over a trace, to find the configuration
+// that saves the most bandwidth while keeping delivery ratio at least
+// MinDeliveryRatio.
+type Tuner struct {
+	// base config and channel; parameters being swept are overridden
+	Simulation Simulation
+
+	CycleLengths        []uint16 // 0 for adaptive
+	ConfidenceLookbacks []int
+	Algorithms          []ictl.CompressionAlgorithm
+
+	MinDeliveryRatio float64
+
+	// number of runs for each candidate, with consecutive channel seeds;
+	// results of all runs are added up. 1 if 0.
+	Runs int
+}
+
+// NewTuner returns a Tuner sweeping common values of each parameter.
+func NewTuner(sim Simulation, minDeliveryRatio float64) *Tuner {
+	return &Tuner{
+		Simulation:          sim,
+		CycleLengths:        []uint16{0, 4, 8, 16, 32, 64},
+		ConfidenceLookbacks: []int{1, 2, 4},
+		Algorithms:          []ictl.CompressionAlgorithm{ictl.CAAuto, ictl.CAFlate, ictl.CAZlib, ictl.CALzw, ictl.CANone},
+		MinDeliveryRatio:    minDeliveryRatio,
+	}
+}
+
+// Candidate is a combination of parameters evaluated by a Tuner.
+type Candidate struct {
+	CycleLength        uint16
+	ConfidenceLookback int
+	Algorithm          ictl.CompressionAlgorithm
+
+	Result   Result
+	Feasible bool // delivery ratio is at least MinDeliveryRatio
+}
+
+// Apply sets parameters of c in config.
+func (c Candidate) Apply(config ictl.EndpointConfig) ictl.EndpointConfig {
+	return config.
+		SetEncoderCycleLength(c.CycleLength).
+		SetConfidenceLookback(c.ConfidenceLookback).
+		SetCompressionAlgorithm(c.Algorithm)
+}
+
+// Flags formats parameters of c as flags of ictl-eval.
+func (c Candidate) Flags() string {
+	return fmt.Sprintf("-cycle-length %d -lookback %d -algorithm %v", c.CycleLength, c.ConfidenceLookback, c.Algorithm)
+}
+
+// Tune evaluates all combinations of parameters over trace. Candidates are
+// returned best first: feasible ones by saving, then the rest by delivery
+// ratio. So the recommended configuration is the first candidate, if it's
+// feasible; if it's not, no combination meets MinDeliveryRatio.
+func (t *Tuner) Tune(trace []Record) (candidates []Candidate, err error) {
+	runs := t.Runs
+	if runs <= 0 {
+		runs = 1
+	}
+	for _, cycleLength := range t.CycleLengths {
+		for _, lookback := range t.ConfidenceLookbacks {
+			for _, algorithm := range t.Algorithms {
+				c := Candidate{CycleLength: cycleLength, ConfidenceLookback: lookback, Algorithm: algorithm}
+				for run := 0; run < runs; run++ {
+					sim := t.Simulation
+					sim.Config = c.Apply(copyConfig(t.Simulation.Config))
+					sim.Channel.Seed += int64(run)
+					var r Result
+					if r, _, err = sim.Run(trace); err != nil {
+						err = fmt.Errorf("%s: %v", c.Flags(), err)
+						return
+					}
+					c.Result.add(r)
+					c.Result.Duration = r.Duration
+				}
+				c.Feasible = c.Result.DeliveryRatio() >= t.MinDeliveryRatio
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Feasible != b.Feasible {
+			return a.Feasible
+		}
+		if a.Feasible {
+			return a.Result.Saving() > b.Result.Saving()
+		}
+		return a.Result.DeliveryRatio() > b.Result.DeliveryRatio()
+	})
+	return
+}
+
+// copyConfig returns a copy of config, or the default config if it's nil, so
+// that candidates don't modify the base config.
+func copyConfig(config ictl.EndpointConfig) ictl.EndpointConfig {
+	if config == nil {
+		return ictl.DefaultEndpointConfig()
+	}
+	return config.Clone()
+}
@@ -0,0 +1,54 @@
+package eval
+
+import (
+	"testing"
+
+	"github.com/songgao/ictl"
+)
+
+func TestTune(t *testing.T) {
+	trace := vehicleTrace(300)
+	config := ictl.DefaultEndpointConfig().SetChecksum(true)
+	tuner := &Tuner{
+		Simulation:          Simulation{Config: config, Channel: Channel{Loss: Bernoulli{P: 0.05}, Seed: 3}},
+		CycleLengths:        []uint16{0, 4, 32},
+		ConfidenceLookbacks: []int{1, 2},
+		Algorithms:          []ictl.CompressionAlgorithm{ictl.CANone, ictl.CAFlate},
+		MinDeliveryRatio:    0.9,
+	}
+	candidates, err := tuner.Tune(trace)
+	if err != nil {
+		t.Fatalf("calling Tune() error: %v\n", err)
+	}
+	if len(candidates) != 12 {
+		t.Fatalf("expected 12 candidates; got %d\n", len(candidates))
+	}
+	if !candidates[0].Feasible {
+		t.Fatalf("expected a feasible candidate; best is %+v\n", candidates[0])
+	}
+	for i, c := range candidates {
+		if c.Result.Messages != len(trace) {
+			t.Fatalf("candidate #%d replayed %d messages\n", i, c.Result.Messages)
+		}
+		if c.Feasible != (c.Result.DeliveryRatio() >= 0.9) {
+			t.Fatalf("candidate #%d has wrong Feasible\n", i)
+		}
+		if i > 0 && c.Feasible && c.Result.Saving() > candidates[i-1].Result.Saving() {
+			t.Fatalf("candidates are not ordered by saving\n")
+		}
+		if i > 0 && c.Feasible && !candidates[i-1].Feasible {
+			t.Fatalf("feasible candidate after infeasible one\n")
+		}
+	}
+	if !config.Checksum() || config.EncoderCycleLength() != 0 || config.CompressionAlgorithm() != ictl.CAAuto {
+		t.Fatalf("base config is modified\n")
+	}
+
+	tuner.MinDeliveryRatio = 1.01
+	if candidates, err = tuner.Tune(trace); err != nil {
+		t.Fatalf("calling Tune() error: %v\n", err)
+	}
+	if candidates[0].Feasible {
+		t.Fatalf("expected no feasible candidate\n")
+	}
+}
@@ -0,0 +1,84 @@
+package ictl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// confidence assigned to KFs acknowledged by the receiver
+const maxConfidence uint8 = 255
+
+// Feedback reports are carried in frames of type frameFeedback. The frameID
+// field of the header holds the number of KF IDs in the report. The
+// (uncompressed) payload starts with one byte of DF delivery ratio observed by
+// the receiver, scaled to [0, 255], followed by the list of KF IDs the
+// receiver holds, each as a big-endian uint16, most recently received first.
+// If any of the IDs doesn't fit in 16 bits, the report uses a header with
+// extended IDs, and each ID is a big-endian uint32 instead.
+
+func encodeFeedback(pool *slicePool, ids []uint32, ratio float64) (packet *ReusableSlice, err error) {
+	var h header
+	h.setFrameType(frameFeedback)
+	h.setFrameID(uint32(len(ids)))
+	for _, id := range ids {
+		if id > 0xFFFF {
+			h.setExtendedIDs()
+		}
+	}
+	size := feedbackIDSize(h)
+
+	payload := pool.get()
+	defer payload.Done()
+	if 1+len(ids)*size > payload.Cap() {
+		err = errors.New("feedback report does not fit in a packet")
+		return
+	}
+	payload.Resize(1 + len(ids)*size)
+	payload.Slice()[0] = uint8(ratio*255 + 0.5)
+	for i, id := range ids {
+		if size == 4 {
+			binary.BigEndian.PutUint32(payload.Slice()[1+i*size:], id)
+		} else {
+			binary.BigEndian.PutUint16(payload.Slice()[1+i*size:], uint16(id))
+		}
+	}
+	packet, err = encodeWithHeader(pool, payload.Slice(), h, CANone)
+	return
+}
+
+// feedbackIDSize returns size of each ID in a report with header h
+func feedbackIDSize(h header) int {
+	if h.extendedIDs {
+		return 4
+	}
+	return 2
+}
+
+func decodeFeedback(pool *slicePool, report []byte) (ids []uint32, ratio float64, err error) {
+	var header header
+	var payload *ReusableSlice
+	if header, payload, err = decode(pool, report); err != nil {
+		return
+	}
+	defer payload.Done()
+	if header.getFrameType() != frameFeedback {
+		err = fmt.Errorf("not a feedback report (frame type %d)", header.getFrameType())
+		return
+	}
+	size := feedbackIDSize(header)
+	if uint64(1)+uint64(header.getFrameID())*uint64(size) != uint64(len(payload.Slice())) {
+		err = errors.New("malformed feedback report")
+		return
+	}
+	ratio = float64(payload.Slice()[0]) / 255
+	ids = make([]uint32, header.getFrameID())
+	for i := range ids {
+		if size == 4 {
+			ids[i] = binary.BigEndian.Uint32(payload.Slice()[1+i*size:])
+		} else {
+			ids[i] = uint32(binary.BigEndian.Uint16(payload.Slice()[1+i*size:]))
+		}
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package ictl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFeedbackReport(t *testing.T) {
+	pool := newSlicePool(1379)
+	for _, ids := range [][]uint32{
+		{42, 7, 65535, 0},
+		{70000, 42, 0xFFFFFFFF}, // extended IDs
+	} {
+		report, err := encodeFeedback(pool, ids, 0.8)
+		if err != nil {
+			t.Fatalf("error encoding feedback: %v\n", err)
+		}
+
+		got, ratio, err := decodeFeedback(pool, report.Slice())
+		report.Done()
+		if err != nil {
+			t.Fatalf("error decoding feedback: %v\n", err)
+		}
+		if ratio < 0.79 || ratio > 0.81 {
+			t.Fatalf("decoded ratio %f; expected 0.8\n", ratio)
+		}
+		if len(got) != len(ids) {
+			t.Fatalf("decoded %d IDs; expected %d\n", len(got), len(ids))
+		}
+		for i := range ids {
+			if got[i] != ids[i] {
+				t.Fatalf("decoded IDs %v != %v\n", got, ids)
+			}
+		}
+	}
+}
+
+func TestFeedbackAvoidsLostKF(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(2).SetConfidenceLookback(4)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	msgs := [][]byte{
+		[]byte("message #0, a key frame"),
+		[]byte("message #1, a differential frame"),
+		[]byte("message #2, a key frame that gets lost"),
+		[]byte("message #3, a differential frame"),
+	}
+
+	for i, msg := range msgs {
+		packet, err := sender.Encode("test", msg, 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		if i == 2 { // drop KF, and let the sender know what has been received
+			packet.Done()
+			var report *ReusableSlice
+			if report, err = receiver.Feedback("test"); err != nil {
+				t.Fatalf("calling receiver.Feedback() error: %v\n", err)
+			}
+			if err = sender.HandleFeedback("test", report.Slice()); err != nil {
+				t.Fatalf("calling sender.HandleFeedback() error: %v\n", err)
+			}
+			if _, err = receiver.Decode("test", report.Slice()); err == nil {
+				t.Fatalf("decoding a feedback report as data should fail\n")
+			}
+			report.Done()
+			continue
+		}
+		rcvd, err := receiver.Decode("test", packet.Slice())
+		packet.Done()
+		if err != nil {
+			t.Fatalf("calling receiver.Decode() error for message #%d: %v\n", i, err)
+		}
+		if !bytes.Equal(msg, rcvd.Slice()) {
+			t.Fatalf("decoded data is not equal to sent data: %q != %q\n", msg, rcvd.Slice())
+		}
+		rcvd.Done()
+	}
+
+	if err := sender.HandleFeedback("unknown", nil); err == nil {
+		t.Fatalf("feedback for unknown context should fail\n")
+	}
+}
@@ -0,0 +1,90 @@
+package ictl
+
+import "time"
+
+// max number of frames a decoder reassembles at the same time
+const maxFragmentedFrames = 8
+
+type fragmentedFrameKey struct {
+	frameType uint8
+	frameID   uint32
+}
+
+type fragmentedFrame struct {
+	count     uint8
+	fragments [][]byte // nil until received
+	received  int
+	size      int
+	started   time.Time
+}
+
+// reassembler collects fragments of frames until they are complete
+type reassembler struct {
+	frames  map[fragmentedFrameKey]*fragmentedFrame
+	timeout time.Duration
+}
+
+func newReassembler(timeout time.Duration) *reassembler {
+	return &reassembler{
+		frames:  make(map[fragmentedFrameKey]*fragmentedFrame),
+		timeout: timeout,
+	}
+}
+
+// add adds a fragment carried in a packet with header h. When this completes
+// the frame, ok is true and compressed is the whole compressed payload of the
+// frame. Frames that are not completed within timeout are dropped.
+func (r *reassembler) add(h header, fragment []byte, now time.Time) (compressed []byte, ok bool) {
+	r.expire(now)
+
+	index, count, _ := h.getFragment()
+	key := fragmentedFrameKey{frameType: h.getFrameType(), frameID: h.getFrameID()}
+	f := r.frames[key]
+	if f == nil || f.count != count { // new frame, or a frame reusing the ID
+		if f == nil && len(r.frames) >= maxFragmentedFrames {
+			r.dropOldest()
+		}
+		f = &fragmentedFrame{
+			count:     count,
+			fragments: make([][]byte, count),
+			started:   now,
+		}
+		r.frames[key] = f
+	}
+	if f.fragments[index] != nil { // duplicate
+		return
+	}
+	f.fragments[index] = append([]byte(nil), fragment...)
+	f.received++
+	f.size += len(fragment)
+	if f.received < int(f.count) {
+		return
+	}
+
+	delete(r.frames, key)
+	compressed = make([]byte, 0, f.size)
+	for _, fragment := range f.fragments {
+		compressed = append(compressed, fragment...)
+	}
+	ok = true
+	return
+}
+
+func (r *reassembler) expire(now time.Time) {
+	for key, f := range r.frames {
+		if now.Sub(f.started) > r.timeout {
+			delete(r.frames, key)
+		}
+	}
+}
+
+func (r *reassembler) dropOldest() {
+	var oldestKey fragmentedFrameKey
+	var oldest *fragmentedFrame
+	for key, f := range r.frames {
+		if oldest == nil || f.started.Before(oldest.started) {
+			oldestKey, oldest = key, f
+		}
+	}
+	delete(r.frames, oldestKey)
+}
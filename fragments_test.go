@@ -0,0 +1,94 @@
+package ictl
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFragments(t *testing.T) {
+	config := DefaultEndpointConfig().SetMaxMessageSize(16384).SetEncoderCycleLength(4)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	msg := make([]byte, 10000)
+	rand.New(rand.NewSource(42)).Read(msg)
+
+	if _, err := sender.Encode("test", msg, 0); err != ErrPacketTooLarge {
+		t.Fatalf("Encode() of a large KF returned %v; expected ErrPacketTooLarge\n", err)
+	}
+	if _, err := sender.EncodeFragments("test", make([]byte, 20000), 0); err != ErrMessageTooLarge {
+		t.Fatalf("EncodeFragments() of a message over max size returned %v; expected ErrMessageTooLarge\n", err)
+	}
+
+	packets, err := sender.EncodeFragments("test", msg, 0)
+	if err != nil {
+		t.Fatalf("calling sender.EncodeFragments() error: %v\n", err)
+	}
+	if len(packets) < 8 {
+		t.Fatalf("expected at least 8 fragments; got %d\n", len(packets))
+	}
+	// deliver in reverse order, with a duplicate
+	packets = append(packets, packets[len(packets)-1])
+	var rcvd *ReusableSlice
+	for i := len(packets) - 1; i >= 0; i-- {
+		if len(packets[i].Slice()) > 1379 {
+			t.Fatalf("fragment of %d bytes exceeds max packet size\n", len(packets[i].Slice()))
+		}
+		data, err := receiver.Decode("test", packets[i].Slice())
+		if err != nil {
+			t.Fatalf("calling receiver.Decode() error: %v\n", err)
+		}
+		if data != nil {
+			if i != 0 {
+				t.Fatalf("message complete before all fragments arrived\n")
+			}
+			rcvd = data
+		}
+	}
+	releasePackets(packets[:len(packets)-1])
+	if rcvd == nil || !bytes.Equal(msg, rcvd.Slice()) {
+		t.Fatalf("reassembled data is not equal to sent data\n")
+	}
+	rcvd.Done()
+
+	// a small change results in a single-packet DF
+	msg[42]++
+	if packets, err = sender.EncodeFragments("test", msg, 0); err != nil {
+		t.Fatalf("calling sender.EncodeFragments() error: %v\n", err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("DF should fit in one packet; got %d\n", len(packets))
+	}
+	if rcvd, err = receiver.Decode("test", packets[0].Slice()); err != nil {
+		t.Fatalf("calling receiver.Decode() error: %v\n", err)
+	}
+	if !bytes.Equal(msg, rcvd.Slice()) {
+		t.Fatalf("decoded data is not equal to sent data\n")
+	}
+	rcvd.Done()
+	releasePackets(packets)
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := newReassembler(time.Second)
+	now := time.Now()
+
+	var h header
+	h.setFrameType(frameKF)
+	h.setFrameID(7)
+	h.setFragment(0, 2)
+	if _, ok := r.add(h, []byte("hello, "), now); ok {
+		t.Fatalf("frame should not be complete with 1 of 2 fragments\n")
+	}
+	h.setFragment(1, 2)
+	if _, ok := r.add(h, []byte("world"), now.Add(2*time.Second)); ok {
+		t.Fatalf("frame should have been dropped after timeout\n")
+	}
+	h.setFragment(0, 2)
+	compressed, ok := r.add(h, []byte("hello, "), now.Add(2*time.Second))
+	if !ok || string(compressed) != "hello, world" {
+		t.Fatalf("expected complete frame \"hello, world\"; got %v %q\n", ok, compressed)
+	}
+}
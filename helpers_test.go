@@ -0,0 +1,75 @@
+package ictl
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// driftingMessages returns n messages of size bytes, each differing from the
+// previous one in a random byte
+func driftingMessages(n int, size int) (messages [][]byte) {
+	rng := rand.New(rand.NewSource(1))
+	message := make([]byte, size)
+	rng.Read(message)
+	for i := 0; i < n; i++ {
+		message[rng.Intn(len(message))] = byte(rng.Int())
+		messages = append(messages, append([]byte(nil), message...))
+	}
+	return
+}
+
+// encodeMessages encodes messages in context "test" with Encode, returning
+// copies of packets
+func encodeMessages(t *testing.T, endpoint Endpoint, messages ...[]byte) (packets [][]byte) {
+	for i, message := range messages {
+		packet, err := endpoint.Encode("test", message, 0)
+		if err != nil {
+			t.Fatalf("message #%d: calling Encode() error: %v\n", i, err)
+		}
+		packets = append(packets, append([]byte(nil), packet.Slice()...))
+		packet.Done()
+	}
+	return
+}
+
+// encodeMessageFragments is like encodeMessages, but encodes with
+// EncodeFragments, returning packets of each message
+func encodeMessageFragments(t *testing.T, endpoint Endpoint, messages ...[]byte) (packets [][][]byte) {
+	for i, message := range messages {
+		encoded, err := endpoint.EncodeFragments("test", message, 0)
+		if err != nil {
+			t.Fatalf("message #%d: calling EncodeFragments() error: %v\n", i, err)
+		}
+		var p [][]byte
+		for _, e := range encoded {
+			p = append(p, append([]byte(nil), e.Slice()...))
+			e.Done()
+		}
+		packets = append(packets, p)
+	}
+	return
+}
+
+// frameType returns type of frame carried in packet
+func frameType(t *testing.T, packet []byte) FrameType {
+	info, err := ParsePacket(packet)
+	if err != nil {
+		t.Fatalf("calling ParsePacket() error: %v\n", err)
+	}
+	return info.FrameType
+}
+
+// checkMessages checks that decoded are messages with given indexes, and
+// releases them
+func checkMessages(t *testing.T, decoded []*ReusableSlice, messages [][]byte, expected ...int) {
+	if len(decoded) != len(expected) {
+		t.Fatalf("expected %d messages; got %d\n", len(expected), len(decoded))
+	}
+	for i, d := range decoded {
+		if !bytes.Equal(d.Slice(), messages[expected[i]]) {
+			t.Fatalf("message #%d is not message %d\n", i, expected[i])
+		}
+		d.Done()
+	}
+}
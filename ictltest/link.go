@@ -0,0 +1,29 @@
+// Package ictltest provides helpers to connect ICTL Endpoints through
+// deterministic in-memory lossy links, for tests and benchmarks.
+//
+// Links are those of package eval. They run on a virtual clock, which Pair
+// also drives its Endpoints with, so that delays and timeouts don't slow
+// tests down or depend on scheduling, and draw all randomness from a seeded
+// source, so that failures are reproducible.
+package ictltest
+
+import (
+	"github.com/songgao/ictl/eval"
+)
+
+// LinkConfig describes impairments of a Link.
+type LinkConfig = eval.Channel
+
+// Link is a one-way in-memory link.
+type Link = eval.Link
+
+// Packet is a packet carried by a Link.
+type Packet = eval.Packet
+
+// LinkStats holds counters of a Link.
+type LinkStats = eval.LinkStats
+
+// NewLink returns a Link with impairments described by config.
+func NewLink(config LinkConfig) *Link {
+	return eval.NewLink(config)
+}
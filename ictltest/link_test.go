@@ -0,0 +1,84 @@
+package ictltest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/songgao/ictl/eval"
+)
+
+func sendAll(l *Link, n int) (received []Packet) {
+	now := time.Unix(0, 0)
+	for i := 0; i < n; i++ {
+		l.Send(Packet{Data: []byte{byte(i), 0, 0, 0}, Index: i}, now)
+		now = now.Add(time.Millisecond)
+		received = append(received, l.Receive(now)...)
+	}
+	return append(received, l.Flush()...)
+}
+
+func TestLinkDeterministic(t *testing.T) {
+	config := LinkConfig{
+		Loss:      eval.GilbertElliott{P: 0.05, R: 0.3, LossBad: 1},
+		Reorder:   0.1,
+		Duplicate: 0.05,
+		Corrupt:   0.05,
+		Jitter:    3 * time.Millisecond,
+		Seed:      7,
+	}
+	a, b := sendAll(NewLink(config), 1000), sendAll(NewLink(config), 1000)
+	if len(a) != len(b) {
+		t.Fatalf("runs with the same seed delivered %d and %d packets\n", len(a), len(b))
+	}
+	for i := range a {
+		if a[i].Index != b[i].Index || !bytes.Equal(a[i].Data, b[i].Data) {
+			t.Fatalf("runs with the same seed differ at packet #%d\n", i)
+		}
+	}
+}
+
+func TestLinkImpairments(t *testing.T) {
+	l := NewLink(LinkConfig{Loss: eval.Bernoulli{P: 0.1}, Duplicate: 0.1, Corrupt: 0.1, Reorder: 0.1, Seed: 1})
+	received := sendAll(l, 2000)
+	stats := l.Stats()
+	if stats.Sent != 2000 || stats.Delivered != len(received) {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+	if stats.Delivered != stats.Sent-stats.Lost+stats.Duplicated {
+		t.Fatalf("delivered packets don't add up: %+v\n", stats)
+	}
+	for _, n := range []int{stats.Lost, stats.Duplicated, stats.Corrupted, stats.Reordered} {
+		if n < 100 || n > 300 {
+			t.Fatalf("impairment rates are off: %+v\n", stats)
+		}
+	}
+
+	corrupted, reordered := 0, 0
+	for i, p := range received {
+		if !bytes.Equal(p.Data[1:], []byte{0, 0, 0}) || p.Data[0] != byte(p.Index) {
+			corrupted++
+		}
+		if i > 0 && p.Index < received[i-1].Index {
+			reordered++
+		}
+	}
+	if corrupted != stats.Corrupted {
+		t.Fatalf("%d packets are corrupted; expected %d\n", corrupted, stats.Corrupted)
+	}
+	if reordered == 0 {
+		t.Fatalf("no packets are reordered\n")
+	}
+}
+
+func TestLinkDelay(t *testing.T) {
+	l := NewLink(LinkConfig{Delay: 5 * time.Millisecond})
+	now := time.Unix(0, 0)
+	l.Send(Packet{Data: []byte{1}}, now)
+	if p := l.Receive(now.Add(4 * time.Millisecond)); len(p) != 0 {
+		t.Fatalf("packet is delivered before its delay\n")
+	}
+	if p := l.Receive(now.Add(5 * time.Millisecond)); len(p) != 1 {
+		t.Fatalf("packet is not delivered after its delay\n")
+	}
+}
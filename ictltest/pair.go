@@ -0,0 +1,106 @@
+package ictltest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/songgao/ictl"
+	"github.com/songgao/ictl/eval"
+)
+
+// Delivery holds what happened to messages sent through a Pair.
+type Delivery struct {
+	Sent         int // messages
+	Delivered    int // messages reconstructed correctly, counted once each
+	Corrupted    int // reconstructed messages differing from the original
+	DecodeErrors int // packets the receiver failed to decode
+}
+
+// Ratio returns the portion of messages reconstructed correctly.
+func (d Delivery) Ratio() float64 {
+	if d.Sent == 0 {
+		return 1
+	}
+	return float64(d.Delivered) / float64(d.Sent)
+}
+
+// Pair connects a sender Endpoint to a receiver Endpoint through a Link, and
+// a Link in the other direction for feedback and resync requests. Messages
+// are sent one Interval of virtual time apart, and both Endpoints run on that
+// clock. Options of delivery are those of eval.Session. It's not safe for concurrent use.
+type Pair struct {
+	*eval.Session
+
+	Now      time.Time
+	Interval time.Duration
+}
+
+// NewPair creates a sender and a receiver Endpoint from config, connected by
+// links with impairments described by forward and backward. Interval is
+// 10ms.
+func NewPair(config ictl.EndpointConfig, forward, backward LinkConfig) *Pair {
+	p := &Pair{
+		Now:      time.Unix(0, 0),
+		Interval: 10 * time.Millisecond,
+	}
+	config = config.Clone().SetClock(func() time.Time { return p.Now })
+	p.Session = eval.NewSession(ictl.NewEndpoint(config), ictl.NewEndpoint(config), NewLink(forward), NewLink(backward))
+	return p
+}
+
+// Send encodes message in context at the sender, advances the clock by
+// Interval, and delivers packets that come out of the links by then. Errors
+// of decoding are counted in Delivery and kept in DecodeErrors, rather than
+// returned, since a lossy link is expected to cause them.
+func (p *Pair) Send(context string, message []byte) (err error) {
+	if err = p.Session.Send(context, message, p.Now); err != nil {
+		return
+	}
+	p.Now = p.Now.Add(p.Interval)
+	return p.Deliver(p.Now)
+}
+
+// Flush delivers all packets still in the links.
+func (p *Pair) Flush() error {
+	return p.Session.Flush(p.Now)
+}
+
+// Delivery returns what happened to messages sent so far.
+func (p *Pair) Delivery() Delivery {
+	total, _ := p.Results()
+	return Delivery{
+		Sent:         total.Messages,
+		Delivered:    total.Delivered,
+		Corrupted:    total.Corrupted,
+		DecodeErrors: total.DecodeErrors,
+	}
+}
+
+// DecodeErrors returns errors the receiver returned in decoding.
+func (p *Pair) DecodeErrors() []error {
+	return p.Errors()
+}
+
+// Close closes both endpoints.
+func (p *Pair) Close() {
+	p.Sender.Close()
+	p.Receiver.Close()
+}
+
+// AssertDeliveryRatio fails t if less than min of messages sent so far have
+// been delivered. It doesn't flush the links.
+func (p *Pair) AssertDeliveryRatio(t testing.TB, min float64) {
+	t.Helper()
+	if d := p.Delivery(); d.Ratio() < min {
+		t.Fatalf("delivery ratio %.3f is lower than %.3f: %+v\n", d.Ratio(), min, d)
+	}
+}
+
+// AssertNoCorruption fails t if any message has been reconstructed
+// incorrectly.
+func (p *Pair) AssertNoCorruption(t testing.TB) {
+	t.Helper()
+	if d := p.Delivery(); d.Corrupted > 0 {
+		t.Fatalf("%d messages are corrupted: %+v\n", d.Corrupted, d)
+	}
+}
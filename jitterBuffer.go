@@ -0,0 +1,214 @@
+package ictl
+
+import "time"
+
+// jitterBuffer holds DFs whose reference hasn't arrived yet, e.g., because
+// the KF took a slower path, so that they can be decoded once it arrives
+// instead of failing. Entries are kept in the order they arrived. In in-order
+// mode, messages decoded while DFs are held are queued behind them as well, so
+// that messages are delivered in the order they arrived, except that a KF is
+// delivered right before the DFs referencing it.
+type jitterBuffer struct {
+	size    int           // max number of entries
+	timeout time.Duration // max time a DF is held
+	inOrder bool
+
+	entries []jitterEntry
+}
+
+type jitterEntry struct {
+	header  header         // of a held DF
+	diff    *ReusableSlice // uncompressed payload of a held DF; nil once decoded
+	data    *ReusableSlice // decoded message
+	arrived time.Time
+}
+
+func (en jitterEntry) held() bool {
+	return en.diff != nil
+}
+
+// newJitterBuffer returns nil if the jitter buffer is disabled in config
+func newJitterBuffer(config endpointConfig) *jitterBuffer {
+	if config.jitterBufferSize <= 0 {
+		return nil
+	}
+	return &jitterBuffer{
+		size:    config.jitterBufferSize,
+		timeout: config.jitterBufferTimeout,
+		inOrder: config.jitterBufferInOrder,
+	}
+}
+
+// hold adds a DF with header h and differential data diff, transferring
+// ownership of diff to the buffer
+func (j *jitterBuffer) hold(h header, diff *ReusableSlice, now time.Time) {
+	j.entries = append(j.entries, jitterEntry{header: h, diff: diff, arrived: now})
+}
+
+// clear releases all entries
+func (j *jitterBuffer) clear() {
+	if j == nil {
+		return
+	}
+	for _, en := range j.entries {
+		if en.diff != nil {
+			en.diff.Done()
+		}
+		if en.data != nil {
+			en.data.Done()
+		}
+	}
+	j.entries = nil
+}
+
+// decodeMessages is like decode, but DFs whose reference is missing are held
+// in the jitter buffer, and all messages that become available are returned:
+// the one decoded from packet if any, and held ones released by it or by
+// expiry of others. messages may be non-empty even if err is not nil.
+func (e *decoder) decodeMessages(packet []byte, now time.Time) (messages []*ReusableSlice, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		err = errContextClosed
+		return
+	}
+
+	j := e.jitter
+	if j == nil {
+		var data *ReusableSlice
+		if data, _, _, _, err = e.decodeLocked(packet, false, now); data != nil {
+			messages = append(messages, data)
+		}
+		return
+	}
+
+	e.expireHeld(now)
+
+	var data *ReusableSlice
+	var h header
+	var held bool
+	if data, _, h, held, err = e.decodeLocked(packet, true, now); data != nil {
+		if h.getFrameType() == frameKF {
+			if releaseErr := e.releaseHeld(h.frameID, data); err == nil {
+				err = releaseErr
+			}
+		} else {
+			j.entries = append(j.entries, jitterEntry{data: data, arrived: now})
+		}
+	}
+	if id, _, _, _, refresh := h.getRefresh(); refresh {
+		if ref, ok := e.rcvdKFs.get(id); ok { // DFs held for the new reference, if just completed
+			ref.Done()
+			if releaseErr := e.releaseHeld(id, nil); err == nil {
+				err = releaseErr
+			}
+		}
+	}
+	if held {
+		for len(j.entries) > j.size {
+			e.expireOldest()
+		}
+	}
+
+	// deliver decoded entries; in in-order mode, only those not queued behind
+	// a held DF
+	var still []jitterEntry
+	for i, en := range j.entries {
+		if en.held() {
+			if j.inOrder {
+				still = append(still, j.entries[i:]...)
+				break
+			}
+			still = append(still, en)
+			continue
+		}
+		messages = append(messages, en.data)
+	}
+	j.entries = still
+	return
+}
+
+// releaseHeld decodes held DFs referencing KF id, which has just arrived with
+// message data. The KF is placed right before the first of them, or at the end
+// if there's none; data is nil if the KF's message isn't to be delivered,
+// e.g., it's a refreshed reference. DFs that fail to decode are dropped, and
+// the first error is returned.
+//
+// Caller must hold e.mu.
+func (e *decoder) releaseHeld(id uint32, data *ReusableSlice) (err error) {
+	j := e.jitter
+	kf := jitterEntry{data: data}
+	placed := false
+	var entries []jitterEntry
+	for _, en := range j.entries {
+		if !en.held() || en.header.frameID != id {
+			entries = append(entries, en)
+			continue
+		}
+		if !placed && data != nil {
+			entries = append(entries, kf)
+		}
+		placed = true
+		ref, _ := e.rcvdKFs.get(id) // just put by decodeLocked
+		var patchErr error
+		en.data, patchErr = e.patchDF(en.header, en.diff, ref)
+		ref.Done()
+		en.diff.Done()
+		en.diff = nil
+		if patchErr != nil {
+			e.dStats.decoded(false)
+			if err == nil {
+				err = patchErr
+			}
+			continue
+		}
+		e.dStats.decoded(true)
+		e.stats.MessagesDecoded++
+		e.stats.DecodedBytes += uint64(len(en.data.Slice()))
+		entries = append(entries, en)
+	}
+	if !placed && data != nil {
+		entries = append(entries, kf)
+	}
+	j.entries = entries
+	return
+}
+
+// expireHeld drops held DFs that have waited longer than the timeout
+//
+// Caller must hold e.mu.
+func (e *decoder) expireHeld(now time.Time) {
+	j := e.jitter
+	var entries []jitterEntry
+	for _, en := range j.entries {
+		if en.held() && now.Sub(en.arrived) > j.timeout {
+			e.dropHeld(en)
+			continue
+		}
+		entries = append(entries, en)
+	}
+	j.entries = entries
+}
+
+// expireOldest drops the oldest held DF
+//
+// Caller must hold e.mu.
+func (e *decoder) expireOldest() {
+	j := e.jitter
+	for i, en := range j.entries {
+		if en.held() {
+			e.dropHeld(en)
+			j.entries = append(j.entries[:i], j.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// dropHeld counts a held DF as failed due to missing reference, and releases
+// it
+func (e *decoder) dropHeld(en jitterEntry) {
+	e.stats.MissingReferences++
+	e.dStats.decoded(false)
+	en.diff.Done()
+}
@@ -0,0 +1,121 @@
+package ictl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterBuffer(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(8))
+	messages := driftingMessages(10, 64)
+	packets := encodeMessages(t, sender, messages...)
+	sender.Close()
+	for _, inOrder := range []bool{false, true} {
+		config := DefaultEndpointConfig().SetJitterBufferSize(16).SetJitterBufferTimeout(time.Hour).SetJitterBufferInOrder(inOrder)
+		endpoint := NewEndpoint(config)
+		decode := func(i int) []*ReusableSlice {
+			decoded, err := endpoint.DecodeMessages("test", packets[i])
+			if err != nil {
+				t.Fatalf("calling DecodeMessages() error: %v\n", err)
+			}
+			return decoded
+		}
+
+		// DFs arriving before their KF are held until it arrives
+		checkMessages(t, decode(1), messages)
+		checkMessages(t, decode(2), messages)
+		checkMessages(t, decode(0), messages, 0, 1, 2)
+
+		// DF 9 references the late KF 8; DF 3 references KF 0
+		checkMessages(t, decode(9), messages)
+		if inOrder {
+			checkMessages(t, decode(3), messages)
+			checkMessages(t, decode(8), messages, 8, 9, 3)
+		} else {
+			checkMessages(t, decode(3), messages, 3)
+			checkMessages(t, decode(8), messages, 8, 9)
+		}
+
+		if stats := endpoint.Stats(); stats.DFsHeld != 3 || stats.MissingReferences != 0 || stats.MessagesDecoded != 6 {
+			t.Fatalf("unexpected stats: %+v\n", stats)
+		}
+		endpoint.Close()
+	}
+}
+
+func TestJitterBufferExpiry(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(8))
+	messages := driftingMessages(10, 64)
+	packets := encodeMessages(t, sender, messages...)
+	sender.Close()
+	config := DefaultEndpointConfig().SetJitterBufferSize(2).SetJitterBufferTimeout(50 * time.Millisecond).SetJitterBufferInOrder(true)
+	dec := newDecoder(newSlicePool(1500), *(config.(*endpointConfig)), newDecoderStats(100))
+	defer dec.close()
+	now := time.Now()
+	decode := func(i int, at time.Duration) []*ReusableSlice {
+		decoded, err := dec.decodeMessages(packets[i], now.Add(at))
+		if err != nil {
+			t.Fatalf("calling decodeMessages() error: %v\n", err)
+		}
+		return decoded
+	}
+
+	checkMessages(t, decode(0, 0), messages, 0)
+	checkMessages(t, decode(9, 0), messages)
+	checkMessages(t, decode(1, 10*time.Millisecond), messages)
+	// DF 9 times out, releasing DF 1 queued behind it
+	checkMessages(t, decode(2, 100*time.Millisecond), messages, 1, 2)
+	checkMessages(t, decode(8, 110*time.Millisecond), messages, 8)
+
+	// the buffer holds 2 entries; the oldest held DF is dropped
+	dec.foundReference(8)
+	dec.rcvdKFs.clear()
+	checkMessages(t, decode(9, 200*time.Millisecond), messages)
+	checkMessages(t, decode(3, 200*time.Millisecond), messages)
+	checkMessages(t, decode(4, 200*time.Millisecond), messages)
+	if len(dec.jitter.entries) != 2 {
+		t.Fatalf("expected 2 entries; got %d\n", len(dec.jitter.entries))
+	}
+	if dec.stats.MissingReferences != 2 {
+		t.Fatalf("expected 2 missing references; got %d\n", dec.stats.MissingReferences)
+	}
+}
+
+func TestJitterBufferReleaseErrors(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(8).SetChecksum(true).SetCompressionAlgorithm(CANone))
+	messages := driftingMessages(3, 64)
+	packets := encodeMessages(t, sender, messages...)
+	sender.Close()
+	packets[1][len(packets[1])-1] ^= 0xff // DF 1 fails its checksum once patched
+
+	config := DefaultEndpointConfig().SetJitterBufferSize(4).SetJitterBufferTimeout(time.Hour)
+	dec := newDecoder(newSlicePool(1500), *(config.(*endpointConfig)), newDecoderStats(100))
+	defer dec.close()
+	now := time.Now()
+	for _, i := range []int{1, 2} {
+		if decoded, err := dec.decodeMessages(packets[i], now); err != nil || len(decoded) != 0 {
+			t.Fatalf("expected DF %d to be held; got %d messages, %v\n", i, len(decoded), err)
+		}
+	}
+
+	// DF 2 decoding after DF 1 failed doesn't hide the error
+	decoded, err := dec.decodeMessages(packets[0], now)
+	if err != ErrChecksumMismatch {
+		t.Fatalf("expected %v; got %v\n", ErrChecksumMismatch, err)
+	}
+	checkMessages(t, decoded, messages, 0, 2)
+	if ratio := dec.dStats.successRatio(); ratio != 0.99 {
+		t.Fatalf("expected the failed DF to count in delivery ratio; got %v\n", ratio)
+	}
+}
+
+func TestJitterBufferDisabled(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig())
+	packets := encodeMessages(t, sender, driftingMessages(2, 64)...)
+	sender.Close()
+	endpoint := NewEndpoint(DefaultEndpointConfig())
+	defer endpoint.Close()
+	if decoded, err := endpoint.DecodeMessages("test", packets[1]); err == nil || len(decoded) != 0 {
+		t.Fatalf("expected DF with missing reference to fail; got %d messages, %v\n", len(decoded), err)
+	}
+}
@@ -0,0 +1,293 @@
+package ictl_test
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/songgao/ictl"
+	"github.com/songgao/ictl/eval"
+	"github.com/songgao/ictl/ictltest"
+)
+
+// dropPackets loses packets at given positions, counted from 0
+type dropPackets map[int]bool
+
+func (m dropPackets) NewProcess(*rand.Rand) eval.LossProcess {
+	return &dropProcess{drop: m}
+}
+
+type dropProcess struct {
+	drop dropPackets
+	n    int
+}
+
+func (p *dropProcess) Lost() bool {
+	p.n++
+	return p.drop[p.n-1]
+}
+
+// sendMessages sends n messages of size 128, each differing from the previous
+// one in a few bytes
+func sendMessages(t *testing.T, pair *ictltest.Pair, n int) {
+	rng := rand.New(rand.NewSource(1))
+	message := make([]byte, 128)
+	rng.Read(message)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint32(message, uint32(i))
+		message[4+rng.Intn(len(message)-4)] = byte(rng.Int())
+		if err := pair.Send("test", message); err != nil {
+			t.Fatalf("calling pair.Send() error: %v\n", err)
+		}
+	}
+	if err := pair.Flush(); err != nil {
+		t.Fatalf("calling pair.Flush() error: %v\n", err)
+	}
+}
+
+func TestLossyMissingKeyFrame(t *testing.T) {
+	config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(8)
+	// the second KF is lost; the DFs referencing it can't be decoded
+	pair := ictltest.NewPair(config, ictltest.LinkConfig{Loss: dropPackets{8: true}}, ictltest.LinkConfig{})
+	defer pair.Close()
+	sendMessages(t, pair, 32)
+
+	d := pair.Delivery()
+	if d.Delivered != 32-8 || d.DecodeErrors != 7 {
+		t.Fatalf("unexpected delivery: %+v\n", d)
+	}
+	for _, err := range pair.DecodeErrors() {
+		if !strings.Contains(err.Error(), "is missing") {
+			t.Fatalf("unexpected decode error: %v\n", err)
+		}
+	}
+	if stats, _ := pair.Receiver.ContextStats("test"); stats.MissingReferences != 7 {
+		t.Fatalf("expected 7 missing references; got %d\n", stats.MissingReferences)
+	}
+	pair.AssertNoCorruption(t)
+}
+
+func TestLossyDelivery(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      ictl.EndpointConfig
+		link        ictltest.LinkConfig
+		feedback    bool
+		minDelivery float64
+	}{
+		{
+			name:        "bernoulli",
+			config:      ictl.DefaultEndpointConfig().SetEncoderCycleLength(8),
+			link:        ictltest.LinkConfig{Loss: eval.Bernoulli{P: 0.05}, Seed: 1},
+			minDelivery: 0.85,
+		},
+		{
+			name:        "burst",
+			config:      ictl.DefaultEndpointConfig().SetEncoderCycleLength(8),
+			link:        ictltest.LinkConfig{Loss: eval.GilbertElliott{P: 0.02, R: 0.5, LossBad: 1}, Seed: 2},
+			minDelivery: 0.85,
+		},
+		{
+			name:        "reorder and duplicate",
+			config:      ictl.DefaultEndpointConfig().SetSequenceNumbers(true),
+			link:        ictltest.LinkConfig{Reorder: 0.05, Duplicate: 0.05, Seed: 3},
+			minDelivery: 0.9,
+		},
+		{
+			name:        "corruption with checksum",
+			config:      ictl.DefaultEndpointConfig().SetChecksum(true).SetEncoderCycleLength(16),
+			link:        ictltest.LinkConfig{Corrupt: 0.05, Seed: 4},
+			minDelivery: 0.8,
+		},
+		{
+			name:        "feedback",
+			config:      ictl.DefaultEndpointConfig().SetConfidenceLookback(4).SetEncoderCycleLength(8),
+			link:        ictltest.LinkConfig{Loss: eval.Bernoulli{P: 0.05}, Seed: 5},
+			feedback:    true,
+			minDelivery: 0.85,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pair := ictltest.NewPair(test.config, test.link, test.link)
+			defer pair.Close()
+			pair.Feedback = test.feedback
+			sendMessages(t, pair, 1000)
+			pair.AssertDeliveryRatio(t, test.minDelivery)
+			pair.AssertNoCorruption(t)
+			t.Logf("delivery: %+v\n", pair.Delivery())
+		})
+	}
+}
+
+func TestLossyResync(t *testing.T) {
+	// in adaptive mode, the first KF being lost leaves the receiver with
+	// nothing to decode until the encoder decides to send another KF, or a
+	// resync request is answered
+	for _, resync := range []bool{false, true} {
+		pair := ictltest.NewPair(ictl.DefaultEndpointConfig(), ictltest.LinkConfig{Loss: dropPackets{0: true}}, ictltest.LinkConfig{})
+		pair.Resync = resync
+		sendMessages(t, pair, 100)
+		d := pair.Delivery()
+		pair.Close()
+		// the request arrives after the next message is encoded
+		if resync && d.DecodeErrors > 2 {
+			t.Fatalf("expected resync to recover delivery: %+v\n", d)
+		}
+		if !resync && d.DecodeErrors <= 2 {
+			t.Fatalf("expected delivery to suffer without resync: %+v\n", d)
+		}
+	}
+}
+
+func TestLossyNACK(t *testing.T) {
+	config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(16)
+	link := ictltest.LinkConfig{Loss: eval.Bernoulli{P: 0.1}, Delay: 5 * time.Millisecond, Seed: 6}
+	var errs [2]int
+	for i, nack := range []bool{false, true} {
+		pair := ictltest.NewPair(config, link, link)
+		pair.NACK = nack
+		sendMessages(t, pair, 1000)
+		pair.AssertNoCorruption(t)
+		errs[i] = pair.Delivery().DecodeErrors
+		if stats := pair.Sender.Stats(); nack != (stats.KFsRetransmitted > 0) {
+			t.Fatalf("unexpected retransmissions: %d\n", stats.KFsRetransmitted)
+		}
+		t.Logf("NACK %v: %+v\n", nack, pair.Delivery())
+		pair.Close()
+	}
+	if errs[1]*2 > errs[0] {
+		t.Fatalf("expected NACKs to reduce decode errors: %d without, %d with\n", errs[0], errs[1])
+	}
+}
+
+func TestLossyJitterBuffer(t *testing.T) {
+	link := ictltest.LinkConfig{Reorder: 0.3, ReorderDepth: 3, Seed: 3}
+	var delivered [2]int
+	for i, size := range []int{0, 8} {
+		config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(8).SetJitterBufferSize(size)
+		pair := ictltest.NewPair(config, link, ictltest.LinkConfig{})
+		pair.DecodeMessages = true
+		sendMessages(t, pair, 1000)
+		pair.AssertNoCorruption(t)
+		delivered[i] = pair.Delivery().Delivered
+		if stats, _ := pair.Receiver.ContextStats("test"); (size > 0) != (stats.DFsHeld > 0) {
+			t.Fatalf("unexpected DFs held: %d\n", stats.DFsHeld)
+		}
+		t.Logf("jitter buffer %d: %+v\n", size, pair.Delivery())
+		pair.Close()
+	}
+	if delivered[1] <= delivered[0] {
+		t.Fatalf("expected jitter buffer to improve delivery: %d without, %d with\n", delivered[0], delivered[1])
+	}
+}
+
+func TestLossyParity(t *testing.T) {
+	link := ictltest.LinkConfig{Loss: eval.Bernoulli{P: 0.05}, Seed: 4}
+	var lost [2]int
+	for i, size := range []int{0, 2} {
+		// DFs of the first KF of a group arrive before the parity frame, so
+		// they're held in the jitter buffer until it's rebuilt
+		config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(8).SetParityGroupSize(size).SetJitterBufferSize(16)
+		pair := ictltest.NewPair(config, link, ictltest.LinkConfig{})
+		pair.DecodeMessages = true
+		sendMessages(t, pair, 1000)
+		pair.AssertNoCorruption(t)
+		lost[i] = pair.Delivery().Sent - pair.Delivery().Delivered
+		if stats, _ := pair.Receiver.ContextStats("test"); (size > 0) != (stats.KFsRecovered > 0) {
+			t.Fatalf("unexpected KFs recovered: %d\n", stats.KFsRecovered)
+		}
+		t.Logf("parity group %d: %+v\n", size, pair.Delivery())
+		pair.Close()
+	}
+	if lost[1]*2 > lost[0] {
+		t.Fatalf("expected parity frames to reduce lost messages: %d without, %d with\n", lost[0], lost[1])
+	}
+}
+
+// slowLoss is a loss model pausing the caller for pause every n packets, so
+// that wall-clock time passes between packets
+type slowLoss struct {
+	eval.LossModel
+	n     int
+	pause time.Duration
+}
+
+func (m slowLoss) NewProcess(rng *rand.Rand) eval.LossProcess {
+	return &slowProcess{LossProcess: m.LossModel.NewProcess(rng), loss: m}
+}
+
+type slowProcess struct {
+	eval.LossProcess
+	loss slowLoss
+	sent int
+}
+
+func (p *slowProcess) Lost() bool {
+	if p.sent++; p.sent%p.loss.n == 0 {
+		time.Sleep(p.loss.pause)
+	}
+	return p.LossProcess.Lost()
+}
+
+func TestLossyDeterministic(t *testing.T) {
+	// Pair drives both endpoints with its virtual clock, so timeouts and rate
+	// limits, and thus results, don't depend on how fast the test runs
+	config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(8).SetParityGroupSize(2).
+		SetJitterBufferSize(16).SetJitterBufferTimeout(15 * time.Millisecond)
+	link := ictltest.LinkConfig{Loss: eval.Bernoulli{P: 0.05}, Seed: 4}
+	var deliveries [2]ictltest.Delivery
+	var stats [2]ictl.Stats
+	for i, pause := range []time.Duration{0, 20 * time.Millisecond} {
+		forward := link
+		if pause > 0 {
+			forward.Loss = slowLoss{LossModel: link.Loss, n: 10, pause: pause}
+		}
+		pair := ictltest.NewPair(config, forward, link)
+		pair.DecodeMessages = true
+		sendMessages(t, pair, 1000)
+		deliveries[i] = pair.Delivery()
+		stats[i], _ = pair.Receiver.ContextStats("test")
+		pair.Close()
+	}
+	if deliveries[0] != deliveries[1] || stats[0] != stats[1] {
+		t.Fatalf("runs at different speeds differ: %+v, %+v; %+v, %+v\n", deliveries[0], stats[0], deliveries[1], stats[1])
+	}
+}
+
+func TestLossyKFRepeats(t *testing.T) {
+	link := ictltest.LinkConfig{Loss: eval.Bernoulli{P: 0.05}, Seed: 4}
+	var errs [2]int
+	for i, repeats := range []int{0, 2} {
+		config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(8).SetKFRepeats(repeats)
+		pair := ictltest.NewPair(config, link, ictltest.LinkConfig{})
+		sendMessages(t, pair, 1000)
+		pair.AssertNoCorruption(t)
+		errs[i] = pair.Delivery().DecodeErrors
+		if stats := pair.Sender.Stats(); stats.KFsRepeated != uint64(repeats*1000/8) {
+			t.Fatalf("unexpected KFs repeated: %d\n", stats.KFsRepeated)
+		}
+		t.Logf("KF repeats %d: %+v\n", repeats, pair.Delivery())
+		pair.Close()
+	}
+	if errs[1]*2 > errs[0] {
+		t.Fatalf("expected KF repeats to reduce decode errors: %d without, %d with\n", errs[0], errs[1])
+	}
+}
+
+func TestLossyRefresh(t *testing.T) {
+	config := ictl.DefaultEndpointConfig().SetEncoderCycleLength(16).SetRefreshSlices(4)
+	link := ictltest.LinkConfig{Loss: eval.Bernoulli{P: 0.02}, Delay: 5 * time.Millisecond, Seed: 5}
+	pair := ictltest.NewPair(config, link, link)
+	defer pair.Close()
+	pair.Resync = true
+	sendMessages(t, pair, 1000)
+	pair.AssertNoCorruption(t)
+	pair.AssertDeliveryRatio(t, 0.85)
+	if stats := pair.Receiver.Stats(); stats.RefreshesCompleted == 0 || stats.KFsReceived == 0 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+	t.Logf("%+v\n", pair.Delivery())
+}
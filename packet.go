@@ -2,12 +2,23 @@ package ictl
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 )
 
 const (
 	frameKF uint8 = 1 << iota
 	frameDF
+	frameFeedback // acknowledgement report sent from decoder back to encoder
+	frameRequest  // request sent from decoder back to encoder, e.g., resync
+)
+
+// The 4-bit frame type field has no single-bit values left, so later frame
+// types take the remaining values.
+const (
+	frameParity uint8 = 3 // XOR parity of a group of KFs, for FEC
 )
 
 type CompressionAlgorithm uint8
@@ -25,14 +36,149 @@ const (
 	CAAuto CompressionAlgorithm = 0x0F
 )
 
+// Wire format versions, carried in the higher 4 bits of the first header
+// byte.
+//
+// Version 0 is the basic 4-byte header: frame type, compression options and
+// algorithm, and a 16-bit frame ID.
+//
+// Version 1 appends a flags byte after frame ID. Each flag indicates presence
+// of an optional field, which follow the flags byte in the order of the flag
+// bits.
+//
+// Version 2 is version 1 with extended IDs: frame ID and sequence number are
+// 32 bits instead of 16, so that they don't wrap around in long-running
+// streams. The flags byte is always present in version 2.
+//
+// Versions 12 to 15, i.e., first byte with the higher 2 bits set, are a
+// compressed header: a single byte describing a DF without optional fields.
+// The next 3 bits are a check value of the reference KF ID (see refCheck),
+// and the lower 3 bits are the compression algorithm, with no options. The
+// reference is implied: it's the latest KF received in the context, so
+// decoding relies on per-context state; encoders only use it when the
+// reference is the latest KF sent and known to be held by the receiver. To
+// keep the implied reference from moving back to a late or duplicate KF,
+// while following an encoder that restarted with IDs starting over, KFs
+// carry the epoch of their encoder (flagEpoch) when header compression is
+// enabled.
+//
+// Compatibility policy: encoders always write the lowest version that can
+// express a packet, so packets not using newer features stay decodable by
+// receivers that are already deployed. Decoders reject, rather than guess,
+// anything they don't know: versions newer than what they support (with an
+// *UnsupportedVersionError), flags they don't know, and frame types they don't
+// know. So a new optional field or frame type can be added within a version,
+// and is only ever sent when the feature is turned on by configuration, or
+// when the packet can't be expressed otherwise; changing layout of existing
+// fields, e.g., longer IDs, requires a new version. The same goes for
+// payloads: a payload layout that older decoders would misread, e.g.,
+// length-prefixed differential data, is announced by a flag
+// (flagLengthPrefix), and the original layout is used whenever it can express
+// the message.
+const (
+	headerVersion0 uint8 = iota
+	headerVersion1
+	headerVersion2
+
+	maxHeaderVersion = headerVersion2
+
+	compressedHeaderMark uint8 = 0xC0 // higher 2 bits of the first byte
+)
+
+// refCheck returns the 3-bit check value of reference KF ID id carried in
+// compressed headers. It's a hash rather than lower bits of id, since KF IDs
+// are often apart by a power of 2.
+func refCheck(id uint32) uint8 {
+	return uint8((id * 0x9E3779B1) >> 29)
+}
+
+// UnsupportedVersionError is returned when decoding a packet with a header
+// version newer than what this implementation supports.
+type UnsupportedVersionError struct {
+	Version uint8
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported ICTL header version %d", e.Version)
+}
+
+// Header flags, in version 1 and later
+const (
+	// the differential data of the DF starts with the length of the message,
+	// so that the message can be shorter than its reference (see diff); no
+	// field follows
+	flagLengthPrefix uint8 = 1 << iota
+
+	// a CRC32C (Castagnoli) checksum of the original message follows the
+	// flags byte, as a big-endian uint32
+	flagChecksum
+
+	// the packet carries one fragment of a frame's compressed payload; the
+	// fragment index and the total number of fragments follow, one byte each
+	flagFragment
+
+	// sequence number of the message follows, as a big-endian uint16, or
+	// uint32 in version 2. Only used in DFs, since frame ID of a KF is its
+	// sequence number.
+	flagSequence
+
+	// channel ID identifying the context follows, as a big-endian uint16
+	flagChannel
+
+	// epoch of the encoder follows, as a big-endian uint16. Only used in KFs
+	// with header compression, so that decoders can tell a restarted encoder,
+	// whose KF IDs start over, from a late or duplicate KF (see
+	// decoder.setLatestKF).
+	flagEpoch
+
+	// the KF is a copy of one sent earlier, retransmitted in answer to a
+	// NACK, or repeated by the encoder (see SetKFRepeats); no field follows
+	flagRetransmit
+
+	// the DF carries a segment of a new reference, which the decoder caches
+	// as a KF once it has all segments (see SetRefreshSlices). The ID of the
+	// new reference follows, as a big-endian uint16, or uint32 in version 2;
+	// then the segment index and the number of segments, one byte each; then
+	// the length of the new reference, as a big-endian uint32. The segment
+	// precedes the differential data in the uncompressed payload. In a
+	// retransmitted KF, it marks a refreshed reference, carried whole as the
+	// only segment, which the decoder caches without delivering, since its
+	// message has been delivered with the first segment.
+	flagRefresh
+
+	// all bits of the flags byte are taken; further optional fields require
+	// a new version
+	knownFlags = flagLengthPrefix | flagChecksum | flagFragment | flagSequence | flagChannel | flagEpoch | flagRetransmit | flagRefresh
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
 type header struct {
 	frameType          uint8
 	compressionOptions uint8
-	frameID            uint16
+	frameID            uint32 // at most 0xFFFF unless extendedIDs
+
+	extendedIDs bool // version 2
+
+	// compressed header; when read, frameID is only resolved by decoder, and
+	// holds refCheck of the reference until then
+	compressed bool
+
+	flags         uint8
+	checksum      uint32 // if flags&flagChecksum != 0
+	fragmentIndex uint8  // if flags&flagFragment != 0
+	fragmentCount uint8  // if flags&flagFragment != 0
+	sequence      uint32 // if flags&flagSequence != 0
+	channel       uint16 // if flags&flagChannel != 0
+	epoch         uint16 // if flags&flagEpoch != 0
+	refreshID     uint32 // if flags&flagRefresh != 0
+	refreshIndex  uint8  // if flags&flagRefresh != 0
+	refreshCount  uint8  // if flags&flagRefresh != 0
+	refreshLength uint32 // if flags&flagRefresh != 0
 }
 
 func (h *header) setFrameType(frame uint8) {
-	// higher (first) 4 bits are reserved and should always be 0b0000
+	// higher (first) 4 bits are the version, which is decided in writeTo
 	h.frameType = 0x0F & frame
 }
 
@@ -58,16 +204,199 @@ func (h header) getCompressionAlgorithm() CompressionAlgorithm {
 	return CompressionAlgorithm(h.compressionOptions & 0x0F)
 }
 
-func (h *header) setFrameID(id uint16) {
+// setFrameID sets frame ID; the header uses extended IDs if id doesn't fit
+// in 16 bits
+func (h *header) setFrameID(id uint32) {
 	h.frameID = id
+	if id > 0xFFFF {
+		h.extendedIDs = true
+	}
 }
 
-func (h header) getFrameID() uint16 {
+func (h header) getFrameID() uint32 {
 	return h.frameID
 }
 
+func (h *header) setLengthPrefix() {
+	h.flags |= flagLengthPrefix
+}
+
+// hasLengthPrefix returns whether differential data of the DF starts with the
+// length of the message
+func (h header) hasLengthPrefix() bool {
+	return h.flags&flagLengthPrefix != 0
+}
+
+// setExtendedIDs makes the header use 32-bit frame ID and sequence number
+func (h *header) setExtendedIDs() {
+	h.extendedIDs = true
+}
+
+func (h *header) setChecksum(checksum uint32) {
+	h.flags |= flagChecksum
+	h.checksum = checksum
+}
+
+// getChecksum returns checksum of the original message; ok is false if the
+// header doesn't carry one.
+func (h header) getChecksum() (checksum uint32, ok bool) {
+	return h.checksum, h.flags&flagChecksum != 0
+}
+
+func (h *header) setFragment(index uint8, count uint8) {
+	h.flags |= flagFragment
+	h.fragmentIndex = index
+	h.fragmentCount = count
+}
+
+// getFragment returns index of the fragment carried in the packet, and total
+// number of fragments of the frame; ok is false if the packet carries a whole
+// frame.
+func (h header) getFragment() (index uint8, count uint8, ok bool) {
+	return h.fragmentIndex, h.fragmentCount, h.flags&flagFragment != 0
+}
+
+func (h *header) setSequence(seq uint32) {
+	h.flags |= flagSequence
+	h.sequence = seq
+	if seq > 0xFFFF {
+		h.extendedIDs = true
+	}
+}
+
+// getSequence returns sequence number of the message carried in the frame;
+// ok is false if it's unknown.
+func (h header) getSequence() (seq uint32, ok bool) {
+	if h.getFrameType() == frameKF {
+		return h.frameID, true
+	}
+	return h.sequence, h.flags&flagSequence != 0
+}
+
+func (h *header) setChannel(channel uint16) {
+	h.flags |= flagChannel
+	h.channel = channel
+}
+
+// getChannel returns channel ID of the context the frame belongs to; ok is
+// false if the header doesn't carry one.
+func (h header) getChannel() (channel uint16, ok bool) {
+	return h.channel, h.flags&flagChannel != 0
+}
+
+func (h *header) setEpoch(epoch uint16) {
+	h.flags |= flagEpoch
+	h.epoch = epoch
+}
+
+// getEpoch returns epoch of the encoder that sent the KF; ok is false if the
+// header doesn't carry one.
+func (h header) getEpoch() (epoch uint16, ok bool) {
+	return h.epoch, h.flags&flagEpoch != 0
+}
+
+func (h *header) setRetransmit() {
+	h.flags |= flagRetransmit
+}
+
+// isRetransmit returns whether the frame is a retransmitted or repeated KF
+func (h header) isRetransmit() bool {
+	return h.flags&flagRetransmit != 0
+}
+
+func (h *header) setRefresh(id uint32, index uint8, count uint8, length uint32) {
+	h.flags |= flagRefresh
+	h.refreshID = id
+	h.refreshIndex = index
+	h.refreshCount = count
+	h.refreshLength = length
+	if id > 0xFFFF {
+		h.extendedIDs = true
+	}
+}
+
+// getRefresh returns ID of the new reference a frame carries a segment of,
+// the segment index, number of segments, and length of the reference; ok is
+// false if the frame doesn't carry one.
+func (h header) getRefresh() (id uint32, index uint8, count uint8, length uint32, ok bool) {
+	return h.refreshID, h.refreshIndex, h.refreshCount, h.refreshLength, h.flags&flagRefresh != 0
+}
+
+// setCompressed makes the header written as a compressed header; frameID
+// must be set to the reference KF ID
+func (h *header) setCompressed() {
+	h.compressed = true
+}
+
+// compressible returns whether the header can be written as a compressed
+// header, apart from requirements on the reference
+func (h header) compressible() bool {
+	return h.getFrameType() == frameDF && h.flags == 0 &&
+		h.getCompressionOptions() == 0 && h.getCompressionAlgorithm() < 8
+}
+
+// version returns the lowest version that can express the header
+func (h header) version() uint8 {
+	if h.extendedIDs {
+		return headerVersion2
+	}
+	if h.flags != 0 {
+		return headerVersion1
+	}
+	return headerVersion0
+}
+
+// length returns number of bytes writeTo writes
+func (h header) length() (l int) {
+	if h.compressed {
+		return 1
+	}
+	l = 4
+	if h.extendedIDs {
+		l += 2
+	}
+	if h.version() != headerVersion0 {
+		l++
+	}
+	if h.flags&flagChecksum != 0 {
+		l += 4
+	}
+	if h.flags&flagFragment != 0 {
+		l += 2
+	}
+	if h.flags&flagSequence != 0 {
+		l += 2
+		if h.extendedIDs {
+			l += 2
+		}
+	}
+	if h.flags&flagChannel != 0 {
+		l += 2
+	}
+	if h.flags&flagEpoch != 0 {
+		l += 2
+	}
+	if h.flags&flagRefresh != 0 {
+		l += 8
+		if h.extendedIDs {
+			l += 2
+		}
+	}
+	return
+}
+
 func (h header) writeTo(w io.Writer) (err error) {
-	err = binary.Write(w, binary.BigEndian, &h.frameType)
+	if h.compressed {
+		if !h.compressible() {
+			err = errors.New("header cannot be compressed")
+			return
+		}
+		first := compressedHeaderMark | refCheck(h.frameID)<<3 | uint8(h.getCompressionAlgorithm())
+		err = binary.Write(w, binary.BigEndian, &first)
+		return
+	}
+	first := h.version()<<4 | h.frameType&0x0F
+	err = binary.Write(w, binary.BigEndian, &first)
 	if err != nil {
 		return
 	}
@@ -75,25 +404,195 @@ func (h header) writeTo(w io.Writer) (err error) {
 	if err != nil {
 		return
 	}
-	err = binary.Write(w, binary.BigEndian, &h.frameID)
+	if h.extendedIDs {
+		err = binary.Write(w, binary.BigEndian, &h.frameID)
+	} else {
+		err = binary.Write(w, binary.BigEndian, uint16(h.frameID))
+	}
+	if err != nil {
+		return
+	}
+	if h.version() == headerVersion0 {
+		return
+	}
+	err = binary.Write(w, binary.BigEndian, &h.flags)
 	if err != nil {
 		return
 	}
+	if h.flags&flagChecksum != 0 {
+		err = binary.Write(w, binary.BigEndian, &h.checksum)
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagFragment != 0 {
+		err = binary.Write(w, binary.BigEndian, &h.fragmentIndex)
+		if err != nil {
+			return
+		}
+		err = binary.Write(w, binary.BigEndian, &h.fragmentCount)
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagSequence != 0 {
+		if h.extendedIDs {
+			err = binary.Write(w, binary.BigEndian, &h.sequence)
+		} else {
+			err = binary.Write(w, binary.BigEndian, uint16(h.sequence))
+		}
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagChannel != 0 {
+		err = binary.Write(w, binary.BigEndian, &h.channel)
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagEpoch != 0 {
+		err = binary.Write(w, binary.BigEndian, &h.epoch)
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagRefresh != 0 {
+		if h.extendedIDs {
+			err = binary.Write(w, binary.BigEndian, &h.refreshID)
+		} else {
+			err = binary.Write(w, binary.BigEndian, uint16(h.refreshID))
+		}
+		if err != nil {
+			return
+		}
+		err = binary.Write(w, binary.BigEndian, []uint8{h.refreshIndex, h.refreshCount})
+		if err != nil {
+			return
+		}
+		err = binary.Write(w, binary.BigEndian, &h.refreshLength)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
 func (h *header) readFrom(r io.Reader) (err error) {
-	err = binary.Read(r, binary.BigEndian, &h.frameType)
+	var first uint8
+	err = binary.Read(r, binary.BigEndian, &first)
 	if err != nil {
 		return
 	}
+	if first&compressedHeaderMark == compressedHeaderMark {
+		h.compressed = true
+		h.frameType = frameDF
+		h.frameID = uint32(first>>3) & 0x07
+		h.setCompressionAlgorithm(CompressionAlgorithm(first & 0x07))
+		return
+	}
+	version := first >> 4
+	if version > maxHeaderVersion {
+		err = &UnsupportedVersionError{Version: version}
+		return
+	}
+	h.frameType = first & 0x0F
+	switch h.frameType {
+	case frameKF, frameDF, frameFeedback, frameRequest, frameParity:
+	default:
+		err = fmt.Errorf("unknown frame type %d", h.frameType)
+		return
+	}
 	err = binary.Read(r, binary.BigEndian, &h.compressionOptions)
 	if err != nil {
 		return
 	}
-	err = binary.Read(r, binary.BigEndian, &h.frameID)
+	h.extendedIDs = version == headerVersion2
+	if err = readID(r, h.extendedIDs, &h.frameID); err != nil {
+		return
+	}
+	if version == headerVersion0 {
+		return
+	}
+	err = binary.Read(r, binary.BigEndian, &h.flags)
 	if err != nil {
 		return
 	}
+	if h.flags&^knownFlags != 0 {
+		err = fmt.Errorf("unknown header flags 0x%02x", h.flags&^knownFlags)
+		return
+	}
+	if h.flags&flagChecksum != 0 {
+		err = binary.Read(r, binary.BigEndian, &h.checksum)
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagFragment != 0 {
+		err = binary.Read(r, binary.BigEndian, &h.fragmentIndex)
+		if err != nil {
+			return
+		}
+		err = binary.Read(r, binary.BigEndian, &h.fragmentCount)
+		if err != nil {
+			return
+		}
+		if h.fragmentIndex >= h.fragmentCount {
+			err = fmt.Errorf("invalid fragment %d of %d", h.fragmentIndex, h.fragmentCount)
+			return
+		}
+	}
+	if h.flags&flagSequence != 0 {
+		if err = readID(r, h.extendedIDs, &h.sequence); err != nil {
+			return
+		}
+	}
+	if h.flags&flagChannel != 0 {
+		err = binary.Read(r, binary.BigEndian, &h.channel)
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagEpoch != 0 {
+		err = binary.Read(r, binary.BigEndian, &h.epoch)
+		if err != nil {
+			return
+		}
+	}
+	if h.flags&flagRefresh != 0 {
+		if err = readID(r, h.extendedIDs, &h.refreshID); err != nil {
+			return
+		}
+		err = binary.Read(r, binary.BigEndian, &h.refreshIndex)
+		if err != nil {
+			return
+		}
+		err = binary.Read(r, binary.BigEndian, &h.refreshCount)
+		if err != nil {
+			return
+		}
+		if h.refreshIndex >= h.refreshCount {
+			err = fmt.Errorf("invalid refresh segment %d of %d", h.refreshIndex, h.refreshCount)
+			return
+		}
+		err = binary.Read(r, binary.BigEndian, &h.refreshLength)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// readID reads a 32-bit ID if extended is true, or a 16-bit one otherwise
+func readID(r io.Reader, extended bool, id *uint32) (err error) {
+	if extended {
+		err = binary.Read(r, binary.BigEndian, id)
+		return
+	}
+	var short uint16
+	if err = binary.Read(r, binary.BigEndian, &short); err != nil {
+		return
+	}
+	*id = uint32(short)
 	return
 }
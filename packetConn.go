@@ -0,0 +1,261 @@
+package ictl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// DatagramError is returned by PacketConn.ReadFrom when a received datagram
+// cannot be decoded. The PacketConn remains usable.
+type DatagramError struct {
+	Addr net.Addr // where the datagram came from
+	Err  error
+}
+
+func (e *DatagramError) Error() string {
+	return fmt.Sprintf("undecodable datagram from %v: %v", e.Addr, e.Err)
+}
+
+// PacketConn runs ICTL over a net.PacketConn. Plain application messages
+// written with WriteTo are encoded in the context of destination address,
+// and datagrams read with ReadFrom are decoded in the context of source
+// address. Feedback reports, resync requests and NACKs received from peers
+// are handled transparently; NACKs are answered by retransmitting KFs.
+type PacketConn struct {
+	net.PacketConn
+
+	endpoint     *endpoint
+	label        string
+	autoFeedback int32        // accessed atomically
+	autoResync   int32        // accessed atomically
+	autoNACK     int32        // accessed atomically
+	onSendError  atomic.Value // func(net.Addr, error)
+}
+
+// NewPacketConn wraps conn with an Endpoint created from config. Contexts are
+// named after remote addresses, prefixed by label and "@" if label is not
+// empty, so that multiple PacketConns can share the same naming scheme in
+// config overrides.
+func NewPacketConn(conn net.PacketConn, config EndpointConfig, label string) *PacketConn {
+	return &PacketConn{
+		PacketConn: conn,
+		endpoint:   NewEndpoint(config).(*endpoint),
+		label:      label,
+	}
+}
+
+// Endpoint returns the Endpoint used by c, e.g., to set context config
+// overrides.
+func (c *PacketConn) Endpoint() Endpoint {
+	return c.endpoint
+}
+
+// ContextName returns name of the context used for messages to and from addr.
+func (c *PacketConn) ContextName(addr net.Addr) string {
+	if c.label == "" {
+		return addr.String()
+	}
+	return c.label + "@" + addr.String()
+}
+
+// SetAutoFeedback sets whether a feedback report is sent back to the peer
+// each time a KF is received from it.
+func (c *PacketConn) SetAutoFeedback(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.autoFeedback, v)
+}
+
+// SetAutoResync sets whether a resync request is sent back to the peer when
+// a datagram from it cannot be decoded due to missing reference. Requests are
+// rate limited as described in Endpoint.ResyncRequest.
+func (c *PacketConn) SetAutoResync(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.autoResync, v)
+}
+
+// SetAutoNACK sets whether a NACK is sent back to the peer when a datagram
+// from it cannot be decoded due to missing reference. NACKs are rate limited
+// as described in Endpoint.NACK.
+func (c *PacketConn) SetAutoNACK(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.autoNACK, v)
+}
+
+// SetSendErrorHandler sets a function called with errors of sends ReadFrom
+// makes on its own, i.e., automatic feedback reports, resync requests and
+// NACKs, and KFs retransmitted in answer to NACKs. Such errors don't affect
+// the result of ReadFrom. handler must not block; set to nil to ignore the
+// errors, which is the default.
+func (c *PacketConn) SetSendErrorHandler(handler func(addr net.Addr, err error)) {
+	c.onSendError.Store(handler)
+}
+
+// sendError passes err, if any, of a send made by ReadFrom to addr to the
+// handler set with SetSendErrorHandler
+func (c *PacketConn) sendError(addr net.Addr, err error) {
+	if err == nil {
+		return
+	}
+	if handler, _ := c.onSendError.Load().(func(net.Addr, error)); handler != nil {
+		handler(addr, err)
+	}
+}
+
+// SendFeedback sends a feedback report for messages received from addr.
+func (c *PacketConn) SendFeedback(addr net.Addr) (err error) {
+	var report *ReusableSlice
+	if report, err = c.endpoint.Feedback(c.ContextName(addr)); err != nil {
+		return
+	}
+	defer report.Done()
+	_, err = c.PacketConn.WriteTo(report.Slice(), addr)
+	return
+}
+
+// WriteTo encodes p and sends the resulting packets to addr. Large messages
+// are sent in fragments, up to MaxMessageSize.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	var packets []*ReusableSlice
+	if packets, err = c.endpoint.EncodeFragments(c.ContextName(addr), p, 0); err != nil {
+		return
+	}
+	defer releasePackets(packets)
+	for _, packet := range packets {
+		if _, err = c.PacketConn.WriteTo(packet.Slice(), addr); err != nil {
+			return
+		}
+	}
+	n = len(p)
+	return
+}
+
+// SendResyncRequest sends a resync request to addr if the decoder of messages
+// from addr needs one; see Endpoint.ResyncRequest.
+func (c *PacketConn) SendResyncRequest(addr net.Addr) (err error) {
+	var request *ReusableSlice
+	if request, err = c.endpoint.ResyncRequest(c.ContextName(addr)); err != nil || request == nil {
+		return
+	}
+	defer request.Done()
+	_, err = c.PacketConn.WriteTo(request.Slice(), addr)
+	return
+}
+
+// SendNACK sends a NACK to addr if the decoder of messages from addr has
+// found KFs missing; see Endpoint.NACK.
+func (c *PacketConn) SendNACK(addr net.Addr) (err error) {
+	var request *ReusableSlice
+	if request, err = c.endpoint.NACK(c.ContextName(addr)); err != nil || request == nil {
+		return
+	}
+	defer request.Done()
+	_, err = c.PacketConn.WriteTo(request.Slice(), addr)
+	return
+}
+
+// handleRequest handles a request from addr, retransmitting KFs if it's a
+// NACK. Errors of sending retransmitted KFs go to the handler set with
+// SetSendErrorHandler.
+func (c *PacketConn) handleRequest(context string, request []byte, addr net.Addr) (err error) {
+	var kind uint8
+	if kind, _, _, err = decodeRequest(c.endpoint.pool, request); err != nil {
+		return
+	}
+	if kind != requestNACK {
+		return c.endpoint.HandleFeedback(context, request)
+	}
+	var packets []*ReusableSlice
+	if packets, err = c.endpoint.Retransmit(context, request); err != nil {
+		return
+	}
+	defer releasePackets(packets)
+	for _, packet := range packets {
+		_, sendErr := c.PacketConn.WriteTo(packet.Slice(), addr)
+		c.sendError(addr, sendErr)
+	}
+	return
+}
+
+// ReadFrom reads a datagram and decodes it into p. Feedback reports and
+// requests are consumed without returning, and so are retransmitted KFs that
+// have been received before. If a datagram cannot be decoded, err is a
+// *DatagramError. If the message is longer than p, the first len(p) bytes are
+// returned along with io.ErrShortBuffer, and the rest is discarded. Errors of
+// sends ReadFrom makes on its own are not returned; see SetSendErrorHandler.
+func (c *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buf := c.endpoint.pool.get()
+	defer buf.Done()
+	for {
+		var l int
+		if l, addr, err = c.PacketConn.ReadFrom(buf.Slice()[:buf.Cap()]); err != nil {
+			return
+		}
+		buf.Resize(l)
+
+		var h header
+		if err = h.readFrom(bytes.NewReader(buf.Slice())); err != nil {
+			err = &DatagramError{Addr: addr, Err: err}
+			return
+		}
+		context := c.ContextName(addr)
+		if h.getFrameType() == frameFeedback {
+			if err = c.endpoint.HandleFeedback(context, buf.Slice()); err != nil {
+				err = &DatagramError{Addr: addr, Err: err}
+				return
+			}
+			continue
+		}
+		if h.getFrameType() == frameRequest {
+			if err = c.handleRequest(context, buf.Slice(), addr); err != nil {
+				err = &DatagramError{Addr: addr, Err: err}
+				return
+			}
+			continue
+		}
+
+		var data *ReusableSlice
+		if data, err = c.endpoint.Decode(context, buf.Slice()); err != nil {
+			if atomic.LoadInt32(&c.autoNACK) != 0 {
+				c.sendError(addr, c.SendNACK(addr))
+			}
+			if atomic.LoadInt32(&c.autoResync) != 0 {
+				c.sendError(addr, c.SendResyncRequest(addr))
+			}
+			err = &DatagramError{Addr: addr, Err: err}
+			return
+		}
+		if data == nil { // fragment of an incomplete message, KF received before, or parity frame
+			continue
+		}
+		if n = copy(p, data.Slice()); n < len(data.Slice()) {
+			err = io.ErrShortBuffer
+		}
+		data.Done()
+
+		// data of a parity frame is a rebuilt KF
+		isKF := h.getFrameType() == frameKF || h.getFrameType() == frameParity
+		if isKF && atomic.LoadInt32(&c.autoFeedback) != 0 {
+			c.sendError(addr, c.SendFeedback(addr))
+		}
+		return
+	}
+}
+
+// Close closes the underlying connection and the Endpoint.
+func (c *PacketConn) Close() (err error) {
+	err = c.PacketConn.Close()
+	c.endpoint.Close()
+	return
+}
@@ -0,0 +1,152 @@
+package ictl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenLoopback(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening on loopback: %v\n", err)
+	}
+	return conn
+}
+
+func TestPacketConn(t *testing.T) {
+	config := DefaultEndpointConfig().SetConfidenceLookback(4)
+	sender := NewPacketConn(listenLoopback(t), config, "test")
+	defer sender.Close()
+	receiver := NewPacketConn(listenLoopback(t), config, "test")
+	defer receiver.Close()
+	receiver.SetAutoFeedback(true)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 2000)
+	for i := 0; i < 20; i++ {
+		msg := []byte(fmt.Sprintf("vehicle status #%d: speed=%d heading=%d", i, 40+i%3, 180))
+		if _, err := sender.WriteTo(msg, receiver.LocalAddr()); err != nil {
+			t.Fatalf("calling sender.WriteTo() error: %v\n", err)
+		}
+		n, addr, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("calling receiver.ReadFrom() error: %v\n", err)
+		}
+		if addr.String() != sender.LocalAddr().String() {
+			t.Fatalf("message from %v; expected %v\n", addr, sender.LocalAddr())
+		}
+		if !bytes.Equal(msg, buf[:n]) {
+			t.Fatalf("received data is not equal to sent data: %q != %q\n", msg, buf[:n])
+		}
+	}
+
+	// garbage datagram is reported, and doesn't break the connection
+	for _, garbage := range [][]byte{{0xff}, {0x01, 0x0f, 0x00, 0x00, 0x42}} {
+		if _, err := sender.PacketConn.WriteTo(garbage, receiver.LocalAddr()); err != nil {
+			t.Fatalf("error writing raw datagram: %v\n", err)
+		}
+		if _, _, err := receiver.ReadFrom(buf); err == nil {
+			t.Fatalf("undecodable datagram should produce an error\n")
+		} else if _, ok := err.(*DatagramError); !ok {
+			t.Fatalf("expected *DatagramError; got %T: %v\n", err, err)
+		}
+	}
+	msg := []byte("after garbage")
+	if _, err := sender.WriteTo(msg, receiver.LocalAddr()); err != nil {
+		t.Fatalf("calling sender.WriteTo() error: %v\n", err)
+	}
+	if n, _, err := receiver.ReadFrom(buf); err != nil {
+		t.Fatalf("calling receiver.ReadFrom() error: %v\n", err)
+	} else if !bytes.Equal(msg, buf[:n]) {
+		t.Fatalf("received data is not equal to sent data: %q != %q\n", msg, buf[:n])
+	}
+}
+
+// receiveOnlyConn is a net.PacketConn that fails to send anything
+type receiveOnlyConn struct {
+	net.PacketConn
+}
+
+func (c receiveOnlyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return 0, errors.New("send failed")
+}
+
+func TestPacketConnErrors(t *testing.T) {
+	config := DefaultEndpointConfig()
+	sender := NewPacketConn(listenLoopback(t), config, "test")
+	defer sender.Close()
+	receiver := NewPacketConn(receiveOnlyConn{listenLoopback(t)}, config, "test")
+	defer receiver.Close()
+	receiver.SetAutoFeedback(true)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var sendErrors []error
+	receiver.SetSendErrorHandler(func(addr net.Addr, err error) {
+		sendErrors = append(sendErrors, err)
+	})
+
+	// a failed feedback report doesn't fail the KF it's sent for
+	msg := []byte("vehicle status #0: speed=40 heading=180")
+	if _, err := sender.WriteTo(msg, receiver.LocalAddr()); err != nil {
+		t.Fatalf("calling sender.WriteTo() error: %v\n", err)
+	}
+	buf := make([]byte, 2000)
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("calling receiver.ReadFrom() error: %v\n", err)
+	}
+	if !bytes.Equal(msg, buf[:n]) {
+		t.Fatalf("received data is not equal to sent data: %q != %q\n", msg, buf[:n])
+	}
+	if len(sendErrors) != 1 {
+		t.Fatalf("expected the failed feedback report to be reported; got %v\n", sendErrors)
+	}
+
+	// a message longer than the buffer is truncated
+	if _, err = sender.WriteTo(msg, receiver.LocalAddr()); err != nil {
+		t.Fatalf("calling sender.WriteTo() error: %v\n", err)
+	}
+	if n, _, err = receiver.ReadFrom(buf[:10]); err != io.ErrShortBuffer || n != 10 || !bytes.Equal(msg[:10], buf[:n]) {
+		t.Fatalf("expected %q and io.ErrShortBuffer; got %q, %v\n", msg[:10], buf[:n], err)
+	}
+}
+
+func TestPacketConnNACK(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8)
+	sender := NewPacketConn(listenLoopback(t), config, "test")
+	defer sender.Close()
+	receiver := NewPacketConn(listenLoopback(t), config, "test")
+	defer receiver.Close()
+	receiver.SetAutoNACK(true)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the first KF is lost
+	lost := []byte("vehicle status #0: speed=40 heading=180")
+	packets, err := sender.Endpoint().EncodeFragments(sender.ContextName(receiver.LocalAddr()), lost, 0)
+	if err != nil {
+		t.Fatalf("calling EncodeFragments() error: %v\n", err)
+	}
+	releasePackets(packets)
+	if _, err = sender.WriteTo([]byte("vehicle status #1: speed=41 heading=180"), receiver.LocalAddr()); err != nil {
+		t.Fatalf("calling sender.WriteTo() error: %v\n", err)
+	}
+	buf := make([]byte, 2000)
+	if _, _, err = receiver.ReadFrom(buf); err == nil {
+		t.Fatalf("expected DF with missing reference to fail\n")
+	}
+
+	// sender answers the NACK while reading
+	go sender.ReadFrom(make([]byte, 2000))
+
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("calling receiver.ReadFrom() error: %v\n", err)
+	}
+	if !bytes.Equal(lost, buf[:n]) {
+		t.Fatalf("received %q; expected retransmitted %q\n", buf[:n], lost)
+	}
+}
@@ -0,0 +1,178 @@
+package ictl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// FrameType is the type of frame carried in an ICTL packet.
+type FrameType uint8
+
+// Frame types
+const (
+	FrameKF       FrameType = FrameType(frameKF)
+	FrameDF       FrameType = FrameType(frameDF)
+	FrameFeedback FrameType = FrameType(frameFeedback)
+	FrameRequest  FrameType = FrameType(frameRequest)
+	FrameParity   FrameType = FrameType(frameParity)
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameKF:
+		return "KF"
+	case FrameDF:
+		return "DF"
+	case FrameFeedback:
+		return "feedback"
+	case FrameRequest:
+		return "request"
+	case FrameParity:
+		return "parity"
+	}
+	return fmt.Sprintf("frame type %d", uint8(t))
+}
+
+func (a CompressionAlgorithm) String() string {
+	switch a {
+	case CANone:
+		return "none"
+	case CAFlate:
+		return "flate"
+	case CAGzip:
+		return "gzip"
+	case CALzw:
+		return "lzw"
+	case CAZlib:
+		return "zlib"
+	case CAAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("algorithm %d", uint8(a))
+}
+
+// PacketInfo describes an ICTL packet, as parsed from its header by
+// ParsePacket.
+type PacketInfo struct {
+	// wire format version of the header; meaningless if Compressed
+	Version    uint8
+	Compressed bool // 1-byte compressed header
+
+	FrameType FrameType
+
+	// ID of the KF in a KF, ID of the reference KF in a DF, number of KF IDs
+	// in a feedback report or a NACK, or ID of the missing reference in a
+	// resync request. With a compressed header, the reference is implied by
+	// decoder state, and FrameID is 0.
+	FrameID uint32
+
+	CompressionAlgorithm CompressionAlgorithm
+	CompressionOptions   uint8 // higher 4 bits
+
+	HeaderLength  int
+	PayloadLength int // compressed payload, i.e., what follows the header
+
+	// optional header fields; each is meaningful only if its Has* is true
+	Checksum      uint32
+	HasChecksum   bool
+	FragmentIndex uint8
+	FragmentCount uint8
+	HasFragment   bool
+	Sequence      uint32 // also set for KFs, from FrameID
+	HasSequence   bool
+	Channel       uint16
+	HasChannel    bool
+	Epoch         uint16
+	HasEpoch      bool
+	ExtendedIDs   bool
+	LengthPrefix  bool // DF data starts with the message length
+	Retransmitted bool // KF retransmitted in answer to a NACK, or repeated
+
+	// segment of a new reference carried in a DF; see SetRefreshSlices
+	RefreshID     uint32
+	RefreshIndex  uint8
+	RefreshCount  uint8
+	RefreshLength uint32
+	HasRefresh    bool
+}
+
+// ParsePacket parses header of packet without decoding it, which doesn't
+// need any decoder state. It fails on packets that decoders would reject for
+// their header.
+func ParsePacket(packet []byte) (info PacketInfo, err error) {
+	var h header
+	var rest []byte
+	if h, rest, err = readHeader(packet); err != nil {
+		return
+	}
+	info.Compressed = h.compressed
+	if !h.compressed {
+		info.Version = h.version()
+		info.FrameID = h.getFrameID()
+	}
+	info.FrameType = FrameType(h.getFrameType())
+	info.CompressionAlgorithm = h.getCompressionAlgorithm()
+	info.CompressionOptions = h.getCompressionOptions()
+	info.HeaderLength = len(packet) - len(rest)
+	info.PayloadLength = len(rest)
+	info.Checksum, info.HasChecksum = h.getChecksum()
+	info.FragmentIndex, info.FragmentCount, info.HasFragment = h.getFragment()
+	if !h.compressed {
+		info.Sequence, info.HasSequence = h.getSequence()
+	}
+	info.Channel, info.HasChannel = h.getChannel()
+	info.Epoch, info.HasEpoch = h.getEpoch()
+	info.ExtendedIDs = h.extendedIDs
+	info.LengthPrefix = h.hasLengthPrefix()
+	info.Retransmitted = h.isRetransmit()
+	info.RefreshID, info.RefreshIndex, info.RefreshCount, info.RefreshLength, info.HasRefresh = h.getRefresh()
+	return
+}
+
+// String formats info in one line, e.g., for logs.
+func (info PacketInfo) String() string {
+	var b bytes.Buffer
+	if info.Compressed {
+		fmt.Fprintf(&b, "%v compressed-header", info.FrameType)
+	} else {
+		fmt.Fprintf(&b, "%v v%d", info.FrameType, info.Version)
+		switch info.FrameType {
+		case FrameDF:
+			fmt.Fprintf(&b, " ref=%d", info.FrameID)
+		case FrameFeedback:
+			fmt.Fprintf(&b, " ids=%d", info.FrameID)
+		default:
+			fmt.Fprintf(&b, " id=%d", info.FrameID)
+		}
+	}
+	if info.Retransmitted {
+		b.WriteString(" retransmitted")
+	}
+	fmt.Fprintf(&b, " %v", info.CompressionAlgorithm)
+	if info.CompressionOptions != 0 {
+		fmt.Fprintf(&b, "(0x%02x)", info.CompressionOptions)
+	}
+	if info.HasSequence && info.FrameType != FrameKF {
+		fmt.Fprintf(&b, " seq=%d", info.Sequence)
+	}
+	if info.HasFragment {
+		fmt.Fprintf(&b, " fragment=%d/%d", info.FragmentIndex+1, info.FragmentCount)
+	}
+	if info.HasChannel {
+		fmt.Fprintf(&b, " channel=%d", info.Channel)
+	}
+	if info.HasEpoch {
+		fmt.Fprintf(&b, " epoch=%d", info.Epoch)
+	}
+	if info.LengthPrefix {
+		b.WriteString(" length-prefixed")
+	}
+	if info.HasRefresh {
+		fmt.Fprintf(&b, " refresh=%d segment=%d/%d", info.RefreshID, info.RefreshIndex+1, info.RefreshCount)
+	}
+	if info.HasChecksum {
+		fmt.Fprintf(&b, " crc32c=%08x", info.Checksum)
+	}
+	fmt.Fprintf(&b, " header=%dB payload=%dB", info.HeaderLength, info.PayloadLength)
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package ictl
+
+import "testing"
+
+func TestParsePacket(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(3).SetCompressionAlgorithm(CANone).SetSequenceNumbers(true).SetChannelIDs(true)
+	sender := NewEndpoint(config)
+	if err := sender.RegisterChannel("test", 3); err != nil {
+		t.Fatalf("calling sender.RegisterChannel() error: %v\n", err)
+	}
+
+	for i, c := range []struct {
+		message   string
+		frameType FrameType
+		frameID   uint32
+		seq       uint32
+		str       string
+	}{
+		{"hello world", FrameKF, 0, 0, "KF v1 id=0 none channel=3 header=7B payload=11B"},
+		{"hello world", FrameDF, 0, 1, "DF v1 ref=0 none seq=1 channel=3 header=9B payload=0B"},
+		{"hello", FrameDF, 0, 2, "DF v1 ref=0 none seq=2 channel=3 length-prefixed header=9B payload=1B"},
+	} {
+		packet, err := sender.Encode("test", []byte(c.message), 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		info, err := ParsePacket(packet.Slice())
+		length := len(packet.Slice())
+		packet.Done()
+		if err != nil {
+			t.Fatalf("calling ParsePacket() error: %v\n", err)
+		}
+		if info.FrameType != c.frameType || info.FrameID != c.frameID || !info.HasSequence || info.Sequence != c.seq {
+			t.Fatalf("packet #%d: unexpected %+v\n", i, info)
+		}
+		if !info.HasChannel || info.Channel != 3 || info.HeaderLength+info.PayloadLength != length {
+			t.Fatalf("packet #%d: unexpected %+v\n", i, info)
+		}
+		if info.String() != c.str {
+			t.Fatalf("packet #%d: got %q; expected %q\n", i, info.String(), c.str)
+		}
+	}
+
+	if _, err := ParsePacket([]byte{0x05, 0x00, 0x00, 0x00}); err == nil {
+		t.Fatalf("ParsePacket() should fail on unknown frame type\n")
+	}
+}
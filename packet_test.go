@@ -0,0 +1,152 @@
+package ictl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	var basic header
+	basic.setFrameType(frameDF)
+	basic.setFrameID(0x1234)
+	basic.setCompressionAlgorithm(CAFlate)
+
+	withChecksum := basic
+	withChecksum.setChecksum(0xdeadbeef)
+
+	withAll := withChecksum
+	withAll.setLengthPrefix()
+	withAll.setFragment(1, 3)
+	withAll.setSequence(0x4321)
+	withAll.setChannel(0xbeef)
+	withAll.setEpoch(0x5678)
+	withAll.setRefresh(0x2345, 1, 4, 300)
+
+	extended := withAll
+	extended.setFrameID(0x12345678)
+
+	for _, h := range []header{basic, withChecksum, withAll, extended} {
+		buf := new(bytes.Buffer)
+		if err := h.writeTo(buf); err != nil {
+			t.Fatalf("error writing header: %v\n", err)
+		}
+		if buf.Len() != h.length() {
+			t.Fatalf("header written in %d bytes; length() is %d\n", buf.Len(), h.length())
+		}
+		var got header
+		if err := got.readFrom(buf); err != nil {
+			t.Fatalf("error reading header: %v\n", err)
+		}
+		if got != h {
+			t.Fatalf("header read %+v != written %+v\n", got, h)
+		}
+	}
+
+	compressed := basic
+	compressed.setCompressed()
+	buf := new(bytes.Buffer)
+	if err := compressed.writeTo(buf); err != nil {
+		t.Fatalf("error writing compressed header: %v\n", err)
+	}
+	if buf.Len() != 1 || compressed.length() != 1 {
+		t.Fatalf("compressed header written in %d bytes; length() is %d\n", buf.Len(), compressed.length())
+	}
+	var got header
+	if err := got.readFrom(buf); err != nil {
+		t.Fatalf("error reading compressed header: %v\n", err)
+	}
+	if !got.compressed || got.getFrameType() != frameDF || got.getCompressionAlgorithm() != CAFlate || got.getFrameID() != uint32(refCheck(basic.getFrameID())) {
+		t.Fatalf("unexpected compressed header: %+v\n", got)
+	}
+	if withChecksum.setCompressed(); withChecksum.writeTo(new(bytes.Buffer)) == nil {
+		t.Fatalf("header with optional fields should not be compressed\n")
+	}
+
+	if extended.version() != headerVersion2 {
+		t.Fatalf("header with 32-bit frame ID should be version 2; got %d\n", extended.version())
+	}
+	if basic.length() != 4 {
+		t.Fatalf("header without flags should be 4 bytes; got %d\n", basic.length())
+	}
+}
+
+func TestHeaderValidation(t *testing.T) {
+	// a version 0 packet as produced by the first releases
+	var h header
+	if err := h.readFrom(bytes.NewReader([]byte{0x01, 0x01, 0x00, 0x2a})); err != nil {
+		t.Fatalf("error reading version 0 header: %v\n", err)
+	}
+	if h.getFrameType() != frameKF || h.getFrameID() != 42 || h.getCompressionAlgorithm() != CAFlate {
+		t.Fatalf("unexpected version 0 header: %+v\n", h)
+	}
+
+	err := h.readFrom(bytes.NewReader([]byte{0xb1, 0x01, 0x00, 0x2a}))
+	if verr, ok := err.(*UnsupportedVersionError); !ok || verr.Version != 0xb {
+		t.Fatalf("expected *UnsupportedVersionError with version 11; got %v\n", err)
+	}
+
+	for _, packet := range [][]byte{
+		{0x05, 0x01, 0x00, 0x2a}, // unknown frame type
+		{0x12, 0x01, 0x00, 0x2a, 0x80, 0x00, 0x08, 0x04, 0x04, 0x00, 0x00, 0x01, 0x00}, // refresh segment out of range
+	} {
+		if err = h.readFrom(bytes.NewReader(packet)); err == nil {
+			t.Fatalf("header %x should be rejected\n", packet)
+		}
+	}
+}
+
+func TestWireCompatibility(t *testing.T) {
+	messages := []string{
+		"speed=40 heading=180",
+		"speed=41 heading=180",
+		"speed=41 heading=181",
+		"speed=42 heading=180 brake",
+		"speed=43 heading=179",
+	}
+	// produced with EncoderCycleLength 4 by the first releases
+	legacy := []string{
+		"0100000073706565643d34302068656164696e673d313830",
+		"0203000080002050300006090781c040",
+		"0203000080002050300006090781006020",
+		"020300008000205030000a090781880c472309accb01",
+		"0100000473706565643d34332068656164696e673d313739",
+	}
+	config := DefaultEndpointConfig().SetEncoderCycleLength(4)
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	for i, h := range legacy {
+		packet, _ := hex.DecodeString(h)
+		data, err := receiver.Decode("test", packet)
+		if err != nil {
+			t.Fatalf("packet #%d: calling Decode() error: %v\n", i, err)
+		}
+		if string(data.Slice()) != messages[i] {
+			t.Fatalf("packet #%d: decoded %q; expected %q\n", i, data.Slice(), messages[i])
+		}
+		data.Done()
+	}
+
+	// with no optional feature enabled, packets stay readable by the first
+	// releases, which only know version 0; a message shorter than its
+	// reference needs the length prefix flag, which they reject
+	sender := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(8))
+	defer sender.Close()
+	for i, m := range append(messages[:4:4], "speed=4") {
+		packet, err := sender.Encode("test", []byte(m), 0)
+		if err != nil {
+			t.Fatalf("message #%d: calling Encode() error: %v\n", i, err)
+		}
+		version := packet.Slice()[0] >> 4
+		var h header
+		err = h.readFrom(bytes.NewReader(packet.Slice()))
+		packet.Done()
+		if err != nil {
+			t.Fatalf("message #%d: error reading header: %v\n", i, err)
+		}
+		shorter := i == 4
+		if (version != headerVersion0) != shorter || h.hasLengthPrefix() != shorter {
+			t.Fatalf("message #%d: unexpected header version %d: %+v\n", i, version, h)
+		}
+	}
+}
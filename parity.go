@@ -0,0 +1,211 @@
+package ictl
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// max number of KFs covered by a parity frame
+const maxParityGroupSize = 8
+
+// Parity frames are carried in frames of type frameParity, sent by an encoder
+// after every group of ParityGroupSize KFs, so that the decoder can rebuild
+// any one KF of the group that is lost. The frameID field of the header is the
+// ID of the last KF of the group. The (uncompressed) payload starts with one
+// byte of the number of KFs in the group, followed by, for each KF, its ID
+// (big-endian uint16, or uint32 if the header has extended IDs), the length of
+// its message (big-endian uint32) and CRC32C of its message (big-endian
+// uint32). The rest is the XOR of the messages, each padded with zeros to the
+// length of the longest one.
+
+// parityMember describes a KF covered by a parity frame
+type parityMember struct {
+	id       uint32
+	length   int
+	checksum uint32
+}
+
+// parityGroupLength returns size of the payload of a parity frame with header
+// h, before the XOR of the messages
+func parityGroupLength(h header, count int) int {
+	return 1 + count*(feedbackIDSize(h)+8)
+}
+
+// buildParity writes the payload of a parity frame with header h covering
+// KFs ids with messages kfs into payload
+func buildParity(payload *ReusableSlice, h header, ids []uint32, kfs [][]byte) (err error) {
+	longest := 0
+	for _, kf := range kfs {
+		if len(kf) > longest {
+			longest = len(kf)
+		}
+	}
+	size := feedbackIDSize(h)
+	l := parityGroupLength(h, len(ids))
+	if l+longest > payload.Cap() {
+		err = ErrMessageTooLarge
+		return
+	}
+	payload.Resize(l + longest)
+	p := payload.Slice()
+	p[0] = uint8(len(ids))
+	for i, id := range ids {
+		member := p[1+i*(size+8):]
+		if size == 4 {
+			binary.BigEndian.PutUint32(member, id)
+		} else {
+			binary.BigEndian.PutUint16(member, uint16(id))
+		}
+		binary.BigEndian.PutUint32(member[size:], uint32(len(kfs[i])))
+		binary.BigEndian.PutUint32(member[size+4:], crc32.Checksum(kfs[i], crc32c))
+	}
+	parity := p[l:]
+	for i := range parity {
+		parity[i] = 0
+	}
+	for _, kf := range kfs {
+		xorInto(parity, kf)
+	}
+	return
+}
+
+// parseParity parses the payload of a parity frame with header h
+func parseParity(h header, payload []byte) (members []parityMember, parity []byte, err error) {
+	if len(payload) < 1 || payload[0] == 0 || payload[0] > maxParityGroupSize {
+		err = errors.New("malformed parity frame")
+		return
+	}
+	size := feedbackIDSize(h)
+	l := parityGroupLength(h, int(payload[0]))
+	if len(payload) < l {
+		err = errors.New("malformed parity frame")
+		return
+	}
+	parity = payload[l:]
+	members = make([]parityMember, payload[0])
+	for i := range members {
+		member := payload[1+i*(size+8):]
+		if size == 4 {
+			members[i].id = binary.BigEndian.Uint32(member)
+		} else {
+			members[i].id = uint32(binary.BigEndian.Uint16(member))
+		}
+		members[i].length = int(binary.BigEndian.Uint32(member[size:]))
+		members[i].checksum = binary.BigEndian.Uint32(member[size+4:])
+		if members[i].length > len(parity) {
+			err = errors.New("malformed parity frame")
+			return
+		}
+	}
+	return
+}
+
+// xorInto XORs src into the beginning of dst, which must be at least as long
+func xorInto(dst []byte, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// sentKFForParity records KF id just sent, and returns packets of a parity
+// frame if it completes a group. The parity frame is fragmented if needed,
+// regardless of how many packets the KF could be split into, since it's sent
+// separately anyway. Groups whose KFs are no longer cached are dropped.
+//
+// Caller must hold e.mu.
+func (e *encoder) sentKFForParity(id uint32) (packets []*ReusableSlice) {
+	if e.parityGroupSize == 0 {
+		return
+	}
+	e.parityIDs = append(e.parityIDs, id)
+	if len(e.parityIDs) < e.parityGroupSize {
+		return
+	}
+	ids := e.parityIDs
+	e.parityIDs = nil
+
+	var kfs [][]byte
+	for _, kfID := range ids {
+		kf, ok := e.sentKFs.get(kfID)
+		if !ok {
+			break
+		}
+		defer kf.Done()
+		kfs = append(kfs, kf.Slice())
+	}
+	if len(kfs) < len(ids) {
+		return
+	}
+
+	h := e.header(frameParity, id, nil)
+	h.flags &^= flagChecksum // messages are checked individually
+	payload := e.msgPool.get()
+	defer payload.Done()
+	if buildParity(payload, h, ids, kfs) != nil {
+		return
+	}
+	var err error
+	if packets, err = encodeFragments(e.pool, e.msgPool, payload.Slice(), h, e.cmpAlgr, maxFragments); err != nil {
+		return
+	}
+	e.stats.ParityFramesSent++
+	return
+}
+
+// recoverKF rebuilds the KF of the group covered by a parity frame with header
+// h that is missing from rcvdKFs, if it's the only one missing. id and data
+// are that KF; data is nil if nothing is to be rebuilt, e.g., nothing is
+// missing, or more than one is.
+//
+// Caller must hold e.mu.
+func (e *decoder) recoverKF(h header, payload []byte) (id uint32, data *ReusableSlice, err error) {
+	var members []parityMember
+	var parity []byte
+	if members, parity, err = parseParity(h, payload); err != nil {
+		return
+	}
+
+	rebuilt := e.pool.get()
+	if len(parity) > rebuilt.Cap() {
+		rebuilt.Done()
+		err = ErrMessageTooLarge
+		return
+	}
+	rebuilt.Resize(len(parity))
+	copy(rebuilt.Slice(), parity)
+	var missing *parityMember
+	for i, m := range members {
+		kf, ok := e.rcvdKFs.get(m.id)
+		if !ok {
+			if missing != nil { // more than one lost
+				rebuilt.Done()
+				return
+			}
+			missing = &members[i]
+			continue
+		}
+		held := len(kf.Slice()) == m.length && crc32.Checksum(kf.Slice(), crc32c) == m.checksum
+		if held {
+			xorInto(rebuilt.Slice(), kf.Slice())
+		}
+		kf.Done()
+		if !held { // the cached KF with the ID is a different one
+			rebuilt.Done()
+			return
+		}
+	}
+	if missing == nil {
+		rebuilt.Done()
+		return
+	}
+
+	rebuilt.Resize(missing.length)
+	if crc32.Checksum(rebuilt.Slice(), crc32c) != missing.checksum {
+		rebuilt.Done()
+		err = ErrChecksumMismatch
+		return
+	}
+	id, data = missing.id, rebuilt
+	return
+}
@@ -0,0 +1,193 @@
+package ictl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParityFormat(t *testing.T) {
+	kfs := [][]byte{[]byte("first KF"), []byte("the second KF"), []byte("third")}
+	for _, ids := range [][]uint32{{0, 8, 16}, {0x10000, 0x10008, 0x10010}} {
+		var h header
+		h.setFrameType(frameParity)
+		h.setFrameID(ids[len(ids)-1])
+		payload := newSlicePool(128).get()
+		if err := buildParity(payload, h, ids, kfs); err != nil {
+			t.Fatalf("calling buildParity() error: %v\n", err)
+		}
+		members, parity, err := parseParity(h, payload.Slice())
+		if err != nil {
+			t.Fatalf("calling parseParity() error: %v\n", err)
+		}
+		if len(members) != len(ids) || len(parity) != len(kfs[1]) {
+			t.Fatalf("unexpected parity frame: %+v, %d bytes of parity\n", members, len(parity))
+		}
+		for i, m := range members {
+			if m.id != ids[i] || m.length != len(kfs[i]) {
+				t.Fatalf("unexpected member #%d: %+v\n", i, m)
+			}
+		}
+		// rebuild the second one from the others
+		rebuilt := append([]byte(nil), parity...)
+		xorInto(rebuilt, kfs[0])
+		xorInto(rebuilt, kfs[2])
+		if !bytes.Equal(rebuilt[:members[1].length], kfs[1]) {
+			t.Fatalf("rebuilt %q; expected %q\n", rebuilt[:members[1].length], kfs[1])
+		}
+		payload.Done()
+	}
+}
+
+func TestParityRecovery(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(4).SetParityGroupSize(2))
+	// KFs differ in length, so that the parity frame covers the longest one
+	var messages [][]byte
+	for i := 0; i < 8; i++ {
+		message := bytes.Repeat([]byte{byte(i / 4)}, 64+i/4)
+		message[i%4] = byte(i)
+		messages = append(messages, message)
+	}
+	packets := encodeMessageFragments(t, sender, messages...)
+	if stats := sender.Stats(); stats.ParityFramesSent != 1 {
+		t.Fatalf("expected 1 parity frame; got %d\n", stats.ParityFramesSent)
+	}
+	sender.Close()
+	if len(packets[4]) != 2 {
+		t.Fatalf("expected the second KF to be followed by a parity frame; got %d packets\n", len(packets[4]))
+	}
+	if info, _ := ParsePacket(packets[4][1]); info.FrameType != FrameParity || info.FrameID != 4 {
+		t.Fatalf("unexpected parity frame: %v\n", info)
+	}
+
+	config := DefaultEndpointConfig().SetJitterBufferSize(8)
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	// the first KF is lost; its DFs are held until it's rebuilt
+	for i := 1; i < 8; i++ {
+		var expected []int
+		switch i {
+		case 4:
+			expected = []int{4, 0, 1, 2, 3}
+		case 5, 6, 7:
+			expected = []int{i}
+		}
+		var decoded []*ReusableSlice
+		for _, p := range packets[i] {
+			messages, err := receiver.DecodeMessages("test", p)
+			if err != nil {
+				t.Fatalf("calling DecodeMessages() error: %v\n", err)
+			}
+			decoded = append(decoded, messages...)
+		}
+		checkMessages(t, decoded, messages, expected...)
+	}
+	if stats := receiver.Stats(); stats.KFsRecovered != 1 || stats.MissingReferences != 0 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+
+	// nothing is missing
+	receiver2 := NewEndpoint(DefaultEndpointConfig())
+	defer receiver2.Close()
+	for i := 0; i < 5; i++ {
+		for j, p := range packets[i] {
+			data, err := receiver2.Decode("test", p)
+			if err != nil {
+				t.Fatalf("calling Decode() error: %v\n", err)
+			}
+			if j == 1 && data != nil {
+				t.Fatalf("expected nothing to be rebuilt\n")
+			}
+			if data != nil {
+				data.Done()
+			}
+		}
+	}
+}
+
+func TestParityTwoLost(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(4).SetParityGroupSize(2))
+	packets := encodeMessageFragments(t, sender, driftingMessages(8, 64)...)
+	sender.Close()
+	receiver := NewEndpoint(DefaultEndpointConfig())
+	defer receiver.Close()
+	// only the parity frame of the group arrives
+	if data, err := receiver.Decode("test", packets[4][1]); data != nil || err != nil {
+		t.Fatalf("expected nothing to be rebuilt; got %v, %v\n", data, err)
+	}
+	if stats := receiver.Stats(); stats.KFsRecovered != 0 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestParityPending(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(1).SetParityGroupSize(2))
+	defer sender.Close()
+	receiver := NewEndpoint(DefaultEndpointConfig())
+	defer receiver.Close()
+	messages := driftingMessages(4, 64)
+	var parity [][]byte
+	for i, message := range messages {
+		packet := encodeMessages(t, sender, message)[0]
+		if f := frameType(t, packet); f != FrameKF {
+			t.Fatalf("message #%d: expected a KF; got %v\n", i, f)
+		}
+		pending, err := sender.Pending("test")
+		if err != nil {
+			t.Fatalf("message #%d: calling Pending() error: %v\n", i, err)
+		}
+		if len(pending) != i%2 {
+			t.Fatalf("message #%d: expected %d pending frames; got %d\n", i, i%2, len(pending))
+		}
+		for _, p := range pending {
+			parity = append(parity, append([]byte(nil), p.Slice()...))
+			p.Done()
+		}
+		if i != 2 { // the first KF of the second group is lost
+			data, err := receiver.Decode("test", packet)
+			if err != nil {
+				t.Fatalf("message #%d: calling Decode() error: %v\n", i, err)
+			}
+			data.Done()
+		}
+	}
+	if stats := sender.Stats(); stats.ParityFramesSent != 2 {
+		t.Fatalf("expected 2 parity frames; got %d\n", stats.ParityFramesSent)
+	}
+
+	data, err := receiver.Decode("test", parity[1])
+	if err != nil || data == nil || !bytes.Equal(data.Slice(), messages[2]) {
+		t.Fatalf("expected message #2 to be rebuilt; got %v, %v\n", data, err)
+	}
+	data.Done()
+
+	// frames not taken are dropped at the next encode call
+	encodeMessages(t, sender, messages...)
+	encodeMessages(t, sender, messages[0])
+	if pending, _ := sender.Pending("test"); len(pending) != 0 {
+		t.Fatalf("expected pending frames to be dropped; got %d\n", len(pending))
+	}
+}
+
+func TestParityMalformed(t *testing.T) {
+	pool := newSlicePool(128)
+	for _, payload := range [][]byte{
+		{},
+		{0},
+		{maxParityGroupSize + 1},
+		{1, 0, 0},
+		{1, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0xff}, // longer than the parity
+	} {
+		var h header
+		h.setFrameType(frameParity)
+		packet, err := encodeWithHeader(pool, payload, h, CANone)
+		if err != nil {
+			t.Fatalf("calling encodeWithHeader() error: %v\n", err)
+		}
+		receiver := NewEndpoint(DefaultEndpointConfig())
+		if _, err = receiver.Decode("test", packet.Slice()); err == nil {
+			t.Fatalf("expected malformed parity frame %v to fail\n", payload)
+		}
+		receiver.Close()
+		packet.Done()
+	}
+}
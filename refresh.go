@@ -0,0 +1,211 @@
+package ictl
+
+import "errors"
+
+// max number of segments a reference is refreshed in
+const maxRefreshSlices = 255
+
+// refreshSegment returns the range of segment index of a reference of length
+// refreshed in count segments. Segments are of the same size, except that the
+// last ones may be shorter, or empty.
+func refreshSegment(length int, index int, count int) (start int, end int) {
+	size := (length + count - 1) / count
+	if start = index * size; start > length {
+		start = length
+	}
+	if end = start + size; end > length {
+		end = length
+	}
+	return
+}
+
+// hasReference returns whether a KF has been sent, which a refresh needs, as
+// the DFs carrying segments reference it.
+//
+// Caller must hold e.mu.
+func (e *encoder) hasReference() bool {
+	return len(e.sentKFs.slices) > 0
+}
+
+// encKFOrRefresh starts refreshing the reference with message data if
+// refresh is enabled and there's a reference to send DFs against, sending the
+// first segment; data is sent as a KF otherwise.
+//
+// Caller must hold e.mu.
+func (e *encoder) encKFOrRefresh(data *ReusableSlice, confidence uint8, maxFragments int) (packets []*ReusableSlice, err error) {
+	if e.refreshSlices == 0 || !e.hasReference() {
+		packets, err = e.encKF(e.idCounter, data, confidence, maxFragments)
+		return
+	}
+	data.AddOwner()
+	e.refreshData, e.refreshID, e.refreshIndex, e.refreshConfidence = data, e.idCounter, 0, confidence
+	e.stats.RefreshesSent++
+	packets, err = e.encRefreshDF(data, maxFragments)
+	return
+}
+
+// encRefreshDF sends data as a DF carrying the next segment of the reference
+// being refreshed. If that fails, e.g., because the packet doesn't fit, the
+// refresh is aborted, and data is sent as a KF instead. Once the last segment
+// is sent, the new reference is cached as a KF.
+//
+// Caller must hold e.mu.
+func (e *encoder) encRefreshDF(data *ReusableSlice, maxFragments int) (packets []*ReusableSlice, err error) {
+	if packets, err = e.encRefresh(data); err != nil {
+		confidence := e.refreshConfidence
+		e.abortRefresh()
+		packets, err = e.encKF(e.idCounter, data, confidence, maxFragments)
+		return
+	}
+	data.Done()
+	if e.refreshIndex++; e.refreshIndex < e.refreshSlices {
+		return
+	}
+	id := e.refreshID
+	e.sentKFs.put(id, e.refreshConfidence, e.refreshData) // transferring ownership
+	e.refreshData = nil
+	e.markRefreshed(id)
+	e.lastKFID = id
+	e.kfsSent++
+	packets = append(packets, e.sentKFForParity(id)...)
+	return
+}
+
+// markRefreshed records that cached KF id has been sent as a refresh,
+// forgetting KFs no longer cached
+//
+// Caller must hold e.mu.
+func (e *encoder) markRefreshed(id uint32) {
+	for old := range e.refreshed {
+		if _, ok := e.sentKFs.slices[old]; !ok {
+			delete(e.refreshed, old)
+		}
+	}
+	e.refreshed[id] = true
+}
+
+// encRefresh encodes data as a DF, with the next segment of the reference
+// being refreshed preceding the differential data. It never fragments.
+//
+// Caller must hold e.mu.
+func (e *encoder) encRefresh(data *ReusableSlice) (packets []*ReusableSlice, err error) {
+	refID, _, ref := e.sentKFs.getMostConfident(e.confidenceLookback)
+	defer ref.Done()
+	d := e.msgPool.get()
+	defer d.Done()
+	var prefixed bool
+	if prefixed, err = diff(ref.Slice(), data.Slice(), d); err != nil {
+		return
+	}
+	reference := e.refreshData.Slice()
+	start, end := refreshSegment(len(reference), e.refreshIndex, e.refreshSlices)
+	payload := e.msgPool.get()
+	defer payload.Done()
+	if end-start+len(d.Slice()) > payload.Cap() {
+		err = ErrPacketTooLarge
+		return
+	}
+	payload.Resize(end - start + len(d.Slice()))
+	copy(payload.Slice(), reference[start:end])
+	copy(payload.Slice()[end-start:], d.Slice())
+
+	h := e.header(frameDF, refID, data.Slice())
+	if e.sequence {
+		h.setSequence(e.idCounter)
+	}
+	h.setRefresh(e.refreshID, uint8(e.refreshIndex), uint8(e.refreshSlices), uint32(len(reference)))
+	if prefixed {
+		h.setLengthPrefix()
+	}
+	packets, err = encodeFragments(e.pool, e.msgPool, payload.Slice(), h, e.cmpAlgr, 1)
+	return
+}
+
+// abortRefresh drops the refresh in progress, if any
+//
+// Caller must hold e.mu.
+func (e *encoder) abortRefresh() {
+	if e.refreshData != nil {
+		e.refreshData.Done()
+		e.refreshData = nil
+	}
+}
+
+// refreshAssembly collects segments of a reference being refreshed
+type refreshAssembly struct {
+	id       uint32
+	count    uint8
+	got      []bool // by segment index
+	received int
+	data     *ReusableSlice
+}
+
+// addRefreshSegment takes the segment of a new reference that precedes the
+// differential data in payload of a DF with header h, removing it from
+// payload. Once all segments have arrived, the reference is cached as a KF.
+//
+// Caller must hold e.mu.
+func (e *decoder) addRefreshSegment(h header, payload *ReusableSlice) (err error) {
+	id, index, count, length, _ := h.getRefresh()
+	start, end := refreshSegment(int(length), int(index), int(count))
+	p := payload.Slice()
+	if len(p) < end-start {
+		err = errors.New("malformed refresh segment")
+		return
+	}
+	segment := p[:end-start]
+	defer func() {
+		copy(p, p[end-start:])
+		payload.Resize(len(p) - (end - start))
+	}()
+
+	if cached, ok := e.rcvdKFs.get(id); ok { // already complete
+		cached.Done()
+		return
+	}
+	r := e.refresh
+	if r != nil && (r.id != id || r.count != count || len(r.data.Slice()) != int(length)) {
+		if r.id != id && seqDelta(id, r.id, h.extendedIDs) < 0 { // older one
+			return
+		}
+		e.clearRefresh()
+		r = nil
+	}
+	if r == nil {
+		data := e.pool.get()
+		if int(length) > data.Cap() {
+			data.Done()
+			err = ErrMessageTooLarge
+			return
+		}
+		data.Resize(int(length))
+		r = &refreshAssembly{id: id, count: count, got: make([]bool, count), data: data}
+		e.refresh = r
+	}
+	if r.got[index] {
+		return
+	}
+	copy(r.data.Slice()[start:end], segment)
+	r.got[index] = true
+	if r.received++; r.received < int(r.count) {
+		return
+	}
+
+	kf := h
+	kf.setFrameType(frameKF)
+	kf.frameID = id
+	e.putKF(kf, r.data)
+	e.stats.RefreshesCompleted++
+	e.clearRefresh()
+	return
+}
+
+// clearRefresh drops segments collected so far
+//
+// Caller must hold e.mu.
+func (e *decoder) clearRefresh() {
+	if e.refresh != nil {
+		e.refresh.data.Done()
+		e.refresh = nil
+	}
+}
@@ -0,0 +1,209 @@
+package ictl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRefreshSegment(t *testing.T) {
+	for _, c := range []struct{ length, count int }{{256, 4}, {10, 3}, {2, 4}, {0, 1}} {
+		next := 0
+		for i := 0; i < c.count; i++ {
+			start, end := refreshSegment(c.length, i, c.count)
+			if start != next || end < start {
+				t.Fatalf("length %d, segment %d of %d: unexpected range [%d, %d)\n", c.length, i, c.count, start, end)
+			}
+			next = end
+		}
+		if next != c.length {
+			t.Fatalf("length %d, %d segments: covered %d bytes\n", c.length, c.count, next)
+		}
+	}
+}
+
+// decodeAll decodes packets in a new endpoint, checking they're decoded into
+// messages
+func decodeAll(t *testing.T, config EndpointConfig, messages [][]byte, packets [][]byte) (stats Stats) {
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	for i, packet := range packets {
+		data, err := receiver.Decode("test", packet)
+		if err != nil {
+			t.Fatalf("message #%d: calling Decode() error: %v\n", i, err)
+		}
+		if !bytes.Equal(data.Slice(), messages[i]) {
+			t.Fatalf("message #%d is decoded incorrectly\n", i)
+		}
+		data.Done()
+	}
+	return receiver.Stats()
+}
+
+func TestRefresh(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8).SetRefreshSlices(4)
+	endpoint := NewEndpoint(config)
+	defer endpoint.Close()
+	messages := driftingMessages(24, 256)
+	packets := encodeMessages(t, endpoint, messages...)
+
+	kfSize := len(packets[0])
+	for i, packet := range packets[1:] {
+		i++
+		info, err := ParsePacket(packet)
+		if err != nil {
+			t.Fatalf("message #%d: calling ParsePacket() error: %v\n", i, err)
+		}
+		if info.FrameType != FrameDF || len(packet) >= kfSize*3/4 {
+			t.Fatalf("message #%d: expected a small DF; got %d bytes: %v\n", i, len(packet), info)
+		}
+		refreshing := i >= 8 && i%8 < 4
+		if refreshing != info.HasRefresh {
+			t.Fatalf("message #%d: unexpected refresh segment: %v\n", i, info)
+		}
+		if refreshing && (info.RefreshID != uint32(i/8*8) || int(info.RefreshIndex) != i%8 || info.RefreshCount != 4) {
+			t.Fatalf("message #%d: unexpected refresh segment: %v\n", i, info)
+		}
+		// the new reference is used once complete
+		if ref := uint32((i - 4) / 8 * 8); info.FrameID != ref {
+			t.Fatalf("message #%d: references %d; expected %d\n", i, info.FrameID, ref)
+		}
+	}
+	if stats := endpoint.Stats(); stats.KFsSent != 1 || stats.RefreshesSent != 2 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+	if stats := decodeAll(t, config, messages, packets); stats.RefreshesCompleted != 2 || stats.KFsReceived != 1 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+
+	// a lost segment makes DFs referencing the new reference fail
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	for i, packet := range packets[:16] {
+		if i == 9 {
+			continue
+		}
+		data, err := receiver.Decode("test", packet)
+		if (i >= 12) != (err != nil) {
+			t.Fatalf("message #%d: unexpected error: %v\n", i, err)
+		}
+		if data != nil {
+			data.Done()
+		}
+	}
+}
+
+func TestRefreshRetransmit(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8).SetRefreshSlices(4)
+	sender := NewEndpoint(config)
+	defer sender.Close()
+	messages := driftingMessages(14, 256)
+	packets := encodeMessages(t, sender, messages...)
+
+	// a segment is lost, so DF 12 misses the new reference, and it's NACKed
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	for i, packet := range packets[:13] {
+		if i == 9 {
+			continue
+		}
+		data, err := receiver.Decode("test", packet)
+		if (i == 12) != (err != nil) {
+			t.Fatalf("message #%d: unexpected error: %v\n", i, err)
+		}
+		if data != nil {
+			data.Done()
+		}
+	}
+	nack, err := receiver.NACK("test")
+	if err != nil || nack == nil {
+		t.Fatalf("expected a NACK; got %v, %v\n", nack, err)
+	}
+	retransmitted, err := sender.Retransmit("test", nack.Slice())
+	nack.Done()
+	if err != nil || len(retransmitted) != 1 {
+		t.Fatalf("expected 1 retransmitted packet; got %d, %v\n", len(retransmitted), err)
+	}
+	defer retransmitted[0].Done()
+	info, _ := ParsePacket(retransmitted[0].Slice())
+	if info.FrameType != FrameKF || info.FrameID != 8 || !info.Retransmitted || !info.HasRefresh {
+		t.Fatalf("unexpected retransmitted packet: %v\n", info)
+	}
+
+	// message 8 has been delivered with the first segment; the reference is
+	// only cached
+	if data, err := receiver.Decode("test", retransmitted[0].Slice()); data != nil || err != nil {
+		t.Fatalf("expected the refreshed reference not to be delivered again; got %v, %v\n", data, err)
+	}
+	data, err := receiver.Decode("test", packets[13])
+	if err != nil {
+		t.Fatalf("calling Decode() error: %v\n", err)
+	}
+	if !bytes.Equal(data.Slice(), messages[13]) {
+		t.Fatalf("message #13 is decoded incorrectly\n")
+	}
+	data.Done()
+}
+
+func TestRefreshForceKeyFrame(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8).SetRefreshSlices(4)
+	endpoint := NewEndpoint(config)
+	defer endpoint.Close()
+	// a forced KF in the middle of a refresh aborts it
+	messages := driftingMessages(16, 256)
+	packets := encodeMessages(t, endpoint, messages[:10]...)
+	if err := endpoint.ForceKeyFrame("test"); err != nil {
+		t.Fatalf("calling ForceKeyFrame() error: %v\n", err)
+	}
+	packets = append(packets, encodeMessages(t, endpoint, messages[10:]...)...)
+	if info, _ := ParsePacket(packets[10]); info.FrameType != FrameKF {
+		t.Fatalf("expected a forced KF; got %v\n", info)
+	}
+	if info, _ := ParsePacket(packets[11]); info.HasRefresh || info.FrameID != 10 {
+		t.Fatalf("expected a DF referencing the forced KF; got %v\n", info)
+	}
+	if stats := decodeAll(t, config, messages, packets); stats.RefreshesCompleted != 0 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestRefreshAdaptive(t *testing.T) {
+	config := DefaultEndpointConfig().SetMaxEncoderCycleLength(16).SetRefreshSlices(4)
+	endpoint := NewEndpoint(config)
+	defer endpoint.Close()
+	messages := driftingMessages(64, 256)
+	packets := encodeMessages(t, endpoint, messages...)
+	if stats := endpoint.Stats(); stats.KFsSent != 1 || stats.RefreshesSent == 0 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+	decodeAll(t, config, messages, packets)
+}
+
+func TestRefreshJitterBuffer(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8).SetRefreshSlices(2)
+	endpoint := NewEndpoint(config)
+	defer endpoint.Close()
+	messages := driftingMessages(12, 256)
+	packets := encodeMessages(t, endpoint, messages...)
+
+	// the DF after the refresh overtakes its last segment, and is held until
+	// the new reference is complete
+	receiver := NewEndpoint(config.SetJitterBufferSize(4))
+	defer receiver.Close()
+	order := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 9, 11}
+	var expected []int
+	for _, i := range order {
+		decoded, err := receiver.DecodeMessages("test", packets[i])
+		if err != nil {
+			t.Fatalf("message #%d: calling DecodeMessages() error: %v\n", i, err)
+		}
+		switch i {
+		case 10:
+			expected = nil
+		case 9:
+			expected = []int{10, 9} // in the order they arrived
+		default:
+			expected = []int{i}
+		}
+		checkMessages(t, decoded, messages, expected...)
+	}
+}
@@ -0,0 +1,149 @@
+package ictl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKFRepeats(t *testing.T) {
+	endpoint := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(16).SetKFRepeats(2).SetKFRepeatSpacing(2))
+	defer endpoint.Close()
+	packets := encodeMessageFragments(t, endpoint, driftingMessages(8, 64)...)
+	for i, p := range packets {
+		expected := 1
+		if i == 2 || i == 4 {
+			expected = 2
+		}
+		if len(p) != expected {
+			t.Fatalf("message #%d: expected %d packets; got %d\n", i, expected, len(p))
+		}
+		if len(p) == 2 {
+			if info, _ := ParsePacket(p[1]); info.FrameType != FrameKF || info.FrameID != 0 || !info.Retransmitted {
+				t.Fatalf("message #%d: unexpected repeat: %v\n", i, info)
+			}
+		}
+	}
+	if stats := endpoint.Stats(); stats.KFsSent != 1 || stats.KFsRepeated != 2 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestKFRepeatsCancelled(t *testing.T) {
+	// a new KF cancels repeats of the previous one
+	config := DefaultEndpointConfig().SetEncoderCycleLength(2).SetKFRepeats(3)
+	endpoint := NewEndpoint(config)
+	defer endpoint.Close()
+	packets := encodeMessageFragments(t, endpoint, driftingMessages(4, 64)...)
+	if info, _ := ParsePacket(packets[3][1]); len(packets[2]) != 1 || info.FrameID != 2 {
+		t.Fatalf("expected the second KF to cancel repeats of the first one\n")
+	}
+	if stats := endpoint.Stats(); stats.KFsRepeated != 2 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+
+}
+
+func TestKFRepeatsPending(t *testing.T) {
+	// Encode returns only the packet of the message; repeats are taken with
+	// Pending
+	endpoint := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(16).SetKFRepeats(2).SetKFRepeatSpacing(2))
+	defer endpoint.Close()
+	for i, message := range driftingMessages(8, 64) {
+		encodeMessages(t, endpoint, message)
+		pending, err := endpoint.Pending("test")
+		if err != nil {
+			t.Fatalf("message #%d: calling Pending() error: %v\n", i, err)
+		}
+		expected := 0
+		if i == 2 || i == 4 {
+			expected = 1
+		}
+		if len(pending) != expected {
+			t.Fatalf("message #%d: expected %d pending frames; got %d\n", i, expected, len(pending))
+		}
+		for _, p := range pending {
+			if info, _ := ParsePacket(p.Slice()); info.FrameType != FrameKF || info.FrameID != 0 || !info.Retransmitted {
+				t.Fatalf("message #%d: unexpected repeat: %v\n", i, info)
+			}
+			p.Done()
+		}
+	}
+	if stats := endpoint.Stats(); stats.KFsRepeated != 2 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestKFRepeatsDuplicates(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(4).SetKFRepeats(1).SetSequenceNumbers(true)
+	sender := NewEndpoint(config)
+	messages := driftingMessages(8, 64)
+	packets := encodeMessageFragments(t, sender, messages...)
+	sender.Close()
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	for i, p := range packets {
+		for j, packet := range p {
+			data, err := receiver.Decode("test", packet)
+			if err != nil {
+				t.Fatalf("calling Decode() error: %v\n", err)
+			}
+			if j == 1 { // repeat of a KF received before
+				if data != nil {
+					t.Fatalf("message #%d: expected repeat to be dropped\n", i)
+				}
+				continue
+			}
+			if !bytes.Equal(data.Slice(), messages[i]) {
+				t.Fatalf("message #%d: decoded %x\n", i, data.Slice())
+			}
+			data.Done()
+		}
+	}
+	// a late repeat of the first KF doesn't move it ahead of the second one
+	if data, err := receiver.Decode("test", packets[1][1]); data != nil || err != nil {
+		t.Fatalf("expected late repeat to be dropped; got %v, %v\n", data, err)
+	}
+	report, err := receiver.Feedback("test")
+	if err != nil {
+		t.Fatalf("calling Feedback() error: %v\n", err)
+	}
+	ids, _, err := decodeFeedback(newSlicePool(1500), report.Slice())
+	report.Done()
+	if err != nil || len(ids) != 2 || ids[0] != 4 || ids[1] != 0 {
+		t.Fatalf("unexpected KFs held: %v, %v\n", ids, err)
+	}
+	// repeats are left out of sequence statistics
+	if stats := receiver.Stats(); stats.DuplicateKFs != 3 || stats.KFsReceived != 5 || stats.Duplicates != 0 || stats.OutOfOrder != 0 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestKFRepeatsLostKF(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8).SetKFRepeats(1).SetKFRepeatSpacing(2)
+	sender := NewEndpoint(config)
+	messages := driftingMessages(4, 64)
+	packets := encodeMessageFragments(t, sender, messages...)
+	sender.Close()
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	// the KF is lost; DFs before its repeat fail, and the repeat makes up for
+	// it
+	for _, packet := range [][]byte{packets[1][0], packets[2][0]} {
+		if _, err := receiver.Decode("test", packet); err == nil {
+			t.Fatalf("expected DF with missing reference to fail\n")
+		}
+	}
+	for _, c := range []struct {
+		packet  []byte
+		message int
+	}{{packets[2][1], 0}, {packets[3][0], 3}} {
+		data, err := receiver.Decode("test", c.packet)
+		if err != nil {
+			t.Fatalf("calling Decode() error: %v\n", err)
+		}
+		if !bytes.Equal(data.Slice(), messages[c.message]) {
+			t.Fatalf("decoded %x; expected message #%d\n", data.Slice(), c.message)
+		}
+		data.Done()
+	}
+}
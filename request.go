@@ -0,0 +1,121 @@
+package ictl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Requests are carried in frames of type frameRequest, sent from a decoder
+// back to the encoder of the peer, like feedback reports. The (uncompressed)
+// payload starts with one byte telling the kind of request, followed by data
+// depending on the kind. The frameID field of the header depends on the kind
+// too.
+const (
+	// requestResync asks the encoder to send a KF in its next encode call.
+	// frameID is the ID of the missing reference that made the decoder ask
+	// for it. No data follows the kind.
+	requestResync uint8 = 1
+
+	// requestNACK asks the encoder to retransmit KFs missing at the decoder.
+	// frameID is the number of KF IDs, which follow the kind in the same
+	// format as in feedback reports: big-endian uint16 each, or uint32 if the
+	// header has extended IDs.
+	requestNACK uint8 = 2
+)
+
+// min interval between resync requests of a decoder while references remain
+// missing, in case requests or the KF answering them are lost
+const resyncInterval = 200 * time.Millisecond
+
+// NACKs are rate limited per missing KF like resync requests; a KF is NACKed
+// at most maxNACKs times, and at most maxMissingRefs KFs are tracked
+const (
+	nackInterval   = resyncInterval
+	maxNACKs       = 3
+	maxMissingRefs = 16
+)
+
+func encodeRequest(pool *slicePool, kind uint8, id uint32) (packet *ReusableSlice, err error) {
+	var h header
+	h.setFrameType(frameRequest)
+	h.setFrameID(id)
+	packet, err = encodeWithHeader(pool, []byte{kind}, h, CANone)
+	return
+}
+
+func encodeNACK(pool *slicePool, ids []uint32) (packet *ReusableSlice, err error) {
+	var h header
+	h.setFrameType(frameRequest)
+	h.setFrameID(uint32(len(ids)))
+	for _, id := range ids {
+		if id > 0xFFFF {
+			h.setExtendedIDs()
+		}
+	}
+	size := feedbackIDSize(h)
+
+	payload := pool.get()
+	defer payload.Done()
+	if 1+len(ids)*size > payload.Cap() {
+		err = errors.New("NACK does not fit in a packet")
+		return
+	}
+	payload.Resize(1 + len(ids)*size)
+	payload.Slice()[0] = requestNACK
+	for i, id := range ids {
+		if size == 4 {
+			binary.BigEndian.PutUint32(payload.Slice()[1+i*size:], id)
+		} else {
+			binary.BigEndian.PutUint16(payload.Slice()[1+i*size:], uint16(id))
+		}
+	}
+	packet, err = encodeWithHeader(pool, payload.Slice(), h, CANone)
+	return
+}
+
+// decodeRequest decodes a request of any kind. id is the frameID of a resync
+// request, and ids are the KF IDs of a NACK.
+func decodeRequest(pool *slicePool, request []byte) (kind uint8, id uint32, ids []uint32, err error) {
+	var header header
+	var payload *ReusableSlice
+	if header, payload, err = decode(pool, request); err != nil {
+		return
+	}
+	defer payload.Done()
+	if header.getFrameType() != frameRequest {
+		err = fmt.Errorf("not a request (frame type %d)", header.getFrameType())
+		return
+	}
+	p := payload.Slice()
+	if len(p) < 1 {
+		err = errors.New("malformed request")
+		return
+	}
+	kind, id = p[0], header.getFrameID()
+	switch kind {
+	case requestResync:
+		if len(p) != 1 {
+			err = errors.New("malformed resync request")
+		}
+	case requestNACK:
+		size := feedbackIDSize(header)
+		if uint64(1)+uint64(id)*uint64(size) != uint64(len(p)) {
+			err = errors.New("malformed NACK")
+			return
+		}
+		ids = make([]uint32, id)
+		for i := range ids {
+			if size == 4 {
+				ids[i] = binary.BigEndian.Uint32(p[1+i*size:])
+			} else {
+				ids[i] = uint32(binary.BigEndian.Uint16(p[1+i*size:]))
+			}
+		}
+		id = 0
+	default:
+		err = fmt.Errorf("unknown request kind %d", kind)
+	}
+	return
+}
@@ -0,0 +1,266 @@
+package ictl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestForceKeyFrame(t *testing.T) {
+	endpoint := NewEndpoint(DefaultEndpointConfig().SetEncoderCycleLength(16))
+	defer endpoint.Close()
+	data := make([]byte, 64)
+	expected := []FrameType{FrameKF, FrameDF, FrameKF, FrameDF}
+	for i, e := range expected {
+		if i == 2 {
+			if err := endpoint.ForceKeyFrame("test"); err != nil {
+				t.Fatalf("calling ForceKeyFrame() error: %v\n", err)
+			}
+		}
+		data[0] = byte(i)
+		if f := frameType(t, encodeMessages(t, endpoint, data)[0]); f != e {
+			t.Fatalf("message #%d is sent as %v; expected %v\n", i, f, e)
+		}
+	}
+	if stats := endpoint.Stats(); stats.ForcedKFs != 1 || stats.KFsSent != 2 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestResyncRequest(t *testing.T) {
+	config := DefaultEndpointConfig() // adaptive; no KF is scheduled while DFs stay small
+	sender := NewEndpoint(config)
+	defer sender.Close()
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	data := make([]byte, 64)
+
+	// the first KF is lost
+	encodeMessages(t, sender, data)
+
+	request, err := receiver.ResyncRequest("test")
+	if err != nil || request != nil {
+		t.Fatalf("expected no resync request before a DF fails; got %v, %v\n", request, err)
+	}
+
+	data[0] = 1
+	packet := encodeMessages(t, sender, data)[0]
+	if f := frameType(t, packet); f != FrameDF {
+		t.Fatalf("expected a DF; got %v\n", f)
+	}
+	if _, err = receiver.Decode("test", packet); err == nil {
+		t.Fatalf("expected decoding DF with missing reference to fail\n")
+	}
+
+	if request, err = receiver.ResyncRequest("test"); err != nil || request == nil {
+		t.Fatalf("expected a resync request; got %v, %v\n", request, err)
+	}
+	if info, _ := ParsePacket(request.Slice()); info.FrameType != FrameRequest || info.FrameID != 0 {
+		t.Fatalf("unexpected request: %v\n", info)
+	}
+	if again, _ := receiver.ResyncRequest("test"); again != nil {
+		t.Fatalf("expected resync requests to be rate limited\n")
+	}
+	if err = sender.HandleFeedback("test", request.Slice()); err != nil {
+		t.Fatalf("calling HandleFeedback() error: %v\n", err)
+	}
+	request.Done()
+
+	data[0] = 2
+	if packet = encodeMessages(t, sender, data)[0]; frameType(t, packet) != FrameKF {
+		t.Fatalf("expected a KF after resync request; got %v\n", frameType(t, packet))
+	}
+	var rcvd *ReusableSlice
+	if rcvd, err = receiver.Decode("test", packet); err != nil {
+		t.Fatalf("calling Decode() error: %v\n", err)
+	}
+	rcvd.Done()
+	if request, _ = receiver.ResyncRequest("test"); request != nil {
+		t.Fatalf("expected no resync request after KF\n")
+	}
+
+	data[0] = 3
+	if packet = encodeMessages(t, sender, data)[0]; frameType(t, packet) != FrameDF {
+		t.Fatalf("expected a DF after forced KF; got %v\n", frameType(t, packet))
+	}
+	if rcvd, err = receiver.Decode("test", packet); err != nil {
+		t.Fatalf("calling Decode() error: %v\n", err)
+	}
+	rcvd.Done()
+
+	if stats := sender.Stats(); stats.ForcedKFs != 1 {
+		t.Fatalf("expected 1 forced KF; got %d\n", stats.ForcedKFs)
+	}
+	if stats := receiver.Stats(); stats.ResyncRequests != 1 {
+		t.Fatalf("expected 1 resync request; got %d\n", stats.ResyncRequests)
+	}
+}
+
+func TestRequestMalformed(t *testing.T) {
+	pool := newSlicePool(1024)
+	request, err := encodeRequest(pool, 9, 1)
+	if err != nil {
+		t.Fatalf("calling encodeRequest() error: %v\n", err)
+	}
+	defer request.Done()
+	endpoint := NewEndpoint(DefaultEndpointConfig())
+	defer endpoint.Close()
+	if err = endpoint.HandleFeedback("test", request.Slice()); err == nil {
+		t.Fatalf("expected unknown request kind to be rejected\n")
+	}
+}
+
+func TestNACKRetransmit(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8)
+	sender := NewEndpoint(config)
+	defer sender.Close()
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	data := make([]byte, 64)
+
+	// the first KF is lost
+	lost := encodeMessages(t, sender, data)[0]
+	kf := append([]byte(nil), data...)
+
+	data[0] = 1
+	packet := encodeMessages(t, sender, data)[0]
+	if _, err := receiver.Decode("test", packet); err == nil {
+		t.Fatalf("expected decoding DF with missing reference to fail\n")
+	}
+
+	nack, err := receiver.NACK("test")
+	if err != nil || nack == nil {
+		t.Fatalf("expected a NACK; got %v, %v\n", nack, err)
+	}
+	if again, _ := receiver.NACK("test"); again != nil {
+		t.Fatalf("expected NACKs to be rate limited\n")
+	}
+	if err = sender.HandleFeedback("test", nack.Slice()); err == nil {
+		t.Fatalf("expected HandleFeedback() to reject a NACK\n")
+	}
+
+	var packets []*ReusableSlice
+	if packets, err = sender.Retransmit("test", nack.Slice()); err != nil || len(packets) != 1 {
+		t.Fatalf("expected 1 retransmitted packet; got %d, %v\n", len(packets), err)
+	}
+	if again, _ := sender.Retransmit("test", nack.Slice()); len(again) != 0 {
+		t.Fatalf("expected retransmissions to be rate limited\n")
+	}
+	nack.Done()
+	info, _ := ParsePacket(packets[0].Slice())
+	if info.FrameType != FrameKF || info.FrameID != 0 || !info.Retransmitted {
+		t.Fatalf("unexpected retransmitted packet: %v\n", info)
+	}
+	original, _ := ParsePacket(lost)
+	if original.Retransmitted || info.PayloadLength != original.PayloadLength {
+		t.Fatalf("retransmitted KF doesn't match original: %v, %v\n", info, original)
+	}
+
+	var rcvd *ReusableSlice
+	if rcvd, err = receiver.Decode("test", packets[0].Slice()); err != nil {
+		t.Fatalf("calling Decode() error: %v\n", err)
+	}
+	if !bytes.Equal(rcvd.Slice(), kf) {
+		t.Fatalf("retransmitted KF is decoded incorrectly\n")
+	}
+	rcvd.Done()
+	if rcvd, err = receiver.Decode("test", packets[0].Slice()); err != nil || rcvd != nil {
+		t.Fatalf("expected duplicate retransmitted KF to be dropped; got %v, %v\n", rcvd, err)
+	}
+	packets[0].Done()
+	if nack, _ = receiver.NACK("test"); nack != nil {
+		t.Fatalf("expected no NACK after KF arrived\n")
+	}
+
+	data[0] = 2
+	packet = encodeMessages(t, sender, data)[0]
+	if rcvd, err = receiver.Decode("test", packet); err != nil {
+		t.Fatalf("calling Decode() error: %v\n", err)
+	}
+	rcvd.Done()
+
+	if stats := sender.Stats(); stats.KFsRetransmitted != 1 || stats.KFsSent != 1 {
+		t.Fatalf("unexpected sender stats: %+v\n", stats)
+	}
+	if stats := receiver.Stats(); stats.NACKs != 1 || stats.DuplicateKFs != 1 {
+		t.Fatalf("unexpected receiver stats: %+v\n", stats)
+	}
+}
+
+func TestNACKDisabled(t *testing.T) {
+	sender := NewEndpoint(DefaultEndpointConfig().SetMaxRetransmits(0))
+	defer sender.Close()
+	encodeMessages(t, sender, make([]byte, 64))
+	pool := newSlicePool(1024)
+	nack, err := encodeNACK(pool, []uint32{0})
+	if err != nil {
+		t.Fatalf("calling encodeNACK() error: %v\n", err)
+	}
+	defer nack.Done()
+	var packets []*ReusableSlice
+	if packets, err = sender.Retransmit("test", nack.Slice()); err != nil || len(packets) != 0 {
+		t.Fatalf("expected no retransmission; got %d, %v\n", len(packets), err)
+	}
+}
+
+func TestNACKFormat(t *testing.T) {
+	pool := newSlicePool(1024)
+	for _, ids := range [][]uint32{{1}, {3, 2, 0xFFFF}, {5, 0x10000}} {
+		nack, err := encodeNACK(pool, ids)
+		if err != nil {
+			t.Fatalf("calling encodeNACK() error: %v\n", err)
+		}
+		kind, _, decoded, err := decodeRequest(pool, nack.Slice())
+		nack.Done()
+		if err != nil || kind != requestNACK {
+			t.Fatalf("calling decodeRequest() error: %v, kind %d\n", err, kind)
+		}
+		if len(decoded) != len(ids) {
+			t.Fatalf("decoded %v; expected %v\n", decoded, ids)
+		}
+		for i := range ids {
+			if decoded[i] != ids[i] {
+				t.Fatalf("decoded %v; expected %v\n", decoded, ids)
+			}
+		}
+	}
+}
+
+func TestRetransmitNotSequenced(t *testing.T) {
+	// the KF arrives, but a NACK sent for it, e.g., before it was reordered,
+	// still makes the sender retransmit it
+	config := DefaultEndpointConfig().SetEncoderCycleLength(8).SetSequenceNumbers(true)
+	sender := NewEndpoint(config)
+	defer sender.Close()
+	receiver := NewEndpoint(config)
+	defer receiver.Close()
+	data := make([]byte, 64)
+	for i, packet := range encodeMessages(t, sender, data, data) {
+		rcvd, err := receiver.Decode("test", packet)
+		if err != nil {
+			t.Fatalf("message #%d: calling Decode() error: %v\n", i, err)
+		}
+		rcvd.Done()
+	}
+
+	nack, err := encodeNACK(newSlicePool(1024), []uint32{0})
+	if err != nil {
+		t.Fatalf("calling encodeNACK() error: %v\n", err)
+	}
+	defer nack.Done()
+	var packets []*ReusableSlice
+	if packets, err = sender.Retransmit("test", nack.Slice()); err != nil || len(packets) != 1 {
+		t.Fatalf("expected 1 retransmitted packet; got %d, %v\n", len(packets), err)
+	}
+	defer releasePackets(packets)
+	var rcvd *ReusableSlice
+	var seq SequenceInfo
+	if rcvd, seq, err = receiver.DecodeWithSequence("test", packets[0].Slice()); err != nil || rcvd != nil {
+		t.Fatalf("expected duplicate retransmitted KF to be dropped; got %v, %v\n", rcvd, err)
+	}
+	if seq.Known {
+		t.Fatalf("expected retransmitted KF not to be sequenced; got %+v\n", seq)
+	}
+	if stats := receiver.Stats(); stats.Duplicates != 0 || stats.OutOfOrder != 0 || stats.DuplicateKFs != 1 {
+		t.Fatalf("unexpected receiver stats: %+v\n", stats)
+	}
+}
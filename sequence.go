@@ -0,0 +1,86 @@
+package ictl
+
+// SequenceInfo describes how a decoded message relates to messages received
+// before it in the same context, based on sequence numbers assigned by the
+// encoder.
+type SequenceInfo struct {
+	Seq uint32 // at most 0xFFFF unless the encoder has ExtendedIDs enabled
+
+	// Known is false if the stream doesn't carry sequence numbers, i.e., the
+	// encoder doesn't have SequenceNumbers enabled. Other fields are not
+	// meaningful then.
+	Known bool
+
+	// number of sequence numbers skipped between the highest one received
+	// before and Seq; these messages are lost or yet to arrive
+	Gap int
+
+	// Seq has been received before
+	Duplicate bool
+
+	// Seq is lower than the highest one received before, i.e., the message
+	// arrived late, after messages sent after it
+	OutOfOrder bool
+}
+
+// sequenceTracker keeps track of sequence numbers received in a context
+type sequenceTracker struct {
+	highest  uint32
+	started  bool
+	disabled bool   // set once a DF without sequence number arrives
+	received uint64 // bit i is set if highest-i has been received
+}
+
+// track records arrival of a frame with header h
+func (t *sequenceTracker) track(h header) (info SequenceInfo) {
+	seq, ok := h.getSequence()
+	if !ok {
+		t.disabled = true
+	}
+	if t.disabled {
+		return
+	}
+	info.Seq, info.Known = seq, true
+
+	if !t.started {
+		t.started = true
+		t.highest = seq
+		t.received = 1
+		return
+	}
+
+	delta := seqDelta(seq, t.highest, h.extendedIDs)
+	switch {
+	case delta > 0:
+		info.Gap = int(delta) - 1
+		if delta < 64 {
+			t.received = t.received<<uint(delta) | 1
+		} else {
+			t.received = 1
+		}
+		t.highest = seq
+	case delta == 0:
+		info.Duplicate = true
+	default:
+		back := uint(-int64(delta))
+		if back < 64 && t.received&(1<<back) != 0 {
+			info.Duplicate = true
+		} else {
+			info.OutOfOrder = true
+			if back < 64 {
+				t.received |= 1 << back
+			}
+		}
+	}
+	return
+}
+
+// seqDelta returns how far sequence number (or KF ID) a is after b, negative
+// if a is before b, taking wrap-around into account
+func seqDelta(a, b uint32, extended bool) int32 {
+	if extended {
+		return int32(a - b)
+	}
+	// 16-bit sequence numbers wrap around at 1<<16
+	return int32(int16(uint16(a) - uint16(b)))
+}
@@ -0,0 +1,119 @@
+package ictl
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSequenceNumbers(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(100).SetSequenceNumbers(true)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	var packets []*ReusableSlice
+	for i := 0; i < 8; i++ {
+		packet, err := sender.Encode("test", []byte(fmt.Sprintf("message #%d", i)), 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		packets = append(packets, packet)
+	}
+	defer releasePackets(packets)
+
+	for _, c := range []struct {
+		index    int
+		expected SequenceInfo
+	}{
+		{0, SequenceInfo{Seq: 0, Known: true}},
+		{1, SequenceInfo{Seq: 1, Known: true}},
+		{4, SequenceInfo{Seq: 4, Known: true, Gap: 2}},
+		{4, SequenceInfo{Seq: 4, Known: true, Duplicate: true}},
+		{2, SequenceInfo{Seq: 2, Known: true, OutOfOrder: true}},
+		{2, SequenceInfo{Seq: 2, Known: true, Duplicate: true}},
+		{5, SequenceInfo{Seq: 5, Known: true}},
+		{7, SequenceInfo{Seq: 7, Known: true, Gap: 1}},
+	} {
+		data, seq, err := receiver.DecodeWithSequence("test", packets[c.index].Slice())
+		if err != nil {
+			t.Fatalf("calling receiver.DecodeWithSequence() error: %v\n", err)
+		}
+		data.Done()
+		if seq != c.expected {
+			t.Fatalf("packet #%d: got %+v; expected %+v\n", c.index, seq, c.expected)
+		}
+	}
+
+	stats, _ := receiver.ContextStats("test")
+	if stats.MessagesLost != 2 || stats.Duplicates != 2 || stats.OutOfOrder != 1 {
+		t.Fatalf("unexpected stats: lost %d, duplicates %d, out of order %d\n", stats.MessagesLost, stats.Duplicates, stats.OutOfOrder)
+	}
+}
+
+func TestSequenceNumbersDisabled(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(100)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	for i := 0; i < 3; i++ {
+		packet, err := sender.Encode("test", []byte(fmt.Sprintf("message #%d", i)), 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		data, seq, err := receiver.DecodeWithSequence("test", packet.Slice())
+		packet.Done()
+		if err != nil {
+			t.Fatalf("calling receiver.DecodeWithSequence() error: %v\n", err)
+		}
+		data.Done()
+		if i > 0 && seq.Known {
+			t.Fatalf("sequence should be unknown for DFs without sequence numbers\n")
+		}
+	}
+}
+
+func TestIDWrapAround(t *testing.T) {
+	for _, extended := range []bool{false, true} {
+		config := DefaultEndpointConfig().SetEncoderCycleLength(2).SetSequenceNumbers(true).SetExtendedIDs(extended)
+		sender := NewEndpoint(config)
+		receiver := NewEndpoint(config)
+
+		enc, err := sender.(*endpoint).getEncoder("test")
+		if err != nil {
+			t.Fatalf("getting encoder error: %v\n", err)
+		}
+		enc.idCounter = 0xFFFE
+
+		for i := 0; i < 6; i++ {
+			message := []byte(fmt.Sprintf("message #%d", i))
+			packet, err := sender.Encode("test", message, 0)
+			if err != nil {
+				t.Fatalf("calling sender.Encode() error: %v\n", err)
+			}
+			h, _, err := readHeader(packet.Slice())
+			if err != nil {
+				t.Fatalf("reading header error: %v\n", err)
+			}
+			if (h.version() == headerVersion2) != extended {
+				t.Fatalf("packet #%d has header version %d with ExtendedIDs %v\n", i, h.version(), extended)
+			}
+
+			data, seq, err := receiver.DecodeWithSequence("test", packet.Slice())
+			packet.Done()
+			if err != nil {
+				t.Fatalf("calling receiver.DecodeWithSequence() error: %v\n", err)
+			}
+			if string(data.Slice()) != string(message) {
+				t.Fatalf("decoded %q; expected %q\n", data.Slice(), message)
+			}
+			data.Done()
+
+			expected := uint32(0xFFFE + i)
+			if !extended {
+				expected &= 0xFFFF
+			}
+			if seq.Seq != expected || seq.Gap != 0 || seq.OutOfOrder || seq.Duplicate {
+				t.Fatalf("packet #%d: unexpected %+v; expected seq %d\n", i, seq, expected)
+			}
+		}
+	}
+}
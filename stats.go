@@ -0,0 +1,167 @@
+package ictl
+
+// Stats holds counters of a context, or of all contexts of an Endpoint.
+type Stats struct {
+	// encoder side
+	MessagesEncoded  uint64
+	RawBytes         uint64 // size of messages before encoding
+	EncodedBytes     uint64 // size of packets produced from them
+	KFsSent          uint64
+	DFsSent          uint64
+	ForcedKFs        uint64 // KFs sent due to ForceKeyFrame or resync requests
+	KFsRetransmitted uint64 // in answer to NACKs; not counted in KFsSent
+	ParityFramesSent uint64 // see SetParityGroupSize
+	KFsRepeated      uint64 // see SetKFRepeats; not counted in KFsSent
+	RefreshesSent    uint64 // references refreshed in segments; see SetRefreshSlices
+
+	// number of packets sent with each compression algorithm, indexed by
+	// CompressionAlgorithm; useful to see what CAAuto picks
+	Algorithms [CAAuto]uint64
+
+	// decoder side
+	PacketsReceived    uint64
+	ReceivedBytes      uint64
+	MessagesDecoded    uint64
+	DecodedBytes       uint64
+	KFsReceived        uint64
+	DFsReceived        uint64
+	MissingReferences  uint64 // DFs that couldn't be decoded due to missing KF
+	ResyncRequests     uint64 // built by ResyncRequest
+	NACKs              uint64 // built by NACK
+	DuplicateKFs       uint64 // KFs received again, e.g., retransmitted or repeated ones
+	DFsHeld            uint64 // put in the jitter buffer for missing reference
+	KFsRecovered       uint64 // rebuilt from parity frames
+	RefreshesCompleted uint64 // references assembled from refresh segments
+
+	// based on sequence numbers, if the encoder has SequenceNumbers enabled
+	MessagesLost uint64 // skipped sequence numbers that haven't arrived late
+	Duplicates   uint64
+	OutOfOrder   uint64
+
+	// ratio of recent DFs that could be decoded. For an Endpoint, it's the
+	// average of live contexts weighted by their DFsReceived.
+	DeliveryRatio float64
+}
+
+// Saving returns the portion of bandwidth saved by encoding, i.e.,
+// 1 - EncodedBytes / RawBytes.
+func (s Stats) Saving() float64 {
+	if s.RawBytes == 0 {
+		return 0
+	}
+	return 1 - float64(s.EncodedBytes)/float64(s.RawBytes)
+}
+
+// add adds counters in o to s. DeliveryRatio is left untouched.
+func (s *Stats) add(o Stats) {
+	s.MessagesEncoded += o.MessagesEncoded
+	s.RawBytes += o.RawBytes
+	s.EncodedBytes += o.EncodedBytes
+	s.KFsSent += o.KFsSent
+	s.DFsSent += o.DFsSent
+	s.ForcedKFs += o.ForcedKFs
+	s.KFsRetransmitted += o.KFsRetransmitted
+	s.ParityFramesSent += o.ParityFramesSent
+	s.KFsRepeated += o.KFsRepeated
+	s.RefreshesSent += o.RefreshesSent
+	for i := range s.Algorithms {
+		s.Algorithms[i] += o.Algorithms[i]
+	}
+	s.PacketsReceived += o.PacketsReceived
+	s.ReceivedBytes += o.ReceivedBytes
+	s.MessagesDecoded += o.MessagesDecoded
+	s.DecodedBytes += o.DecodedBytes
+	s.KFsReceived += o.KFsReceived
+	s.DFsReceived += o.DFsReceived
+	s.MissingReferences += o.MissingReferences
+	s.ResyncRequests += o.ResyncRequests
+	s.NACKs += o.NACKs
+	s.DuplicateKFs += o.DuplicateKFs
+	s.DFsHeld += o.DFsHeld
+	s.KFsRecovered += o.KFsRecovered
+	s.RefreshesCompleted += o.RefreshesCompleted
+	s.MessagesLost += o.MessagesLost
+	s.Duplicates += o.Duplicates
+	s.OutOfOrder += o.OutOfOrder
+}
+
+func (s *Stats) encoded(rawSize int, packets []*ReusableSlice) {
+	h, _, _ := readHeader(packets[0].Slice()) // written by encoder; can't fail
+	s.MessagesEncoded++
+	s.RawBytes += uint64(rawSize)
+	for _, p := range packets {
+		s.EncodedBytes += uint64(len(p.Slice()))
+	}
+	if h.getFrameType() == frameKF {
+		s.KFsSent++
+	} else {
+		s.DFsSent++
+	}
+	for _, p := range packets { // parity frames may follow a KF
+		h, _, _ = readHeader(p.Slice())
+		s.Algorithms[h.getCompressionAlgorithm()]++
+	}
+}
+
+func (s *Stats) sequenced(seq SequenceInfo) {
+	s.MessagesLost += uint64(seq.Gap)
+	if seq.Duplicate {
+		s.Duplicates++
+	}
+	if seq.OutOfOrder {
+		s.OutOfOrder++
+		if s.MessagesLost > 0 {
+			s.MessagesLost--
+		}
+	}
+}
+
+func (s *Stats) received(packet []byte) {
+	s.PacketsReceived++
+	s.ReceivedBytes += uint64(len(packet))
+}
+
+// stats returns counters of the context, holding locks of its encoder and
+// decoder
+func (c *endpointContext) stats() (stats Stats) {
+	if c.enc != nil {
+		c.enc.mu.Lock()
+		stats.add(c.enc.stats)
+		c.enc.mu.Unlock()
+	}
+	if c.dec != nil {
+		c.dec.mu.Lock()
+		stats.add(c.dec.stats)
+		c.dec.mu.Unlock()
+	}
+	stats.DeliveryRatio = c.dStats.successRatio()
+	return
+}
+
+func (e *endpoint) Stats() (stats Stats) {
+	e.mapMu.Lock()
+	defer e.mapMu.Unlock()
+	stats = e.closedStats
+	var ratioSum, weights float64
+	for _, c := range e.contexts {
+		s := c.stats()
+		stats.add(s)
+		ratioSum += s.DeliveryRatio * float64(s.DFsReceived)
+		weights += float64(s.DFsReceived)
+	}
+	stats.DeliveryRatio = 1
+	if weights > 0 {
+		stats.DeliveryRatio = ratioSum / weights
+	}
+	return
+}
+
+func (e *endpoint) ContextStats(context string) (stats Stats, ok bool) {
+	e.mapMu.Lock()
+	defer e.mapMu.Unlock()
+	c := e.contexts[context]
+	if ok = c != nil; ok {
+		stats = c.stats()
+	}
+	return
+}
@@ -0,0 +1,57 @@
+package ictl
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	config := DefaultEndpointConfig().SetEncoderCycleLength(5).SetCompressionAlgorithm(CAFlate)
+	sender := NewEndpoint(config)
+	receiver := NewEndpoint(config)
+
+	var raw uint64
+	for i := 0; i < 10; i++ {
+		msg := []byte(fmt.Sprintf("vehicle status #%d: speed=%d heading=%d", i, 40+i%3, 180))
+		raw += uint64(len(msg))
+		packet, err := sender.Encode("test", msg, 0)
+		if err != nil {
+			t.Fatalf("calling sender.Encode() error: %v\n", err)
+		}
+		if i != 5 { // drop the 2nd KF
+			if data, err := receiver.Decode("test", packet.Slice()); err == nil {
+				data.Done()
+			}
+		}
+		packet.Done()
+	}
+
+	s, ok := sender.ContextStats("test")
+	if !ok {
+		t.Fatalf("sender.ContextStats() did not find context\n")
+	}
+	if s.MessagesEncoded != 10 || s.KFsSent != 2 || s.DFsSent != 8 || s.RawBytes != raw {
+		t.Fatalf("unexpected sender stats: %+v\n", s)
+	}
+	if s.Algorithms[CAFlate] != 10 {
+		t.Fatalf("expected 10 packets compressed with CAFlate; got %v\n", s.Algorithms)
+	}
+
+	r, _ := receiver.ContextStats("test")
+	if r.PacketsReceived != 9 || r.MessagesDecoded != 5 || r.KFsReceived != 1 || r.MissingReferences != 4 {
+		t.Fatalf("unexpected receiver stats: %+v\n", r)
+	}
+	if r.DeliveryRatio >= 1 {
+		t.Fatalf("delivery ratio should drop after missing references; got %f\n", r.DeliveryRatio)
+	}
+
+	if err := sender.CloseContext("test"); err != nil {
+		t.Fatalf("calling sender.CloseContext() error: %v\n", err)
+	}
+	if _, ok = sender.ContextStats("test"); ok {
+		t.Fatalf("closed context should not have stats\n")
+	}
+	if total := sender.Stats(); total.MessagesEncoded != 10 || total.EncodedBytes != s.EncodedBytes {
+		t.Fatalf("endpoint stats should include closed contexts: %+v\n", total)
+	}
+}